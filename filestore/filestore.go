@@ -0,0 +1,133 @@
+// Package filestore keeps NFA attachments in a configurable backend: a local
+// directory or an S3-compatible bucket.
+package filestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when no object is stored under the key.
+	ErrNotFound = errors.New("file not found")
+	// ErrInvalidKey is returned for keys that could escape the store, such
+	// as ones containing "..".
+	ErrInvalidKey = errors.New("invalid file key")
+)
+
+// Info describes a stored object. ContentType may be empty when the backend
+// does not record it.
+type Info struct {
+	Key         string
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+}
+
+// Object is an open stored object. It can seek, so it can be passed to
+// http.ServeContent to answer range requests.
+type Object interface {
+	io.ReadSeekCloser
+	Info() Info
+}
+
+// Store is an attachment backend.
+type Store interface {
+	// Put streams r into the object under key, replacing any existing one.
+	Put(ctx context.Context, key string, r io.Reader, contentType string) error
+	// Open returns the object under key, or ErrNotFound.
+	Open(ctx context.Context, key string) (Object, error)
+	// Delete removes the object under key. Deleting a missing object is not
+	// an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// Presigner is implemented by stores that can hand out time-limited URLs
+// clients download from directly.
+type Presigner interface {
+	PresignGet(key string, expires time.Duration) (string, error)
+}
+
+// ValidKey reports whether key is a relative, slash-separated path without
+// empty, "." or ".." segments.
+func ValidKey(key string) bool {
+	if key == "" || strings.ContainsAny(key, "\\\x00") {
+		return false
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// Exists reports whether an object is stored under key.
+func Exists(ctx context.Context, store Store, key string) (bool, error) {
+	object, err := store.Open(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	object.Close()
+	return true, nil
+}
+
+// defaultLocalDir is used when FILE_STORE_DIR is not set.
+const defaultLocalDir = "/var/nfa/uploads/"
+
+var store Store
+
+// Init configures the store from the environment:
+//
+//	FILE_STORE       "local" (default) or "s3"
+//	FILE_STORE_DIR   directory of the local store
+//	S3_ENDPOINT      e.g. https://s3.ap-south-1.amazonaws.com or http://localhost:9000
+//	S3_REGION        defaults to us-east-1
+//	S3_BUCKET, S3_ACCESS_KEY, S3_SECRET_KEY
+//	S3_PATH_STYLE    "false" for virtual-hosted buckets; path style suits MinIO
+func Init() (Store, error) {
+	switch backend := os.Getenv("FILE_STORE"); backend {
+	case "", "local":
+		dir := os.Getenv("FILE_STORE_DIR")
+		if dir == "" {
+			dir = defaultLocalDir
+		}
+		local, err := NewLocal(dir)
+		if err != nil {
+			return nil, err
+		}
+		store = local
+	case "s3":
+		region := os.Getenv("S3_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		s3, err := NewS3(S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    region,
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			PathStyle: os.Getenv("S3_PATH_STYLE") != "false",
+		})
+		if err != nil {
+			return nil, err
+		}
+		store = s3
+	default:
+		return nil, fmt.Errorf("unknown FILE_STORE %q", backend)
+	}
+	return store, nil
+}
+
+// Get returns the store configured by Init.
+func Get() Store {
+	return store
+}
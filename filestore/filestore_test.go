@@ -0,0 +1,31 @@
+package filestore
+
+import "testing"
+
+func TestValidKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"quote.pdf", true},
+		{"2024/05/quote.pdf", true},
+		{"a/.hidden", true},
+		{"a/..b/c", true},
+		{"", false},
+		{"/etc/passwd", false},
+		{"../secret", false},
+		{"a/../../secret", false},
+		{"a/./b", false},
+		{".", false},
+		{"..", false},
+		{"a//b", false},
+		{"a/", false},
+		{`a\..\b`, false},
+		{"a\x00b", false},
+	}
+	for _, tt := range tests {
+		if got := ValidKey(tt.key); got != tt.want {
+			t.Errorf("ValidKey(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,458 @@
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3PartSize is the size of each part of a multipart upload, and the most an
+// upload buffers in memory. S3 requires at least 5 MiB for all but the last
+// part.
+const s3PartSize = 8 << 20
+
+// S3Config locates a bucket on AWS S3 or a compatible server such as MinIO.
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses objects as endpoint/bucket/key instead of
+	// bucket.endpoint/key
+	PathStyle bool
+}
+
+// S3 keeps objects in an S3-compatible bucket. Requests are signed with
+// AWS Signature Version 4.
+type S3 struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3 returns a store for the configured bucket.
+func NewS3(config S3Config) (*S3, error) {
+	if config.Endpoint == "" || config.Bucket == "" || config.AccessKey == "" || config.SecretKey == "" {
+		return nil, errors.New("S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY are required")
+	}
+	endpoint, err := url.Parse(strings.TrimRight(config.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT %q", config.Endpoint)
+	}
+	return &S3{config: config, endpoint: endpoint, client: &http.Client{}}, nil
+}
+
+// objectURL returns the URL of the object stored under key.
+func (s *S3) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	path := "/" + key
+	if s.config.PathStyle {
+		path = "/" + s.config.Bucket + path
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+	}
+	u.Path = s.endpoint.Path + path
+	u.RawPath = s.endpoint.EscapedPath() + s3Escape(path)
+	u.RawQuery = s3Query(query)
+	return &u
+}
+
+// do signs and sends a request. body may be nil.
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	if body == nil {
+		req.Body = http.NoBody
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.sign(req, sha256Hex(body), time.Now().UTC())
+	return s.client.Do(req)
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	if !ValidKey(key) {
+		return ErrInvalidKey
+	}
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+
+	// Small objects go up in a single request
+	part, err := readPart(r)
+	if err != nil {
+		return fmt.Errorf("failed to read upload: %v", err)
+	}
+	if len(part) < s3PartSize {
+		resp, err := s.do(ctx, http.MethodPut, key, nil, header, part)
+		if err != nil {
+			return err
+		}
+		return s3Check(resp, nil)
+	}
+	return s.putMultipart(ctx, key, header, part, r)
+}
+
+// putMultipart uploads first and the rest of r part by part, aborting the
+// upload if any part fails.
+func (s *S3) putMultipart(ctx context.Context, key string, header http.Header, first []byte, r io.Reader) (err error) {
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := s3Check(resp, &initiated); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			// Use a fresh context: the request's may be what failed
+			if resp, abortErr := s.do(context.Background(), http.MethodDelete, key,
+				url.Values{"uploadId": {initiated.UploadID}}, nil, nil); abortErr == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+
+	type completedPart struct {
+		PartNumber int
+		ETag       string
+	}
+	var parts []completedPart
+	for part := first; len(part) > 0; {
+		number := len(parts) + 1
+		resp, err := s.do(ctx, http.MethodPut, key, url.Values{
+			"partNumber": {strconv.Itoa(number)},
+			"uploadId":   {initiated.UploadID},
+		}, nil, part)
+		if err != nil {
+			return err
+		}
+		if err := s3Check(resp, nil); err != nil {
+			return err
+		}
+		parts = append(parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+
+		if part, err = readPart(r); err != nil {
+			return fmt.Errorf("failed to read upload: %v", err)
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err = s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {initiated.UploadID}}, nil, body)
+	if err != nil {
+		return err
+	}
+	// A completion can fail after a 200 status; the error is in the body
+	var completed struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := s3Check(resp, &completed); err != nil {
+		return err
+	}
+	if completed.XMLName.Local == "Error" {
+		return fmt.Errorf("S3 error %s: %s", completed.Code, completed.Message)
+	}
+	return nil
+}
+
+// Open only reads the object's metadata; its content is fetched when it is
+// read, starting at the current offset.
+func (s *S3) Open(ctx context.Context, key string) (Object, error) {
+	if !ValidKey(key) {
+		return nil, ErrInvalidKey
+	}
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := s3Check(resp, nil); err != nil {
+		return nil, err
+	}
+	info := Info{Key: key, Size: resp.ContentLength, ContentType: resp.Header.Get("Content-Type")}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+	return &s3Object{store: s, ctx: ctx, info: info}, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if !ValidKey(key) {
+		return ErrInvalidKey
+	}
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := s3Check(resp, nil); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// PresignGet returns a URL that downloads the object until it expires. S3
+// accepts at most seven days.
+func (s *S3) PresignGet(key string, expires time.Duration) (string, error) {
+	if !ValidKey(key) {
+		return "", ErrInvalidKey
+	}
+	if expires <= 0 || expires > 7*24*time.Hour {
+		return "", errors.New("expiry must be between 1 second and 7 days")
+	}
+	return s.presign(key, expires, time.Now().UTC()), nil
+}
+
+// presign builds the URL PresignGet returns for a request made at now.
+func (s *S3) presign(key string, expires time.Duration, now time.Time) string {
+	scope := s.scope(now)
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.config.AccessKey + "/" + scope},
+		"X-Amz-Date":          {now.Format("20060102T150405Z")},
+		"X-Amz-Expires":       {strconv.Itoa(int(expires.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	u := s.objectURL(key, query)
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	signature := s.signature(now, canonical)
+	u.RawQuery += "&X-Amz-Signature=" + signature
+	return u.String()
+}
+
+// sign adds the Authorization header of Signature Version 4.
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || lower == "range" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKey, s.scope(now), signedHeaders, s.signature(now, canonical)))
+}
+
+func (s *S3) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.config.Region + "/s3/aws4_request"
+}
+
+func (s *S3) signature(now time.Time, canonicalRequest string) string {
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format("20060102T150405Z"),
+		s.scope(now),
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+type s3Object struct {
+	store  *S3
+	ctx    context.Context
+	info   Info
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) Info() Info {
+	return o.info
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.info.Size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", o.offset)}}
+		resp, err := o.store.do(o.ctx, http.MethodGet, o.info.Key, nil, header, nil)
+		if err != nil {
+			return 0, err
+		}
+		if err := s3Status(resp); err != nil {
+			resp.Body.Close()
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+// Seek moves the offset; the next Read requests the object from there.
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.info.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if offset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body != nil {
+		return o.body.Close()
+	}
+	return nil
+}
+
+// s3Check closes the response, decoding its XML body into v when the request
+// succeeded and v is not nil.
+func s3Check(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	if err := s3Status(resp); err != nil {
+		return err
+	}
+	if v != nil {
+		return xml.NewDecoder(resp.Body).Decode(v)
+	}
+	return nil
+}
+
+// s3Status turns an error response into an error. It does not close the
+// body.
+func s3Status(resp *http.Response) error {
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&s3Err) == nil && s3Err.Code != "" {
+		return fmt.Errorf("S3 error %s: %s", s3Err.Code, s3Err.Message)
+	}
+	return fmt.Errorf("S3 request failed: %s", resp.Status)
+}
+
+// readPart reads up to s3PartSize bytes; it returns an empty slice at the end
+// of r.
+func readPart(r io.Reader) ([]byte, error) {
+	buf := make([]byte, s3PartSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+// s3Escape encodes a key the way Signature Version 4 expects: every byte
+// except unreserved characters and the path separator.
+func s3Escape(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		ch := key[i]
+		if ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' || ch == '/' {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes query parameters sorted by name, as the canonical request
+// requires.
+func s3Query(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, strings.ReplaceAll(s3Escape(name), "/", "%2F")+"="+strings.ReplaceAll(s3Escape(value), "/", "%2F"))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,59 @@
+package filestore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrSigningDisabled is returned when FILE_URL_SECRET is not set.
+	ErrSigningDisabled = errors.New("signed file URLs are not configured")
+	// ErrBadSignature is returned for a signature that does not match or has
+	// expired.
+	ErrBadSignature = errors.New("invalid or expired signature")
+)
+
+func urlSecret() ([]byte, error) {
+	secret := os.Getenv("FILE_URL_SECRET")
+	if secret == "" {
+		return nil, ErrSigningDisabled
+	}
+	return []byte(secret), nil
+}
+
+func urlSignature(secret []byte, key string, expires int64) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(key + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns the signature that lets anyone holding it download key until
+// expires, as a Unix time.
+func Sign(key string, expires time.Time) (string, error) {
+	secret, err := urlSecret()
+	if err != nil {
+		return "", err
+	}
+	return urlSignature(secret, key, expires.Unix()), nil
+}
+
+// Verify checks a signature made by Sign.
+func Verify(key, expires, signature string) error {
+	secret, err := urlSecret()
+	if err != nil {
+		return err
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return ErrBadSignature
+	}
+	if !hmac.Equal([]byte(signature), []byte(urlSignature(secret, key, unix))) {
+		return ErrBadSignature
+	}
+	return nil
+}
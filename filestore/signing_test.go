@@ -0,0 +1,77 @@
+package filestore
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	t.Setenv("FILE_URL_SECRET", "test-secret")
+	expires := time.Now().Add(time.Hour)
+	unix := strconv.FormatInt(expires.Unix(), 10)
+
+	signature, err := Sign("2024/quote.pdf", expires)
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	if err := Verify("2024/quote.pdf", unix, signature); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		key       string
+		expires   string
+		signature string
+	}{
+		{"other key", "2024/other.pdf", unix, signature},
+		{"extended expiry", "2024/quote.pdf", strconv.FormatInt(expires.Unix()+3600, 10), signature},
+		{"tampered signature", "2024/quote.pdf", unix, signature[:len(signature)-1] + "0"},
+		{"empty signature", "2024/quote.pdf", unix, ""},
+		{"malformed expiry", "2024/quote.pdf", "soon", signature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Verify(tt.key, tt.expires, tt.signature); !errors.Is(err, ErrBadSignature) {
+				t.Errorf("Verify() error = %v, want ErrBadSignature", err)
+			}
+		})
+	}
+}
+
+func TestVerifyExpired(t *testing.T) {
+	t.Setenv("FILE_URL_SECRET", "test-secret")
+	expires := time.Now().Add(-time.Minute)
+	signature, err := Sign("quote.pdf", expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify("quote.pdf", strconv.FormatInt(expires.Unix(), 10), signature); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Verify() error = %v, want ErrBadSignature", err)
+	}
+}
+
+func TestVerifyOtherSecret(t *testing.T) {
+	t.Setenv("FILE_URL_SECRET", "first")
+	expires := time.Now().Add(time.Hour)
+	signature, err := Sign("quote.pdf", expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FILE_URL_SECRET", "second")
+	if err := Verify("quote.pdf", strconv.FormatInt(expires.Unix(), 10), signature); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Verify() error = %v, want ErrBadSignature", err)
+	}
+}
+
+func TestSigningDisabled(t *testing.T) {
+	t.Setenv("FILE_URL_SECRET", "")
+	if _, err := Sign("quote.pdf", time.Now().Add(time.Hour)); !errors.Is(err, ErrSigningDisabled) {
+		t.Errorf("Sign() error = %v, want ErrSigningDisabled", err)
+	}
+	if err := Verify("quote.pdf", "9999999999", "abc"); !errors.Is(err, ErrSigningDisabled) {
+		t.Errorf("Verify() error = %v, want ErrSigningDisabled", err)
+	}
+}
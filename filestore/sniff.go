@@ -0,0 +1,197 @@
+package filestore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// SniffLen is the number of leading bytes Sniff looks at.
+const SniffLen = 512
+
+// ErrDangerousType is returned by Sniff for executables, scripts and HTML.
+var ErrDangerousType = errors.New("executable or script content is not allowed")
+
+var dangerousSignatures = []struct {
+	magic string
+	kind  string
+}{
+	{"\x7fELF", "an ELF executable"},
+	{"\xfe\xed\xfa\xce", "a Mach-O executable"},
+	{"\xfe\xed\xfa\xcf", "a Mach-O executable"},
+	{"\xce\xfa\xed\xfe", "a Mach-O executable"},
+	{"\xcf\xfa\xed\xfe", "a Mach-O executable"},
+	{"\xca\xfe\xba\xbe", "a Mach-O or Java class file"},
+	{"#!", "a script"},
+}
+
+const (
+	zipMagic = "PK\x03\x04"
+	oleMagic = "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"
+)
+
+// containerTypes refines formats that share a container by the file
+// extension. The extension alone is never trusted; it only picks among types
+// with the same magic bytes.
+var containerTypes = map[string]map[string]string{
+	zipMagic: {
+		".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+		".zip":  "application/zip",
+	},
+	oleMagic: {
+		".doc": "application/msword",
+		".xls": "application/vnd.ms-excel",
+		".ppt": "application/vnd.ms-powerpoint",
+	},
+}
+
+var containerDefaults = map[string]string{
+	zipMagic: "application/zip",
+	oleMagic: "application/x-ole-storage",
+}
+
+// typeExtensions lists the file extensions that fit a content type. Types
+// missing here are not checked against the extension.
+var typeExtensions = map[string][]string{
+	"application/pdf": {".pdf"},
+	"image/png":       {".png"},
+	"image/jpeg":      {".jpg", ".jpeg"},
+	"image/gif":       {".gif"},
+	"image/webp":      {".webp"},
+	"image/bmp":       {".bmp"},
+	"text/plain":      {".txt", ".log"},
+	"text/csv":        {".csv"},
+	"application/zip": {".zip"},
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   {".docx"},
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         {".xlsx"},
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": {".pptx"},
+	"application/msword":            {".doc"},
+	"application/vnd.ms-excel":      {".xls"},
+	"application/vnd.ms-powerpoint": {".ppt"},
+}
+
+// Sniff returns the content type of a file from its leading bytes, without
+// parameters such as charset. name is only used to tell apart formats that
+// share a container, such as .docx and .zip. Executables, scripts and HTML
+// return ErrDangerousType.
+func Sniff(head []byte, name string) (string, error) {
+	if isPE(head) {
+		return "", fmt.Errorf("%w: looks like a Windows executable", ErrDangerousType)
+	}
+	for _, signature := range dangerousSignatures {
+		if bytes.HasPrefix(head, []byte(signature.magic)) {
+			return "", fmt.Errorf("%w: looks like %s", ErrDangerousType, signature.kind)
+		}
+	}
+
+	ext := strings.ToLower(filepath.Ext(name))
+	for magic, types := range containerTypes {
+		if bytes.HasPrefix(head, []byte(magic)) {
+			if contentType, ok := types[ext]; ok {
+				return contentType, nil
+			}
+			return containerDefaults[magic], nil
+		}
+	}
+
+	contentType, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		return "application/octet-stream", nil
+	}
+	switch contentType {
+	case "text/html":
+		return "", fmt.Errorf("%w: looks like HTML", ErrDangerousType)
+	case "text/xml", "application/xml":
+		if bytes.Contains(bytes.ToLower(head), []byte("<svg")) {
+			return "image/svg+xml", nil
+		}
+	case "text/plain":
+		if ext == ".csv" {
+			return "text/csv", nil
+		}
+	}
+	return contentType, nil
+}
+
+// isPE reports whether head starts a DOS or PE executable: "MZ" followed by
+// the offset of the "PE" header at 0x3c. The header check keeps text that
+// happens to start with "MZ" from being rejected.
+func isPE(head []byte) bool {
+	if len(head) < 0x40 || !bytes.HasPrefix(head, []byte("MZ")) {
+		return false
+	}
+	offset := int(binary.LittleEndian.Uint32(head[0x3c:]))
+	if offset+4 > len(head) {
+		// The header lies beyond what was read; an MZ stub is still an
+		// executable unless the rest is printable text
+		return bytes.IndexFunc(head[2:0x40], func(r rune) bool { return r < 0x09 }) >= 0
+	}
+	return bytes.HasPrefix(head[offset:], []byte("PE\x00\x00"))
+}
+
+// MatchesExtension reports whether the extension of name fits the content
+// type. Types without known extensions always match.
+func MatchesExtension(contentType, name string) bool {
+	extensions, ok := typeExtensions[contentType]
+	if !ok {
+		return true
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, allowed := range extensions {
+		if ext == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// IsText reports whether the content type is text a browser may render as
+// markup, so it has to be scanned for scripts.
+func IsText(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") || strings.HasSuffix(contentType, "xml")
+}
+
+// scriptMarkers are looked for case-insensitively in text uploads.
+var scriptMarkers = [][]byte{
+	[]byte("<script"), []byte("javascript:"), []byte("<iframe"), []byte("<html"),
+	[]byte("onload="), []byte("onerror="),
+}
+
+// ScriptDetector is an io.Writer that watches a stream for script or HTML
+// markup. Markers split across writes are still found.
+type ScriptDetector struct {
+	tail  []byte
+	found bool
+}
+
+func (d *ScriptDetector) Write(p []byte) (int, error) {
+	if d.found {
+		return len(p), nil
+	}
+	window := bytes.ToLower(append(d.tail, p...))
+	for _, marker := range scriptMarkers {
+		if bytes.Contains(window, marker) {
+			d.found = true
+			return len(p), nil
+		}
+	}
+	// Keep enough to catch a marker that starts in this write
+	keep := 16
+	if len(window) < keep {
+		keep = len(window)
+	}
+	d.tail = append(d.tail[:0], window[len(window)-keep:]...)
+	return len(p), nil
+}
+
+// Found reports whether any markup was seen.
+func (d *ScriptDetector) Found() bool {
+	return d.found
+}
@@ -0,0 +1,306 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"nfa-app/models"
+	"nfa-app/storage"
+	"nfa-app/workflow"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// errApprovalMatrix is returned when an approval list does not reach the
+// level the approval matrix requires for the NFA's amount.
+var errApprovalMatrix = errors.New("approval list does not meet the approval matrix")
+
+// requiredApprovalLevel returns the hierarchy level the approval matrix
+// requires for an NFA, or 0 when no rule applies. When several rules match,
+// the strictest one wins.
+func requiredApprovalLevel(q storage.Querier, departmentID, projectID int, amount models.Money) (int, error) {
+	var level int
+	err := q.QueryRow(`
+		SELECT COALESCE(MAX(min_level), 0) FROM approval_matrix
+		WHERE (department_id IS NULL OR department_id = $1)
+		AND (project_id IS NULL OR project_id = $2)
+		AND $3::NUMERIC >= min_amount
+		AND (max_amount IS NULL OR $3::NUMERIC < max_amount)`,
+		departmentID, projectID, amount).Scan(&level)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check approval matrix: %v", err)
+	}
+	return level, nil
+}
+
+// checkApprovalMatrix verifies that at least one of the approvers sits at the
+// required level or higher in the department hierarchy.
+func checkApprovalMatrix(q storage.Querier, departmentID, projectID int, amount models.Money, approverIDs []int) error {
+	required, err := requiredApprovalLevel(q, departmentID, projectID, amount)
+	if err != nil || required == 0 {
+		return err
+	}
+
+	ids := make([]int64, len(approverIDs))
+	for i, id := range approverIDs {
+		ids[i] = int64(id)
+	}
+
+	var highest int
+	err = q.QueryRow(`
+		SELECT COALESCE(MAX(order_value), 0) FROM hierarchy
+		WHERE department_id = $1 AND user_id = ANY($2)`,
+		departmentID, pq.Array(ids)).Scan(&highest)
+	if err != nil {
+		return fmt.Errorf("failed to check approver levels: %v", err)
+	}
+	if highest < required {
+		return fmt.Errorf("%w: an amount of %s needs an approver at hierarchy level %d or above, the highest in the list is %d",
+			errApprovalMatrix, amount, required, highest)
+	}
+	return nil
+}
+
+func approverIDs(list []models.NFAApprovalList) []int {
+	ids := make([]int, len(list))
+	for i, approval := range list {
+		ids[i] = approval.ApproverID
+	}
+	return ids
+}
+
+// currentApproverIDs returns the approvers already on the NFA.
+func currentApproverIDs(tx *sql.Tx, nfaID int) ([]int, error) {
+	rows, err := tx.Query(`SELECT approver_id FROM nfa_approval_list WHERE nfa_id = $1`, nfaID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch approvers: %v", err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// sameApprovalList reports whether list is empty or has the same approvers,
+// stages and rules as the NFA's approval list. list must be normalized.
+func sameApprovalList(tx *sql.Tx, nfaID int, list []models.NFAApprovalList) (bool, error) {
+	if len(list) == 0 {
+		return true, nil
+	}
+	rows, err := tx.Query(`
+		SELECT approver_id, order_value, approval_rule, required_approvals
+		FROM nfa_approval_list WHERE nfa_id = $1`, nfaID)
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch approvers: %v", err)
+	}
+	defer rows.Close()
+
+	type seat struct {
+		approverID, order int
+		rule              string
+		required          int
+	}
+	current := make(map[seat]bool)
+	for rows.Next() {
+		var s seat
+		if err := rows.Scan(&s.approverID, &s.order, &s.rule, &s.required); err != nil {
+			return false, err
+		}
+		current[s] = true
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	if len(current) != len(list) {
+		return false, nil
+	}
+	for _, approval := range list {
+		if !current[seat{approval.ApproverID, approval.Order, approval.Rule, approval.RequiredApprovals}] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// checkNFAApprovalMatrix checks the NFA's approval list as it stands in tx
+// against the approval matrix. Drafts are checked when they are submitted.
+func checkNFAApprovalMatrix(tx *sql.Tx, nfaID int) error {
+	var status string
+	var departmentID, projectID int
+	var amount models.Money
+	err := tx.QueryRow(`
+		SELECT COALESCE(status, ''), COALESCE(department_id, 0), COALESCE(project_id, 0), COALESCE(amount, 0)
+		FROM nfa WHERE nfa_id = $1`, nfaID).Scan(&status, &departmentID, &projectID, &amount)
+	if err != nil {
+		return fmt.Errorf("failed to fetch NFA: %v", err)
+	}
+	if status == string(workflow.StateDraft) {
+		return nil
+	}
+	approvers, err := currentApproverIDs(tx, nfaID)
+	if err != nil {
+		return err
+	}
+	return checkApprovalMatrix(tx, departmentID, projectID, amount, approvers)
+}
+
+// approvalMatrixErrorResponse writes the response for an error from
+// checkApprovalMatrix.
+func approvalMatrixErrorResponse(c *gin.Context, err error) {
+	if errors.Is(err, errApprovalMatrix) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid approval list", "details": err.Error()})
+	} else {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func validateApprovalMatrixRule(rule models.ApprovalMatrixRule) error {
+	if rule.MinAmount < 0 {
+		return errors.New("min_amount must not be negative")
+	}
+	if rule.MaxAmount != nil && *rule.MaxAmount <= rule.MinAmount {
+		return errors.New("max_amount must be greater than min_amount")
+	}
+	if rule.MinLevel < 1 {
+		return errors.New("min_level must be at least 1")
+	}
+	return nil
+}
+
+func CreateApprovalMatrixRule(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := requireAdmin(db, c); !ok {
+			return
+		}
+
+		var rule models.ApprovalMatrixRule
+		if err := c.ShouldBindJSON(&rule); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input data"})
+			return
+		}
+		if err := validateApprovalMatrixRule(rule); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		err := db.QueryRow(`
+			INSERT INTO approval_matrix (department_id, project_id, min_amount, max_amount, min_level)
+			VALUES (NULLIF($1, 0), NULLIF($2, 0), $3, $4, $5) RETURNING id`,
+			rule.DepartmentID, rule.ProjectID, rule.MinAmount, rule.MaxAmount, rule.MinLevel).Scan(&rule.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create approval matrix rule: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message": "Approval matrix rule created successfully",
+			"rule":    rule,
+		})
+	}
+}
+
+func GetApprovalMatrix(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rows, err := db.Query(`
+			SELECT id, COALESCE(department_id, 0), COALESCE(project_id, 0), min_amount, max_amount, min_level
+			FROM approval_matrix
+			ORDER BY department_id NULLS FIRST, project_id NULLS FIRST, min_amount`)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		rules := []models.ApprovalMatrixRule{}
+		for rows.Next() {
+			var rule models.ApprovalMatrixRule
+			if err := rows.Scan(&rule.ID, &rule.DepartmentID, &rule.ProjectID, &rule.MinAmount, &rule.MaxAmount, &rule.MinLevel); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			rules = append(rules, rule)
+		}
+		c.JSON(http.StatusOK, rules)
+	}
+}
+
+func UpdateApprovalMatrixRule(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := requireAdmin(db, c); !ok {
+			return
+		}
+
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule ID"})
+			return
+		}
+
+		var rule models.ApprovalMatrixRule
+		if err := c.ShouldBindJSON(&rule); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input data"})
+			return
+		}
+		if err := validateApprovalMatrixRule(rule); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		rule.ID = id
+
+		result, err := db.Exec(`
+			UPDATE approval_matrix
+			SET department_id = NULLIF($1, 0), project_id = NULLIF($2, 0),
+			    min_amount = $3, max_amount = $4, min_level = $5
+			WHERE id = $6`,
+			rule.DepartmentID, rule.ProjectID, rule.MinAmount, rule.MaxAmount, rule.MinLevel, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Approval matrix rule not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Approval matrix rule updated",
+			"rule":    rule,
+		})
+	}
+}
+
+func DeleteApprovalMatrixRule(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := requireAdmin(db, c); !ok {
+			return
+		}
+
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule ID"})
+			return
+		}
+
+		result, err := db.Exec(`DELETE FROM approval_matrix WHERE id = $1`, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Approval matrix rule not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Approval matrix rule deleted"})
+	}
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxBulkActionItems bounds the number of NFAs handled by one bulk request.
+const maxBulkActionItems = 100
+
+// bulkActionResult reports the outcome for one NFA of a bulk action.
+type bulkActionResult struct {
+	NFAID      int    `json:"nfa_id"`
+	Success    bool   `json:"success"`
+	Status     int    `json:"status"`
+	Role       string `json:"role,omitempty"`
+	OnBehalfOf int    `json:"on_behalf_of,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// BulkApproveOrRejectNFA applies one action with a shared comment to a list of
+// NFAs from the pending queue. Every NFA goes through the same checks as
+// ApproveOrRejectNFA in its own transaction, so a failing item does not undo
+// the others; the response reports each item separately.
+func BulkApproveOrRejectNFA(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := getSessionUserID(db, c)
+		if !ok {
+			return
+		}
+
+		var request struct {
+			NFAIDs  []int  `json:"nfa_ids"`
+			Action  string `json:"action"` // "approve" or "reject"
+			Comment string `json:"comment"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+			return
+		}
+		if request.Action != "approve" && request.Action != "reject" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Action must be either 'approve' or 'reject'"})
+			return
+		}
+		if len(request.NFAIDs) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "nfa_ids must not be empty"})
+			return
+		}
+		if len(request.NFAIDs) > maxBulkActionItems {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Too many NFAs in one request", "max": maxBulkActionItems})
+			return
+		}
+
+		results := []bulkActionResult{}
+		seen := map[int]bool{}
+		succeeded := 0
+		for _, nfaID := range request.NFAIDs {
+			if seen[nfaID] {
+				continue
+			}
+			seen[nfaID] = true
+
+			result := applyBulkAction(db, nfaID, userID, request.Action, request.Comment)
+			if result.Success {
+				succeeded++
+			}
+			results = append(results, result)
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"action":    request.Action,
+			"succeeded": succeeded,
+			"failed":    len(results) - succeeded,
+			"results":   results,
+		})
+	}
+}
+
+// applyBulkAction runs the action on a single NFA in its own transaction.
+func applyBulkAction(db *sql.DB, nfaID, userID int, action, comment string) bulkActionResult {
+	result := bulkActionResult{NFAID: nfaID}
+	fail := func(status int, message string) bulkActionResult {
+		result.Status = status
+		result.Error = message
+		return result
+	}
+
+	if nfaID <= 0 {
+		return fail(http.StatusBadRequest, "Invalid NFA ID")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fail(http.StatusInternalServerError, "Failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	actionResult, err := applyNFAAction(tx, nfaID, userID, action, comment, 0)
+	if err != nil {
+		return fail(nfaActionStatus(err), err.Error())
+	}
+	if err := tx.Commit(); err != nil {
+		return fail(http.StatusInternalServerError, "Failed to commit transaction")
+	}
+
+	result.Success = true
+	result.Status = http.StatusOK
+	result.Role = actionResult.Role
+	result.OnBehalfOf = actionResult.OnBehalfOf
+	return result
+}
@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"nfa-app/filestore"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bundleManifestName is the name of the manifest inside an NFA bundle.
+const bundleManifestName = "manifest.json"
+
+// bundleEntry describes a file in an NFA bundle, or one that was left out and
+// why.
+type bundleEntry struct {
+	Name       string `json:"name,omitempty"`
+	Source     string `json:"source"`
+	Size       int64  `json:"size,omitempty"`
+	SHA256     string `json:"sha256,omitempty"`
+	MimeType   string `json:"mime_type,omitempty"`
+	ScanStatus string `json:"scan_status,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	Warning    string `json:"warning,omitempty"`
+}
+
+// bundleManifest is written last into the bundle, once every hash is known.
+type bundleManifest struct {
+	NFAID       int           `json:"nfa_id"`
+	NFANumber   string        `json:"nfa_number,omitempty"`
+	Subject     string        `json:"subject"`
+	GeneratedAt time.Time     `json:"generated_at"`
+	GeneratedBy int           `json:"generated_by"`
+	Files       []bundleEntry `json:"files"`
+	Skipped     []bundleEntry `json:"skipped"`
+}
+
+// bundleFile is an NFA attachment to be put into a bundle.
+type bundleFile struct {
+	name     string
+	path     string
+	key      string
+	mimeType string
+	sha256   string
+	scan     string
+}
+
+// bundleNames hands out unique, case-insensitively distinct names inside a
+// bundle: a second "quote.pdf" becomes "quote (2).pdf".
+type bundleNames map[string]bool
+
+func (used bundleNames) claim(name string) string {
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	candidate := name
+	for i := 2; used[strings.ToLower(candidate)]; i++ {
+		candidate = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+	}
+	used[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// fetchBundleFiles returns the NFA's attachments with what was recorded when
+// they were uploaded.
+func fetchBundleFiles(db *sql.DB, nfaID int) ([]bundleFile, error) {
+	rows, err := db.Query(`
+		SELECT COALESCE(f.file_name, ''), COALESCE(f.file_path, ''), COALESCE(f.file_key, ''),
+			COALESCE(u.original_name, ''), COALESCE(u.mime_type, ''), COALESCE(u.sha256, ''), COALESCE(u.scan_status, '')
+		FROM nfa_files f
+		LEFT JOIN uploaded_files u ON u.file_name = f.file_key
+		WHERE f.nfa_id = $1
+		ORDER BY f.id`, nfaID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch files: %v", err)
+	}
+	defer rows.Close()
+
+	var files []bundleFile
+	for rows.Next() {
+		var file bundleFile
+		var originalName string
+		err := rows.Scan(&file.name, &file.path, &file.key, &originalName, &file.mimeType, &file.sha256, &file.scan)
+		if err != nil {
+			return nil, err
+		}
+		// The name shown on the NFA wins over the one the file was uploaded as
+		if file.name == "" {
+			file.name = originalName
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
+// DownloadNFABundle streams a ZIP of every attachment of the NFA under
+// attachments/, with duplicate names numbered, and a manifest listing each
+// file's SHA-256 hash. ?include_pdf=true adds the approval PDF, with the
+// comment thread when ?include_comments=true. Attachments that are links to
+// other sites, missing from the store, or held by the malware scan are left
+// out and listed as skipped in the manifest. ?manifest=false leaves the
+// manifest out.
+func DownloadNFABundle(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		nfaID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid NFA ID"})
+			return
+		}
+
+		userID, ok := requireParticipant(db, c, nfaID)
+		if !ok {
+			return
+		}
+
+		manifest := bundleManifest{NFAID: nfaID, GeneratedAt: time.Now(), GeneratedBy: userID,
+			Files: []bundleEntry{}, Skipped: []bundleEntry{}}
+		err = db.QueryRow(`SELECT COALESCE(nfa_number, ''), COALESCE(subject, '') FROM nfa WHERE nfa_id = $1`,
+			nfaID).Scan(&manifest.NFANumber, &manifest.Subject)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "NFA not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch NFA"})
+			return
+		}
+		bundleName := "NFA-" + numberFileName(manifest.NFANumber)
+		if manifest.NFANumber == "" {
+			bundleName = "NFA-" + strconv.Itoa(nfaID)
+		}
+
+		files, err := fetchBundleFiles(db, nfaID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// The PDF is rendered before anything is sent, so a failure can still
+		// be reported with a status code
+		var pdf []byte
+		if c.Query("include_pdf") == "true" {
+			pdf, _, err = renderNFAPDF(c.Request.Context(), db, nfaID, c.Query("include_comments") == "true")
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		c.Header("Content-Type", "application/zip")
+		c.Header("Content-Disposition", "attachment; filename="+bundleName+".zip")
+		c.Header("Cache-Control", "no-store")
+		c.Status(http.StatusOK)
+
+		archive := zip.NewWriter(c.Writer)
+		names := bundleNames{bundleManifestName: true}
+
+		if pdf != nil {
+			name := names.claim(bundleName + ".pdf")
+			entry := bundleEntry{Name: name, Source: "generated", MimeType: "application/pdf"}
+			if err := writeBundleEntry(archive, &entry, bytes.NewReader(pdf)); err != nil {
+				log.Printf("Error writing bundle of NFA %d: %v", nfaID, err)
+				return
+			}
+			manifest.Files = append(manifest.Files, entry)
+		}
+
+		for _, file := range files {
+			entry := bundleEntry{Source: file.path, MimeType: file.mimeType, ScanStatus: file.scan}
+			key := file.key
+			switch {
+			case key == "":
+				entry.Reason = "link to another site"
+			case file.scan == scanPending:
+				entry.Reason = "waiting for a malware scan"
+			case file.scan == scanInfected:
+				entry.Reason = "blocked because malware was found in it"
+			case file.scan == scanFailed:
+				entry.Reason = "blocked because it could not be scanned for malware"
+			}
+			if entry.Reason != "" {
+				manifest.Skipped = append(manifest.Skipped, entry)
+				continue
+			}
+
+			object, err := filestore.Get().Open(c.Request.Context(), key)
+			if err != nil {
+				entry.Reason = "missing from the file store"
+				if !errors.Is(err, filestore.ErrNotFound) {
+					log.Printf("Error opening %s for bundle of NFA %d: %v", key, nfaID, err)
+					entry.Reason = "could not be read"
+				}
+				manifest.Skipped = append(manifest.Skipped, entry)
+				continue
+			}
+
+			name := sanitizeFileName(file.name)
+			if name == "" {
+				name = path.Base(key)
+			} else if path.Ext(name) == "" {
+				// Display names such as "Quotation" keep the stored extension
+				name += path.Ext(key)
+			}
+			entry.Name = names.claim("attachments/" + name)
+			err = writeBundleEntry(archive, &entry, object)
+			object.Close()
+			if err != nil {
+				// The response has started; all that is left is to stop
+				log.Printf("Error writing bundle of NFA %d: %v", nfaID, err)
+				return
+			}
+			if file.sha256 != "" && file.sha256 != entry.SHA256 {
+				entry.Warning = "content does not match the hash recorded at upload"
+			}
+			manifest.Files = append(manifest.Files, entry)
+		}
+
+		if c.Query("manifest") != "false" {
+			writer, err := archive.Create(bundleManifestName)
+			if err == nil {
+				encoder := json.NewEncoder(writer)
+				encoder.SetIndent("", "  ")
+				err = encoder.Encode(manifest)
+			}
+			if err != nil {
+				log.Printf("Error writing bundle manifest of NFA %d: %v", nfaID, err)
+				return
+			}
+		}
+		if err := archive.Close(); err != nil {
+			log.Printf("Error writing bundle of NFA %d: %v", nfaID, err)
+		}
+	}
+}
+
+// writeBundleEntry copies r into the archive under entry.Name and fills in
+// the entry's size and hash.
+func writeBundleEntry(archive *zip.Writer, entry *bundleEntry, r io.Reader) error {
+	writer, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     entry.Name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(writer, hash), r)
+	if err != nil {
+		return err
+	}
+	entry.Size = size
+	entry.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
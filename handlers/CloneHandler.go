@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"nfa-app/models"
+	"nfa-app/storage"
+	"nfa-app/workflow"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errInvalidLocation is returned when an area, project and tower do not
+// belong together.
+var errInvalidLocation = errors.New("invalid location")
+
+// checkLocation verifies that the project lies in the area and the tower in
+// the project, following the same links as GetProjectsByAreaID and
+// GetTowersByProjectID. A zero area or tower is not checked.
+func checkLocation(q storage.Querier, areaID, projectID, towerID int) error {
+	var projectArea int
+	err := q.QueryRow(`SELECT COALESCE(area_id, 0) FROM projects WHERE project_id = $1`, projectID).Scan(&projectArea)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: project %d not found", errInvalidLocation, projectID)
+	} else if err != nil {
+		return fmt.Errorf("failed to check project: %v", err)
+	}
+	if areaID != 0 && projectArea != areaID {
+		return fmt.Errorf("%w: project %d is not in area %d", errInvalidLocation, projectID, areaID)
+	}
+
+	if towerID == 0 {
+		return nil
+	}
+	var towerProject int
+	err = q.QueryRow(`SELECT COALESCE(project_id, 0) FROM towers WHERE tower_id = $1`, towerID).Scan(&towerProject)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: tower %d not found", errInvalidLocation, towerID)
+	} else if err != nil {
+		return fmt.Errorf("failed to check tower: %v", err)
+	}
+	if towerProject != projectID {
+		return fmt.Errorf("%w: tower %d is not in project %d", errInvalidLocation, towerID, projectID)
+	}
+	return nil
+}
+
+// CloneNFA starts a new draft from an existing NFA. Content, custom fields,
+// attachments and the approval list are copied, except attachments found
+// infected; the workflow state, number and decisions are not. The body may
+// override the project, tower and area: moving to another project takes that
+// project's area and clears the tower unless they are given too.
+func CloneNFA(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sourceID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid NFA ID"})
+			return
+		}
+
+		userID, ok := requireParticipant(db, c, sourceID)
+		if !ok {
+			return
+		}
+
+		var request struct {
+			ProjectID int `json:"project_id"`
+			TowerID   int `json:"tower_id"`
+			AreaID    int `json:"area_id"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil && err != io.EOF {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+			return
+		}
+
+		var projectID, towerID, areaID, initiatorID int
+		var status string
+		err = db.QueryRow(`
+			SELECT COALESCE(project_id, 0), COALESCE(tower_id, 0), COALESCE(area_id, 0),
+			       COALESCE(initiator_id, 0), COALESCE(status, '')
+			FROM nfa WHERE nfa_id = $1`, sourceID).Scan(&projectID, &towerID, &areaID, &initiatorID, &status)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "NFA not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		// A draft is private to its initiator until it is submitted
+		if status == string(workflow.StateDraft) && initiatorID != userID {
+			c.JSON(http.StatusNotFound, gin.H{"error": "NFA not found"})
+			return
+		}
+
+		if request.ProjectID != 0 && request.ProjectID != projectID {
+			projectID = request.ProjectID
+			areaID, towerID = 0, 0
+			if err := db.QueryRow(`SELECT COALESCE(area_id, 0) FROM projects WHERE project_id = $1`,
+				projectID).Scan(&areaID); err != nil && err != sql.ErrNoRows {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return
+			}
+		}
+		if request.AreaID != 0 {
+			areaID = request.AreaID
+		}
+		if request.TowerID != 0 {
+			towerID = request.TowerID
+		}
+		if request.ProjectID != 0 || request.AreaID != 0 || request.TowerID != 0 {
+			if err := checkLocation(db, areaID, projectID, towerID); errors.Is(err, errInvalidLocation) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			} else if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+			return
+		}
+		defer tx.Rollback()
+
+		var newID int
+		err = tx.QueryRow(`
+			INSERT INTO nfa
+				(project_id, tower_id, area_id, department_id, priority, subject, description, reference,
+				 recommender, last_recommender, initiator_id, amount, currency, cost_centre, custom_fields, template_id,
+				 status, draft_saved_at, cloned_from)
+			SELECT $1, $2, $3, department_id, priority, subject, description, reference,
+				recommender, last_recommender, $4, amount, currency, cost_centre, custom_fields, template_id,
+				$5, CURRENT_TIMESTAMP, nfa_id
+			FROM nfa WHERE nfa_id = $6
+			RETURNING nfa_id`,
+			projectID, towerID, areaID, userID, string(workflow.StateDraft), sourceID).Scan(&newID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to clone NFA: %v", err)})
+			return
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO nfa_approval_list (nfa_id, approver_id, order_value, approval_rule, required_approvals)
+			SELECT $1, approver_id, order_value, approval_rule, required_approvals
+			FROM nfa_approval_list WHERE nfa_id = $2
+			ORDER BY order_value, id`, newID, sourceID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to copy approval list"})
+			return
+		}
+
+		// Attachments go through the same checks as any other; files found
+		// infected since they were attached are left behind
+		files, skipped, err := cloneableFiles(tx, sourceID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := insertNFAFiles(db, tx, newID, userID, files, nil); err != nil {
+			attachErrorResponse(c, err)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction", "details": err.Error()})
+			return
+		}
+
+		response := gin.H{
+			"message":     "Draft created from NFA",
+			"nfa_id":      newID,
+			"cloned_from": sourceID,
+		}
+		if len(skipped) > 0 {
+			response["skipped_files"] = skipped
+		}
+		c.JSON(http.StatusCreated, response)
+	}
+}
+
+// cloneableFiles returns the NFA's attachments that may be copied to a clone
+// and the names of those that may not because they were found infected.
+func cloneableFiles(tx *sql.Tx, nfaID int) (files []models.NFAFile, skipped []string, err error) {
+	rows, err := tx.Query(`
+		SELECT COALESCE(f.file_name, ''), COALESCE(f.file_path, ''), COALESCE(f.file_type, ''),
+		       COALESCE(u.scan_status, '') = $2
+		FROM nfa_files f
+		LEFT JOIN uploaded_files u ON u.file_name = f.file_key
+		WHERE f.nfa_id = $1
+		ORDER BY f.id`, nfaID, scanInfected)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch files: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var file models.NFAFile
+		var infected bool
+		if err := rows.Scan(&file.Name, &file.Path, &file.Type, &infected); err != nil {
+			return nil, nil, err
+		}
+		if infected {
+			skipped = append(skipped, file.Name)
+			continue
+		}
+		files = append(files, file)
+	}
+	return files, skipped, rows.Err()
+}
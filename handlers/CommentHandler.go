@@ -0,0 +1,524 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"nfa-app/filestore"
+	"nfa-app/models"
+	"nfa-app/storage"
+	"nfa-app/workflow"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// errInvalidComment is returned when a comment refers to users or files that
+// do not exist.
+var errInvalidComment = errors.New("invalid comment")
+
+// isNFAParticipant reports whether the user takes part in the NFA: the
+// initiator, a recommender, an approver or an approver's active delegate. A
+// draft belongs to its initiator alone.
+func isNFAParticipant(db *sql.DB, nfaID, userID int) (bool, error) {
+	var participant bool
+	err := db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM nfa
+			WHERE nfa_id = $1
+			AND (initiator_id = $2 OR (COALESCE(status, '') <> $3 AND $2 IN (recommender, last_recommender)))
+		) OR EXISTS(
+			SELECT 1 FROM nfa_approval_list al JOIN nfa n ON n.nfa_id = al.nfa_id
+			WHERE al.nfa_id = $1
+			AND COALESCE(n.status, '') <> $3
+			AND (al.approver_id = $2 OR al.acted_by = $2 OR al.approver_id IN (`+activeDelegators("$2")+`))
+		)`, nfaID, userID, string(workflow.StateDraft)).Scan(&participant)
+	return participant, err
+}
+
+// canReadThread reports whether the session user, if any, may read the NFA's
+// comment thread: a participant, or an admin unless the NFA is a draft. A
+// request without a valid session may not.
+func canReadThread(db *sql.DB, c *gin.Context, nfaID int) (bool, error) {
+	userID, err := optionalSessionUserID(db, c)
+	if err != nil || userID == 0 {
+		return false, err
+	}
+	participant, err := isNFAParticipant(db, nfaID, userID)
+	if err != nil || participant {
+		return participant, err
+	}
+	var draft bool
+	err = db.QueryRow(`SELECT EXISTS(SELECT 1 FROM nfa WHERE nfa_id = $1 AND status = $2)`,
+		nfaID, string(workflow.StateDraft)).Scan(&draft)
+	if err != nil || draft {
+		return false, err
+	}
+	return isAdminUser(db, userID)
+}
+
+// requireParticipant checks that the session user may see the NFA and read
+// and post on its thread. Admins are allowed too, except on someone else's
+// draft, which is answered as if it did not exist. When it fails, the error
+// response has already been written.
+func requireParticipant(db *sql.DB, c *gin.Context, nfaID int) (userID int, ok bool) {
+	userID, ok = getSessionUserID(db, c)
+	if !ok {
+		return 0, false
+	}
+
+	var draft bool
+	participant, err := isNFAParticipant(db, nfaID, userID)
+	if err == nil && !participant {
+		err = db.QueryRow(`SELECT EXISTS(SELECT 1 FROM nfa WHERE nfa_id = $1 AND status = $2)`,
+			nfaID, string(workflow.StateDraft)).Scan(&draft)
+		if err == nil && !draft {
+			participant, err = isAdminUser(db, userID)
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check access"})
+		return 0, false
+	}
+	if draft {
+		c.JSON(http.StatusNotFound, gin.H{"error": "NFA not found"})
+		return 0, false
+	}
+	if !participant {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only participants of this NFA can access it"})
+		return 0, false
+	}
+	return userID, true
+}
+
+// saveCommentMentions records the mentioned users and notifies the ones who
+// were not mentioned in the comment before.
+func saveCommentMentions(tx *sql.Tx, nfaID, commentID int, mentions []int) error {
+	for _, userID := range mentions {
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)`, userID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%w: mentioned user %d not found", errInvalidComment, userID)
+		}
+
+		result, err := tx.Exec(`
+			INSERT INTO nfa_comment_mentions (comment_id, user_id) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING`, commentID, userID)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+
+		message := fmt.Sprintf("You were mentioned in a comment on NFA #%d.", nfaID)
+		if _, err := storage.CreateNotification(tx, userID, nfaID, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveCommentFiles attaches files that were uploaded through /api/upload. The
+// commenter must be able to see each file, and the NFA must stay within its
+// attachment quota.
+func saveCommentFiles(ctx context.Context, db *sql.DB, tx *sql.Tx, nfaID, commentID, userID int, files []string) error {
+	for _, name := range files {
+		if !filestore.ValidKey(name) {
+			return fmt.Errorf("%w: invalid file name '%s'", errInvalidComment, name)
+		}
+		exists, err := filestore.Exists(ctx, filestore.Get(), name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%w: file '%s' has not been uploaded", errInvalidComment, name)
+		}
+		if err := claimFile(db, tx, name, userID, 0, commentID, nil); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO nfa_comment_files (comment_id, file_name) VALUES ($1, $2)`, commentID, name); err != nil {
+			return err
+		}
+	}
+	if len(files) > 0 {
+		return checkNFAQuota(tx, nfaID)
+	}
+	return nil
+}
+
+func commentErrorStatus(err error) int {
+	if errors.Is(err, errInvalidComment) || errors.Is(err, errInfectedFile) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, errFileAccess) {
+		return http.StatusForbidden
+	}
+	if errors.Is(err, errNFAQuota) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+func CreateComment(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request struct {
+			NFAID    int      `json:"nfa_id"`
+			ParentID int      `json:"parent_id"`
+			Body     string   `json:"body"`
+			Mentions []int    `json:"mentions"`
+			Files    []string `json:"files"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+			return
+		}
+		request.Body = strings.TrimSpace(request.Body)
+		if request.Body == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Comment body is required"})
+			return
+		}
+
+		userID, ok := requireParticipant(db, c, request.NFAID)
+		if !ok {
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+			return
+		}
+		defer tx.Rollback()
+
+		// Replies must stay within the same NFA
+		var parentAuthorID int
+		if request.ParentID != 0 {
+			err = tx.QueryRow(`SELECT author_id FROM nfa_comments WHERE id = $1 AND nfa_id = $2`,
+				request.ParentID, request.NFAID).Scan(&parentAuthorID)
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Parent comment not found on this NFA"})
+				return
+			} else if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return
+			}
+		}
+
+		var commentID int
+		err = tx.QueryRow(`
+			INSERT INTO nfa_comments (nfa_id, parent_id, author_id, body)
+			VALUES ($1, NULLIF($2, 0), $3, $4) RETURNING id`,
+			request.NFAID, request.ParentID, userID, request.Body).Scan(&commentID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create comment: %v", err)})
+			return
+		}
+
+		if err := saveCommentMentions(tx, request.NFAID, commentID, request.Mentions); err != nil {
+			c.JSON(commentErrorStatus(err), gin.H{"error": "Failed to save mentions", "details": err.Error()})
+			return
+		}
+		if err := saveCommentFiles(c.Request.Context(), db, tx, request.NFAID, commentID, userID, request.Files); err != nil {
+			c.JSON(commentErrorStatus(err), gin.H{"error": "Failed to attach files", "details": err.Error()})
+			return
+		}
+
+		if parentAuthorID != 0 && parentAuthorID != userID {
+			message := fmt.Sprintf("Someone replied to your comment on NFA #%d.", request.NFAID)
+			if _, err := storage.CreateNotification(tx, parentAuthorID, request.NFAID, message); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to notify parent author"})
+				return
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction", "details": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message":    "Comment created successfully",
+			"comment_id": commentID,
+		})
+	}
+}
+
+func GetComments(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		nfaID, err := strconv.Atoi(c.Param("nfa_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid NFA ID"})
+			return
+		}
+		if _, ok := requireParticipant(db, c, nfaID); !ok {
+			return
+		}
+
+		thread, err := fetchCommentThread(db, nfaID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, thread)
+	}
+}
+
+// loadOwnComment locks the comment for an edit or delete and checks that the
+// session user wrote it, or is an admin when allowAdmin is set.
+func loadOwnComment(tx *sql.Tx, db *sql.DB, c *gin.Context, commentID, userID int, allowAdmin bool) (nfaID int, body string, ok bool) {
+	var authorID int
+	var deleted bool
+	err := tx.QueryRow(`
+		SELECT nfa_id, author_id, body, deleted_at IS NOT NULL
+		FROM nfa_comments WHERE id = $1 FOR UPDATE`, commentID).Scan(&nfaID, &authorID, &body, &deleted)
+	if err == sql.ErrNoRows || (err == nil && deleted) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Comment not found"})
+		return 0, "", false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return 0, "", false
+	}
+
+	if authorID != userID {
+		isAdmin := false
+		if allowAdmin {
+			if isAdmin, err = isAdminUser(db, userID); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check admin role"})
+				return 0, "", false
+			}
+		}
+		if !isAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You can only change your own comments"})
+			return 0, "", false
+		}
+	}
+	return nfaID, body, true
+}
+
+func UpdateComment(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := getSessionUserID(db, c)
+		if !ok {
+			return
+		}
+
+		commentID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid comment ID"})
+			return
+		}
+
+		var request struct {
+			Body     string `json:"body"`
+			Mentions []int  `json:"mentions"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+			return
+		}
+		request.Body = strings.TrimSpace(request.Body)
+		if request.Body == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Comment body is required"})
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+			return
+		}
+		defer tx.Rollback()
+
+		nfaID, oldBody, ok := loadOwnComment(tx, db, c, commentID, userID, false)
+		if !ok {
+			return
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO nfa_comment_history (comment_id, action, body, changed_by)
+			VALUES ($1, 'edit', $2, $3)`, commentID, oldBody, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record comment history"})
+			return
+		}
+
+		_, err = tx.Exec(`UPDATE nfa_comments SET body = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`, request.Body, commentID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update comment"})
+			return
+		}
+
+		if err := saveCommentMentions(tx, nfaID, commentID, request.Mentions); err != nil {
+			c.JSON(commentErrorStatus(err), gin.H{"error": "Failed to save mentions", "details": err.Error()})
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction", "details": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Comment updated"})
+	}
+}
+
+func DeleteComment(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := getSessionUserID(db, c)
+		if !ok {
+			return
+		}
+
+		commentID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid comment ID"})
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+			return
+		}
+		defer tx.Rollback()
+
+		_, oldBody, ok := loadOwnComment(tx, db, c, commentID, userID, true)
+		if !ok {
+			return
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO nfa_comment_history (comment_id, action, body, changed_by)
+			VALUES ($1, 'delete', $2, $3)`, commentID, oldBody, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record comment history"})
+			return
+		}
+
+		_, err = tx.Exec(`UPDATE nfa_comments SET body = '', deleted_at = CURRENT_TIMESTAMP WHERE id = $1`, commentID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete comment"})
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction", "details": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Comment deleted"})
+	}
+}
+
+// GetCommentHistory lists the earlier versions of a comment, newest first.
+func GetCommentHistory(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		commentID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid comment ID"})
+			return
+		}
+
+		var nfaID int
+		err = db.QueryRow(`SELECT nfa_id FROM nfa_comments WHERE id = $1`, commentID).Scan(&nfaID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Comment not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if _, ok := requireParticipant(db, c, nfaID); !ok {
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT h.action, h.body, h.changed_by, COALESCE(u.name, ''), h.changed_at
+			FROM nfa_comment_history h
+			LEFT JOIN users u ON h.changed_by = u.id
+			WHERE h.comment_id = $1
+			ORDER BY h.changed_at DESC, h.id DESC`, commentID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		history := []models.NFACommentChange{}
+		for rows.Next() {
+			var change models.NFACommentChange
+			if err := rows.Scan(&change.Action, &change.Body, &change.ChangedBy, &change.ChangedByName, &change.ChangedAt); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			history = append(history, change)
+		}
+		c.JSON(http.StatusOK, history)
+	}
+}
+
+// fetchCommentThread loads every comment on the NFA and nests replies under
+// their parents, oldest first.
+func fetchCommentThread(db *sql.DB, nfaID int) ([]models.NFAComment, error) {
+	rows, err := db.Query(`
+		SELECT c.id, c.nfa_id, COALESCE(c.parent_id, 0), c.author_id, COALESCE(u.name, ''), c.body,
+		       c.created_at, c.updated_at, c.deleted_at IS NOT NULL,
+		       ARRAY(SELECT m.user_id FROM nfa_comment_mentions m WHERE m.comment_id = c.id ORDER BY m.user_id),
+		       ARRAY(SELECT f.file_name FROM nfa_comment_files f WHERE f.comment_id = c.id ORDER BY f.id)
+		FROM nfa_comments c
+		LEFT JOIN users u ON c.author_id = u.id
+		WHERE c.nfa_id = $1
+		ORDER BY c.created_at, c.id`, nfaID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch comments: %v", err)
+	}
+	defer rows.Close()
+
+	var comments []models.NFAComment
+	for rows.Next() {
+		var comment models.NFAComment
+		var updatedAt sql.NullTime
+		var mentions pq.Int64Array
+		var files pq.StringArray
+		if err := rows.Scan(&comment.ID, &comment.NFAID, &comment.ParentID, &comment.AuthorID, &comment.AuthorName,
+			&comment.Body, &comment.CreatedAt, &updatedAt, &comment.Deleted, &mentions, &files); err != nil {
+			return nil, err
+		}
+		if updatedAt.Valid {
+			comment.UpdatedAt = &updatedAt.Time
+		}
+		comment.Mentions = make([]int, len(mentions))
+		for i, id := range mentions {
+			comment.Mentions[i] = int(id)
+		}
+		comment.Files = []string(files)
+		if comment.Files == nil {
+			comment.Files = []string{}
+		}
+		comment.Replies = []models.NFAComment{}
+		comments = append(comments, comment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return nestComments(comments, 0), nil
+}
+
+func nestComments(comments []models.NFAComment, parentID int) []models.NFAComment {
+	thread := []models.NFAComment{}
+	for _, comment := range comments {
+		if comment.ParentID == parentID {
+			comment.Replies = nestComments(comments, comment.ID)
+			thread = append(thread, comment)
+		}
+	}
+	return thread
+}
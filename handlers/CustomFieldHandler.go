@@ -0,0 +1,459 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"nfa-app/models"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// errCustomField is returned when custom field values do not match the
+// department's field definitions.
+var errCustomField = errors.New("invalid custom fields")
+
+var customFieldName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+var customFieldTypes = map[string]bool{"text": true, "number": true, "date": true, "enum": true, "user": true}
+
+// customFieldFilterPrefix marks list query parameters that filter on a custom
+// field, as in ?custom.vendor_name=Acme.
+const customFieldFilterPrefix = "custom."
+
+func validateCustomFieldDefinition(field *models.CustomField) error {
+	field.Name = strings.TrimSpace(field.Name)
+	field.Label = strings.TrimSpace(field.Label)
+	if field.DepartmentID <= 0 {
+		return errors.New("department_id is required")
+	}
+	if !customFieldName.MatchString(field.Name) {
+		return errors.New("name must start with a lowercase letter and contain only lowercase letters, digits and underscores")
+	}
+	if field.Label == "" {
+		field.Label = field.Name
+	}
+	if !customFieldTypes[field.Type] {
+		return errors.New("field_type must be one of text, number, date, enum or user")
+	}
+	if field.Type == "enum" && len(field.Options) == 0 {
+		return errors.New("an enum field needs at least one option")
+	}
+	if field.Type != "enum" {
+		field.Options = []string{}
+	}
+	return nil
+}
+
+// fetchCustomFields returns the department's field definitions in display
+// order, optionally including deactivated ones.
+func fetchCustomFields(db *sql.DB, departmentID int, includeInactive bool) ([]models.CustomField, error) {
+	rows, err := db.Query(`
+		SELECT id, department_id, name, label, field_type, options, required, sort_order, is_active, created_at
+		FROM custom_fields
+		WHERE department_id = $1 AND (is_active OR $2)
+		ORDER BY sort_order, id`, departmentID, includeInactive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch custom fields: %v", err)
+	}
+	defer rows.Close()
+
+	fields := []models.CustomField{}
+	for rows.Next() {
+		var field models.CustomField
+		var options pq.StringArray
+		if err := rows.Scan(&field.ID, &field.DepartmentID, &field.Name, &field.Label, &field.Type, &options,
+			&field.Required, &field.SortOrder, &field.IsActive, &field.CreatedAt); err != nil {
+			return nil, err
+		}
+		field.Options = []string(options)
+		fields = append(fields, field)
+	}
+	return fields, rows.Err()
+}
+
+// validateCustomFields checks the values against the department's fields and
+// returns them in their stored form: numbers as numbers, dates as
+// YYYY-MM-DD and users as IDs. Empty values are dropped. Deactivated fields
+// keep the value in stored, the NFA's current values, whatever the client
+// sent for them.
+func validateCustomFields(db *sql.DB, departmentID int, values, stored map[string]interface{}) (map[string]interface{}, error) {
+	fields, err := fetchCustomFields(db, departmentID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]models.CustomField, len(fields))
+	for _, field := range fields {
+		byName[field.Name] = field
+	}
+
+	var problems []string
+	for name := range values {
+		if _, ok := byName[name]; !ok {
+			problems = append(problems, fmt.Sprintf("%s is not a custom field of this department", name))
+		}
+	}
+	sort.Strings(problems)
+
+	normalized := make(map[string]interface{})
+	for _, field := range fields {
+		if !field.IsActive {
+			if value, ok := stored[field.Name]; ok && value != nil {
+				normalized[field.Name] = value
+			}
+			continue
+		}
+		value, err := normalizeCustomFieldValue(db, field, values[field.Name])
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", field.Name, err))
+			continue
+		}
+		if value == nil {
+			if field.Required {
+				problems = append(problems, fmt.Sprintf("%s is required", field.Name))
+			}
+			continue
+		}
+		normalized[field.Name] = value
+	}
+
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%w: %s", errCustomField, strings.Join(problems, "; "))
+	}
+	return normalized, nil
+}
+
+func normalizeCustomFieldValue(db *sql.DB, field models.CustomField, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	text, isText := value.(string)
+	if isText {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			return nil, nil
+		}
+	}
+
+	switch field.Type {
+	case "text":
+		if !isText {
+			return nil, errors.New("must be text")
+		}
+		return text, nil
+
+	case "number":
+		if isText {
+			// ParseFloat accepts NaN and Inf, which JSON cannot store
+			number, err := strconv.ParseFloat(text, 64)
+			if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+				return nil, errors.New("must be a number")
+			}
+			return number, nil
+		}
+		number, ok := value.(float64)
+		if !ok {
+			return nil, errors.New("must be a number")
+		}
+		return number, nil
+
+	case "date":
+		if !isText {
+			return nil, errors.New("must be a date in YYYY-MM-DD format")
+		}
+		date, err := time.Parse("2006-01-02", text)
+		if err != nil {
+			return nil, errors.New("must be a date in YYYY-MM-DD format")
+		}
+		return date.Format("2006-01-02"), nil
+
+	case "enum":
+		if !isText {
+			return nil, errors.New("must be one of the field's options")
+		}
+		for _, option := range field.Options {
+			if option == text {
+				return text, nil
+			}
+		}
+		return nil, fmt.Errorf("must be one of %s", strings.Join(field.Options, ", "))
+
+	case "user":
+		var userID int
+		switch v := value.(type) {
+		case float64:
+			if v != math.Trunc(v) {
+				return nil, errors.New("must be a user ID")
+			}
+			userID = int(v)
+		case string:
+			id, err := strconv.Atoi(text)
+			if err != nil {
+				return nil, errors.New("must be a user ID")
+			}
+			userID = id
+		default:
+			return nil, errors.New("must be a user ID")
+		}
+		var exists bool
+		if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)`, userID).Scan(&exists); err != nil {
+			return nil, fmt.Errorf("failed to check user: %v", err)
+		}
+		if !exists {
+			return nil, fmt.Errorf("user %d does not exist", userID)
+		}
+		return userID, nil
+	}
+	return nil, fmt.Errorf("unknown field type %q", field.Type)
+}
+
+// encodeCustomFields prepares values for the JSONB column.
+func encodeCustomFields(values map[string]interface{}) (string, error) {
+	if values == nil {
+		return "{}", nil
+	}
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode custom fields: %v", err)
+	}
+	return string(encoded), nil
+}
+
+// checkCustomFields validates the values for the department and encodes them
+// for storage; stored are the NFA's current values, nil for a new one. When
+// it fails, the error response has already been written.
+func checkCustomFields(db *sql.DB, c *gin.Context, departmentID int, values, stored map[string]interface{}) (encoded string, ok bool) {
+	normalized, err := validateCustomFields(db, departmentID, values, stored)
+	if err == nil {
+		if encoded, err = encodeCustomFields(normalized); err == nil {
+			return encoded, true
+		}
+	}
+	if errors.Is(err, errCustomField) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid custom fields", "details": err.Error()})
+	} else {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+	return "", false
+}
+
+// decodeCustomFields reads the JSONB column; an empty object decodes to nil
+// so it is left out of responses.
+func decodeCustomFields(raw []byte) map[string]interface{} {
+	var values map[string]interface{}
+	if err := json.Unmarshal(raw, &values); err != nil || len(values) == 0 {
+		return nil
+	}
+	return values
+}
+
+// customFieldFilters turns ?custom.<name>=<value> query parameters into
+// conditions on the custom_fields column, appending their arguments. Values
+// are compared as text, so numbers match in their plain form, e.g. 1500.
+func customFieldFilters(c *gin.Context, column string, args []interface{}) (string, []interface{}) {
+	query := c.Request.URL.Query()
+	var names []string
+	for key := range query {
+		name := strings.TrimPrefix(key, customFieldFilterPrefix)
+		if name != key && customFieldName.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var conditions strings.Builder
+	for _, name := range names {
+		args = append(args, name, query.Get(customFieldFilterPrefix+name))
+		fmt.Fprintf(&conditions, " AND %s ->> $%d = $%d", column, len(args)-1, len(args))
+	}
+	return conditions.String(), args
+}
+
+// formatCustomFieldValue renders a stored value for display in the PDF.
+func formatCustomFieldValue(db *sql.DB, field models.CustomField, value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		if field.Type == "user" {
+			return getName(db, "SELECT name FROM users WHERE id = $1", int(v))
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		if field.Type == "date" {
+			if date, err := time.Parse("2006-01-02", v); err == nil {
+				return date.Format("02-01-2006")
+			}
+		}
+		return v
+	}
+	return fmt.Sprint(value)
+}
+
+func CreateCustomField(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := requireAdmin(db, c); !ok {
+			return
+		}
+
+		field := models.CustomField{IsActive: true}
+		if err := c.ShouldBindJSON(&field); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input data"})
+			return
+		}
+		if err := validateCustomFieldDefinition(&field); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var exists bool
+		err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM custom_fields WHERE department_id = $1 AND name = $2)`,
+			field.DepartmentID, field.Name).Scan(&exists)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if exists {
+			c.JSON(http.StatusConflict, gin.H{"error": "The department already has a custom field with this name"})
+			return
+		}
+
+		err = db.QueryRow(`
+			INSERT INTO custom_fields (department_id, name, label, field_type, options, required, sort_order, is_active)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, created_at`,
+			field.DepartmentID, field.Name, field.Label, field.Type, pq.Array(field.Options),
+			field.Required, field.SortOrder, field.IsActive).Scan(&field.ID, &field.CreatedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create custom field: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message": "Custom field created successfully",
+			"field":   field,
+		})
+	}
+}
+
+// GetCustomFields lists the active custom fields of a department.
+func GetCustomFields(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		departmentID, err := strconv.Atoi(c.Query("department_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "department_id is required"})
+			return
+		}
+
+		fields, err := fetchCustomFields(db, departmentID, false)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, fields)
+	}
+}
+
+// UpdateCustomField changes a field's label, options, required flag, order
+// and active state. The name, type and department stay fixed because NFAs
+// already store values under them.
+func UpdateCustomField(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := requireAdmin(db, c); !ok {
+			return
+		}
+
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid custom field ID"})
+			return
+		}
+
+		var request struct {
+			Label     string   `json:"label"`
+			Options   []string `json:"options"`
+			Required  bool     `json:"required"`
+			SortOrder int      `json:"sort_order"`
+			IsActive  *bool    `json:"is_active"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input data"})
+			return
+		}
+
+		var field models.CustomField
+		var options pq.StringArray
+		err = db.QueryRow(`
+			SELECT id, department_id, name, label, field_type, options, required, sort_order, is_active, created_at
+			FROM custom_fields WHERE id = $1`, id).Scan(&field.ID, &field.DepartmentID, &field.Name, &field.Label,
+			&field.Type, &options, &field.Required, &field.SortOrder, &field.IsActive, &field.CreatedAt)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Custom field not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		field.Label = request.Label
+		field.Options = request.Options
+		field.Required = request.Required
+		field.SortOrder = request.SortOrder
+		if request.IsActive != nil {
+			field.IsActive = *request.IsActive
+		}
+		if err := validateCustomFieldDefinition(&field); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		_, err = db.Exec(`
+			UPDATE custom_fields SET label = $1, options = $2, required = $3, sort_order = $4, is_active = $5
+			WHERE id = $6`,
+			field.Label, pq.Array(field.Options), field.Required, field.SortOrder, field.IsActive, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Custom field updated",
+			"field":   field,
+		})
+	}
+}
+
+// DeleteCustomField deactivates a field. Values already stored on NFAs are
+// kept.
+func DeleteCustomField(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := requireAdmin(db, c); !ok {
+			return
+		}
+
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid custom field ID"})
+			return
+		}
+
+		result, err := db.Exec(`UPDATE custom_fields SET is_active = FALSE WHERE id = $1`, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Custom field not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Custom field deleted"})
+	}
+}
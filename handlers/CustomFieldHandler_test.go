@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"nfa-app/models"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeCustomFieldValue(t *testing.T) {
+	number := models.CustomField{Name: "budget", Type: "number"}
+	date := models.CustomField{Name: "due", Type: "date"}
+	enum := models.CustomField{Name: "kind", Type: "enum", Options: []string{"capex", "opex"}}
+	text := models.CustomField{Name: "vendor", Type: "text"}
+
+	tests := []struct {
+		name    string
+		field   models.CustomField
+		value   interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{"number", number, 1500.5, 1500.5, false},
+		{"number as text", number, " 1500 ", 1500.0, false},
+		{"number empty", number, "", nil, false},
+		{"number NaN", number, "NaN", nil, true},
+		{"number Inf", number, "Inf", nil, true},
+		{"number -Infinity", number, "-Infinity", nil, true},
+		{"number out of range", number, "1e400", nil, true},
+		{"number not a number", number, "lots", nil, true},
+		{"number of the wrong type", number, true, nil, true},
+		{"date", date, "2024-03-31", "2024-03-31", false},
+		{"date in another format", date, "31-03-2024", nil, true},
+		{"enum option", enum, "capex", "capex", false},
+		{"enum other value", enum, "other", nil, true},
+		{"text", text, " Acme ", "Acme", false},
+		{"text of the wrong type", text, 12.0, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeCustomFieldValue(nil, tt.field, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeCustomFieldValue() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("normalizeCustomFieldValue() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
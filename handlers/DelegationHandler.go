@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"nfa-app/models"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// activeDelegators returns a subquery selecting the users who have delegated
+// their approvals, for the current date, to the user bound at placeholder. It
+// is embedded in approver lookups as "approver_id IN (...)".
+func activeDelegators(placeholder string) string {
+	return `SELECT d.user_id FROM approval_delegations d
+		WHERE d.delegate_id = ` + placeholder + ` AND CURRENT_DATE BETWEEN d.start_date AND d.end_date`
+}
+
+func CreateDelegation(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := getSessionUserID(db, c)
+		if !ok {
+			return
+		}
+
+		var request struct {
+			DelegateID int    `json:"delegate_id"`
+			StartDate  string `json:"start_date"` // YYYY-MM-DD
+			EndDate    string `json:"end_date"`   // YYYY-MM-DD
+			Reason     string `json:"reason"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+			return
+		}
+
+		if request.DelegateID <= 0 || request.DelegateID == userID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "delegate_id must be another user"})
+			return
+		}
+
+		startDate, err := time.Parse("2006-01-02", request.StartDate)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "start_date must be in YYYY-MM-DD format"})
+			return
+		}
+		endDate, err := time.Parse("2006-01-02", request.EndDate)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "end_date must be in YYYY-MM-DD format"})
+			return
+		}
+		if endDate.Before(startDate) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "end_date must not be before start_date"})
+			return
+		}
+
+		var delegateExists bool
+		err = db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)`, request.DelegateID).Scan(&delegateExists)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if !delegateExists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Delegate not found"})
+			return
+		}
+
+		// Only one delegate may stand in for a user on any given day
+		var overlapping bool
+		err = db.QueryRow(`
+			SELECT EXISTS(
+				SELECT 1 FROM approval_delegations
+				WHERE user_id = $1 AND start_date <= $3 AND end_date >= $2
+			)`, userID, startDate, endDate).Scan(&overlapping)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if overlapping {
+			c.JSON(http.StatusConflict, gin.H{"error": "A delegation already exists for part of this date range"})
+			return
+		}
+
+		var delegationID int
+		err = db.QueryRow(`
+			INSERT INTO approval_delegations (user_id, delegate_id, start_date, end_date, reason)
+			VALUES ($1, $2, $3, $4, NULLIF($5, '')) RETURNING id`,
+			userID, request.DelegateID, startDate, endDate, request.Reason).Scan(&delegationID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create delegation: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message":       "Delegation created successfully",
+			"delegation_id": delegationID,
+		})
+	}
+}
+
+// GetDelegations lists the delegations the session user has given and the
+// ones they have received.
+func GetDelegations(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := getSessionUserID(db, c)
+		if !ok {
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT d.id, d.user_id, COALESCE(u.name, ''), d.delegate_id, COALESCE(dg.name, ''),
+			       d.start_date, d.end_date, COALESCE(d.reason, '')
+			FROM approval_delegations d
+			LEFT JOIN users u ON d.user_id = u.id
+			LEFT JOIN users dg ON d.delegate_id = dg.id
+			WHERE d.user_id = $1 OR d.delegate_id = $1
+			ORDER BY d.start_date DESC`, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		given := []models.Delegation{}
+		received := []models.Delegation{}
+		for rows.Next() {
+			var d models.Delegation
+			if err := rows.Scan(&d.ID, &d.UserID, &d.UserName, &d.DelegateID, &d.DelegateName,
+				&d.StartDate, &d.EndDate, &d.Reason); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if d.UserID == userID {
+				given = append(given, d)
+			} else {
+				received = append(received, d)
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"given":    given,
+			"received": received,
+		})
+	}
+}
+
+func DeleteDelegation(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := getSessionUserID(db, c)
+		if !ok {
+			return
+		}
+
+		delegationID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delegation ID"})
+			return
+		}
+
+		result, err := db.Exec(`DELETE FROM approval_delegations WHERE id = $1 AND user_id = $2`, delegationID, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Delegation not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Delegation deleted"})
+	}
+}
@@ -0,0 +1,501 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"nfa-app/models"
+	"nfa-app/storage"
+	"nfa-app/workflow"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultDraftExpiryDays is used when DRAFT_EXPIRY_DAYS is not set.
+const defaultDraftExpiryDays = 30
+
+// nfaDraftRequest is the body accepted when saving a draft. Nothing is
+// required until the draft is submitted.
+type nfaDraftRequest struct {
+	ProjectID       int                      `json:"project_id"`
+	TowerID         int                      `json:"tower_id"`
+	AreaID          int                      `json:"area_id"`
+	DepartmentID    int                      `json:"department_id"`
+	Priority        string                   `json:"priority"`
+	Subject         string                   `json:"subject"`
+	Description     string                   `json:"description"`
+	Reference       string                   `json:"reference"`
+	Recommender     int                      `json:"recommender"`
+	LastRecommender int                      `json:"last_recommender"`
+	Amount          models.Money             `json:"amount"`
+	Currency        string                   `json:"currency"`
+	CostCentre      string                   `json:"cost_centre"`
+	ApprovalList    []models.NFAApprovalList `json:"approval_list"`
+	Files           []models.NFAFile         `json:"files"`
+	CustomFields    map[string]interface{}   `json:"custom_fields"`
+}
+
+// replaceDraftLists swaps the approval list and files of a draft for the ones
+// in the request. New stored files must be visible to the user saving it.
+func replaceDraftLists(db *sql.DB, tx *sql.Tx, nfaID, userID int, request *nfaDraftRequest) error {
+	if _, err := tx.Exec("DELETE FROM nfa_approval_list WHERE nfa_id = $1", nfaID); err != nil {
+		return fmt.Errorf("failed to clear old approval list: %v", err)
+	}
+	for i := range request.ApprovalList {
+		request.ApprovalList[i].NFAID = nfaID
+		err := tx.QueryRow(`INSERT INTO nfa_approval_list (nfa_id, approver_id, order_value, approval_rule, required_approvals) VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+			nfaID, request.ApprovalList[i].ApproverID, request.ApprovalList[i].Order,
+			request.ApprovalList[i].Rule, request.ApprovalList[i].RequiredApprovals).Scan(&request.ApprovalList[i].ID)
+		if err != nil {
+			return fmt.Errorf("failed to insert approval list: %v", err)
+		}
+	}
+
+	existingFiles, err := nfaFileKeys(tx, nfaID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM nfa_files WHERE nfa_id = $1", nfaID); err != nil {
+		return fmt.Errorf("failed to clear old file records: %v", err)
+	}
+	return insertNFAFiles(db, tx, nfaID, userID, request.Files, existingFiles)
+}
+
+// loadOwnDraft locks the NFA and checks that it is a draft of the user. When
+// it fails, the error response has already been written.
+func loadOwnDraft(tx *sql.Tx, c *gin.Context, nfaID, userID int) bool {
+	var initiatorID int
+	var status string
+	err := tx.QueryRow(`SELECT COALESCE(initiator_id, 0), COALESCE(status, '') FROM nfa WHERE nfa_id = $1 FOR UPDATE`,
+		nfaID).Scan(&initiatorID, &status)
+	if err == sql.ErrNoRows || (err == nil && initiatorID != userID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Draft not found"})
+		return false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	if status != string(workflow.StateDraft) {
+		c.JSON(http.StatusConflict, gin.H{"error": "NFA has already been submitted", "status": status})
+		return false
+	}
+	return true
+}
+
+func CreateDraft(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		initiatorID, ok := getSessionUserID(db, c)
+		if !ok {
+			return
+		}
+
+		var request nfaDraftRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+			return
+		}
+
+		// Custom fields are stored as entered and validated on submit
+		customFields, err := encodeCustomFields(request.CustomFields)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid custom fields", "details": err.Error()})
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+			return
+		}
+		defer tx.Rollback()
+
+		var nfaID int
+		err = tx.QueryRow(`
+			INSERT INTO nfa
+				(project_id, tower_id, area_id, department_id, priority, subject, description, reference,
+				 recommender, last_recommender, initiator_id, amount, currency, cost_centre, status, draft_saved_at, custom_fields)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, NULLIF($13, ''), NULLIF($14, ''), $15, CURRENT_TIMESTAMP, $16)
+			RETURNING nfa_id`,
+			request.ProjectID, request.TowerID, request.AreaID, request.DepartmentID, request.Priority, request.Subject,
+			request.Description, request.Reference, request.Recommender, request.LastRecommender, initiatorID,
+			request.Amount, request.Currency, request.CostCentre, string(workflow.StateDraft), customFields).Scan(&nfaID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to save draft: %v", err)})
+			return
+		}
+
+		if err := replaceDraftLists(db, tx, nfaID, initiatorID, &request); err != nil {
+			attachErrorResponse(c, err)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction", "details": err.Error()})
+			return
+		}
+		setNFAETag(db, c, nfaID)
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message": "Draft saved",
+			"nfa_id":  nfaID,
+		})
+	}
+}
+
+// UpdateDraft autosaves a draft. The whole draft is replaced on every save;
+// If-Match must carry the ETag of the last save.
+func UpdateDraft(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := getSessionUserID(db, c)
+		if !ok {
+			return
+		}
+
+		nfaID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid NFA ID"})
+			return
+		}
+
+		var request nfaDraftRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+			return
+		}
+
+		customFields, err := encodeCustomFields(request.CustomFields)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid custom fields", "details": err.Error()})
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+			return
+		}
+		defer tx.Rollback()
+
+		if !loadOwnDraft(tx, c, nfaID, userID) {
+			return
+		}
+		if !requireIfMatch(c, tx, nfaID) {
+			return
+		}
+
+		_, err = tx.Exec(`
+			UPDATE nfa SET
+				project_id = $1, tower_id = $2, area_id = $3, department_id = $4,
+				priority = $5, subject = $6, description = $7, reference = $8,
+				recommender = $9, last_recommender = $10,
+				amount = $11, currency = NULLIF($12, ''), cost_centre = NULLIF($13, ''),
+				custom_fields = $14, draft_saved_at = CURRENT_TIMESTAMP
+			WHERE nfa_id = $15`,
+			request.ProjectID, request.TowerID, request.AreaID, request.DepartmentID, request.Priority, request.Subject,
+			request.Description, request.Reference, request.Recommender, request.LastRecommender,
+			request.Amount, request.Currency, request.CostCentre, customFields, nfaID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save draft"})
+			return
+		}
+
+		if err := replaceDraftLists(db, tx, nfaID, userID, &request); err != nil {
+			attachErrorResponse(c, err)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction", "details": err.Error()})
+			return
+		}
+		setNFAETag(db, c, nfaID)
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Draft saved",
+			"nfa_id":  nfaID,
+		})
+	}
+}
+
+// GetDrafts lists the session user's drafts, most recently saved first.
+func GetDrafts(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := getSessionUserID(db, c)
+		if !ok {
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT nfa_id, project_id, tower_id, area_id, department_id,
+			       COALESCE(priority, ''), COALESCE(subject, ''), COALESCE(description, ''), COALESCE(reference, ''),
+			       recommender, last_recommender, initiator_id, status,
+			       amount, COALESCE(currency, ''), COALESCE(cost_centre, ''), custom_fields
+			FROM nfa
+			WHERE initiator_id = $1 AND status = $2
+			ORDER BY draft_saved_at DESC`, userID, string(workflow.StateDraft))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch drafts"})
+			return
+		}
+		defer rows.Close()
+
+		drafts := []models.NFA{}
+		for rows.Next() {
+			var nfa models.NFA
+			var customFields []byte
+			if err := rows.Scan(&nfa.NFAID, &nfa.ProjectID, &nfa.TowerID, &nfa.AreaID, &nfa.DepartmentID, &nfa.Priority, &nfa.Subject,
+				&nfa.Description, &nfa.Reference, &nfa.Recommender, &nfa.LastRecommender, &nfa.InitiatorID, &nfa.Status,
+				&nfa.Amount, &nfa.Currency, &nfa.CostCentre, &customFields); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan drafts"})
+				return
+			}
+			nfa.CustomFields = decodeCustomFields(customFields)
+			if err := fetchApprovalsAndFiles(db, &nfa); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			drafts = append(drafts, nfa)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"drafts": drafts})
+	}
+}
+
+// validateDraft runs the checks a draft has to pass before it is submitted
+// and returns every problem found. The approval list and custom fields are
+// normalized in place.
+func validateDraft(db *sql.DB, nfa *models.NFA) ([]string, error) {
+	var problems []string
+	if nfa.ProjectID <= 0 {
+		problems = append(problems, "project_id is required")
+	}
+	if nfa.DepartmentID <= 0 {
+		problems = append(problems, "department_id is required")
+	}
+	if strings.TrimSpace(nfa.Priority) == "" {
+		problems = append(problems, "priority is required")
+	}
+	if strings.TrimSpace(nfa.Subject) == "" {
+		problems = append(problems, "subject is required")
+	}
+	if strings.TrimSpace(cleanHTML(nfa.Description)) == "" {
+		problems = append(problems, "description is required")
+	}
+	if nfa.Recommender <= 0 {
+		problems = append(problems, "recommender is required")
+	}
+	if nfa.Amount < 0 {
+		problems = append(problems, "amount must not be negative")
+	}
+
+	if nfa.DepartmentID > 0 {
+		customFields, err := validateCustomFields(db, nfa.DepartmentID, nfa.CustomFields, nfa.CustomFields)
+		if errors.Is(err, errCustomField) {
+			problems = append(problems, err.Error())
+		} else if err != nil {
+			return nil, err
+		}
+		nfa.CustomFields = customFields
+	}
+
+	if err := normalizeApprovalStages(nfa.Approvals); err != nil {
+		problems = append(problems, err.Error())
+	} else if err := checkApprovalMatrix(db, nfa.DepartmentID, nfa.ProjectID, nfa.Amount, approverIDs(nfa.Approvals)); err != nil {
+		if !errors.Is(err, errApprovalMatrix) {
+			return nil, err
+		}
+		problems = append(problems, err.Error())
+	}
+	return problems, nil
+}
+
+// SubmitDraft validates a draft in full and moves it into the workflow.
+func SubmitDraft(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := getSessionUserID(db, c)
+		if !ok {
+			return
+		}
+
+		nfaID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid NFA ID"})
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+			return
+		}
+		defer tx.Rollback()
+
+		if !loadOwnDraft(tx, c, nfaID, userID) {
+			return
+		}
+
+		nfa := models.NFA{NFAID: nfaID}
+		var customFields []byte
+		var templateID int
+		err = tx.QueryRow(`
+			SELECT project_id, department_id, COALESCE(priority, ''), COALESCE(subject, ''), COALESCE(description, ''),
+			       recommender, amount, custom_fields, COALESCE(template_id, 0)
+			FROM nfa WHERE nfa_id = $1`, nfaID).Scan(&nfa.ProjectID, &nfa.DepartmentID, &nfa.Priority, &nfa.Subject,
+			&nfa.Description, &nfa.Recommender, &nfa.Amount, &customFields, &templateID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load draft"})
+			return
+		}
+		nfa.CustomFields = decodeCustomFields(customFields)
+		if err := fetchApprovalsAndFiles(db, &nfa); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		problems, err := validateDraft(db, &nfa)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// A draft cloned from an NFA raised from a template has to follow it
+		if err := checkNFATemplate(db, tx, templateID, &nfa); errors.Is(err, errTemplate) {
+			problems = append(problems, err.Error())
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(problems) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Draft is not ready to submit", "details": problems})
+			return
+		}
+
+		// Store the stage rules as normalized during validation
+		for _, approval := range nfa.Approvals {
+			_, err := tx.Exec(`UPDATE nfa_approval_list SET approval_rule = $1, required_approvals = $2 WHERE id = $3`,
+				approval.Rule, approval.RequiredApprovals, approval.ID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update approval list"})
+				return
+			}
+		}
+
+		if err := workflow.NFA.Transition(tx, nfaID, workflow.InitialState, userID, ""); err != nil {
+			status := http.StatusInternalServerError
+			var transitionErr *workflow.TransitionError
+			if errors.As(err, &transitionErr) {
+				status = http.StatusConflict
+			}
+			c.JSON(status, gin.H{"error": "Failed to submit draft", "details": err.Error()})
+			return
+		}
+
+		encoded, err := encodeCustomFields(nfa.CustomFields)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// Drafts are numbered on submission so abandoned ones use no numbers
+		nfaNumber, err := storage.AllocateNFANumber(tx, nfa.DepartmentID, nfa.ProjectID, time.Now())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if _, err := tx.Exec(`UPDATE nfa SET draft_saved_at = NULL, custom_fields = $1, nfa_number = $2 WHERE nfa_id = $3`,
+			encoded, nfaNumber, nfaID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit draft"})
+			return
+		}
+
+		// Autosaves are not versioned; the history starts with the submitted
+		// content
+		if _, err := storage.RecordNFAVersion(tx, nfaID, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction", "details": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":    "NFA submitted successfully",
+			"nfa_id":     nfaID,
+			"nfa_number": nfaNumber,
+			"status":     string(workflow.InitialState),
+		})
+	}
+}
+
+// ExpireDrafts is run by the scheduler and deletes drafts that have not been
+// saved for DRAFT_EXPIRY_DAYS days.
+func ExpireDrafts(db *sql.DB) error {
+	days, err := strconv.Atoi(os.Getenv("DRAFT_EXPIRY_DAYS"))
+	if err != nil || days <= 0 {
+		days = defaultDraftExpiryDays
+	}
+
+	rows, err := db.Query(`
+		SELECT nfa_id FROM nfa
+		WHERE status = $1
+		AND draft_saved_at < CURRENT_TIMESTAMP - make_interval(days => $2)`,
+		string(workflow.StateDraft), days)
+	if err != nil {
+		return fmt.Errorf("failed to fetch expired drafts: %v", err)
+	}
+	var expired []int
+	for rows.Next() {
+		var nfaID int
+		if err := rows.Scan(&nfaID); err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, nfaID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, nfaID := range expired {
+		if err := expireDraft(db, nfaID, days); err != nil {
+			log.Printf("Error expiring draft %d: %v", nfaID, err)
+		}
+	}
+	return nil
+}
+
+func expireDraft(db *sql.DB, nfaID, days int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The draft may have been saved or submitted since it was picked up
+	err = tx.QueryRow(`
+		SELECT nfa_id FROM nfa
+		WHERE nfa_id = $1 AND status = $2
+		AND draft_saved_at < CURRENT_TIMESTAMP - make_interval(days => $3)
+		FOR UPDATE`, nfaID, string(workflow.StateDraft), days).Scan(&nfaID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := deleteNFARecords(tx, nfaID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Expired draft NFA %d", nfaID)
+	return nil
+}
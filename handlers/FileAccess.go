@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"nfa-app/filestore"
+	"nfa-app/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errFileAccess is returned when a file is attached that the user may not
+// see.
+var errFileAccess = errors.New("file not accessible")
+
+// fileKey returns the file store key an attachment path points at: the path
+// itself, or the file parameter of a get_file URL. Links to other sites have
+// no key.
+func fileKey(path string) string {
+	u, err := url.Parse(path)
+	if err != nil {
+		return ""
+	}
+	key := u.Query().Get("file")
+	if key == "" && u.Scheme == "" && u.Host == "" {
+		key = u.Path
+	}
+	if !filestore.ValidKey(key) {
+		return ""
+	}
+	return key
+}
+
+// canAccessFile reports whether the user may download a stored file: they
+// uploaded it, they are an admin, or they take part in an NFA that has it as
+// an attachment or in its comment thread.
+func canAccessFile(db *sql.DB, key string, userID int) (bool, error) {
+	if userID == 0 {
+		return false, nil
+	}
+
+	var uploaded bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM uploaded_files WHERE file_name = $1 AND uploaded_by = $2)`,
+		key, userID).Scan(&uploaded)
+	if err != nil || uploaded {
+		return uploaded, err
+	}
+
+	nfaIDs, err := fileNFAIDs(db, key)
+	if err != nil {
+		return false, err
+	}
+	for _, nfaID := range nfaIDs {
+		participant, err := isNFAParticipant(db, nfaID, userID)
+		if err != nil || participant {
+			return participant, err
+		}
+	}
+	return isAdminUser(db, userID)
+}
+
+// fileNFAIDs returns the NFAs a stored file belongs to: its owner and every
+// NFA that has it as an attachment or in its comment thread.
+func fileNFAIDs(db *sql.DB, key string) ([]int, error) {
+	rows, err := db.Query(`
+		SELECT nfa_id FROM uploaded_files WHERE file_name = $1 AND nfa_id IS NOT NULL
+		UNION
+		SELECT c.nfa_id FROM uploaded_files f JOIN nfa_comments c ON c.id = f.comment_id WHERE f.file_name = $1
+		UNION
+		SELECT nfa_id FROM nfa_files WHERE file_key = $1
+		UNION
+		SELECT c.nfa_id FROM nfa_comment_files f JOIN nfa_comments c ON c.id = f.comment_id WHERE f.file_name = $1`, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var nfaIDs []int
+	for rows.Next() {
+		var nfaID int
+		if err := rows.Scan(&nfaID); err != nil {
+			return nil, err
+		}
+		nfaIDs = append(nfaIDs, nfaID)
+	}
+	return nfaIDs, rows.Err()
+}
+
+// requireFileAccess checks that the session user may download the file. When
+// it fails, the error response has already been written.
+func requireFileAccess(db *sql.DB, c *gin.Context, key string) bool {
+	userID, ok := getSessionUserID(db, c)
+	if !ok {
+		return false
+	}
+	allowed, err := canAccessFile(db, key, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check access"})
+		return false
+	}
+	if !allowed {
+		// Not revealing whether the file exists
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return false
+	}
+	return true
+}
+
+// nfaFileKeys returns the keys of the files already attached to the NFA.
+func nfaFileKeys(tx *sql.Tx, nfaID int) (map[string]bool, error) {
+	rows, err := tx.Query(`SELECT file_key FROM nfa_files WHERE nfa_id = $1 AND file_key IS NOT NULL`, nfaID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch files: %v", err)
+	}
+	defer rows.Close()
+
+	keys := map[string]bool{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys[key] = true
+	}
+	return keys, rows.Err()
+}
+
+// claimFile checks that the user may attach the stored file and that it was
+// not found infected, and makes the NFA or comment its owner if it has none
+// yet. Files in existing are already attached and are not checked again.
+func claimFile(db *sql.DB, tx *sql.Tx, key string, userID, nfaID, commentID int, existing map[string]bool) error {
+	if !existing[key] {
+		allowed, err := canAccessFile(db, key, userID)
+		if err != nil {
+			return fmt.Errorf("failed to check file access: %v", err)
+		}
+		if !allowed {
+			return fmt.Errorf("%w: '%s'", errFileAccess, key)
+		}
+	}
+	status, err := fileScanStatus(tx, key)
+	if err != nil {
+		return fmt.Errorf("failed to check scan status: %v", err)
+	}
+	if status == scanInfected {
+		return fmt.Errorf("%w: '%s'", errInfectedFile, key)
+	}
+	_, err = tx.Exec(`
+		UPDATE uploaded_files SET nfa_id = NULLIF($2, 0), comment_id = NULLIF($3, 0)
+		WHERE file_name = $1 AND nfa_id IS NULL AND comment_id IS NULL`, key, nfaID, commentID)
+	if err != nil {
+		return fmt.Errorf("failed to record file owner: %v", err)
+	}
+	return nil
+}
+
+// insertNFAFiles attaches the files to the NFA. userID is who attaches them;
+// files that point at the file store must be visible to them unless they are
+// in existing. Adding files must keep the NFA within its quota.
+func insertNFAFiles(db *sql.DB, tx *sql.Tx, nfaID, userID int, files []models.NFAFile, existing map[string]bool) error {
+	added := false
+	for i := range files {
+		files[i].NFAID = nfaID
+		key := fileKey(files[i].Path)
+		if key != "" {
+			if err := claimFile(db, tx, key, userID, nfaID, 0, existing); err != nil {
+				return err
+			}
+			added = added || !existing[key]
+		}
+		err := tx.QueryRow(`
+			INSERT INTO nfa_files (nfa_id, file_name, file_path, file_type, file_key)
+			VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, '')) RETURNING id`,
+			nfaID, files[i].Name, files[i].Path, files[i].Type, key).Scan(&files[i].ID)
+		if err != nil {
+			return fmt.Errorf("failed to insert file records: %v", err)
+		}
+	}
+	if added {
+		return checkNFAQuota(tx, nfaID)
+	}
+	return nil
+}
+
+// attachErrorResponse writes the response for an error from insertNFAFiles or
+// a function that calls it.
+func attachErrorResponse(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errFileAccess):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot attach file", "details": err.Error()})
+	case errors.Is(err, errInfectedFile):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot attach file", "details": err.Error()})
+	case errors.Is(err, errNFAQuota):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Cannot attach file", "details": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -2,53 +2,40 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"nfa-app/filestore"
 	"nfa-app/models"
 	"os"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jung-kurt/gofpdf"
 )
 
-// downloadImage downloads an image from URL and saves it to a temporary file
-func downloadImage(url string) (string, error) {
-	// Create temp directory if it doesn't exist
-	tempDir := "temp"
-	if err := os.MkdirAll(tempDir, 0755); err != nil {
-		return "", err
-	}
-
-	// Create temporary file
-	tmpFile := filepath.Join(tempDir, "logo.png")
+// defaultPDFLogo is the file store key of the logo used when PDF_LOGO_FILE is
+// not set.
+const defaultPDFLogo = "1744967687116863871-image_2025_02_18T15_14_58_472Z.png"
 
-	// Download the file
-	resp, err := http.Get(url)
-	if err != nil {
-		return "", err
+// readPDFLogo reads the logo straight from the file store; get_file needs a
+// session, so it can no longer be fetched over HTTP.
+func readPDFLogo(ctx context.Context) ([]byte, error) {
+	key := os.Getenv("PDF_LOGO_FILE")
+	if key == "" {
+		key = defaultPDFLogo
 	}
-	defer resp.Body.Close()
-
-	// Create the file
-	out, err := os.Create(tmpFile)
-	if err != nil {
-		return "", err
-	}
-	defer out.Close()
-
-	// Write the body to file
-	_, err = io.Copy(out, resp.Body)
+	object, err := filestore.Get().Open(ctx, key)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	return tmpFile, nil
+	defer object.Close()
+	return io.ReadAll(object)
 }
 
 // Helper function to clean HTML tags and format text
@@ -84,186 +71,263 @@ func GenerateNFAPDF(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		var nfa models.NFA
-		err = db.QueryRow(`
-			SELECT nfa_id, project_id, tower_id, area_id, department_id, 
-			       priority, subject, description, reference, recommender, last_recommender
-			FROM nfa WHERE nfa_id = $1`, nfaID).Scan(
-			&nfa.NFAID, &nfa.ProjectID, &nfa.TowerID, &nfa.AreaID, &nfa.DepartmentID,
-			&nfa.Priority, &nfa.Subject, &nfa.Description, &nfa.Reference, &nfa.Recommender, &nfa.LastRecommender)
-		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "NFA not found"})
+		if _, ok := requireParticipant(db, c, nfaID); !ok {
 			return
 		}
 
-		var (
-			projectName     = getName(db, "SELECT project_name FROM projects WHERE project_id = $1", nfa.ProjectID)
-			departmentName  = getName(db, "SELECT department_name FROM departments WHERE department_id = $1", nfa.DepartmentID)
-			areaName        = getName(db, "SELECT area_name FROM areas WHERE area_id = $1", nfa.AreaID)
-			towerName       = getName(db, "SELECT tower_name FROM towers WHERE tower_id = $1", nfa.TowerID)
-			recommenderName = getName(db, "SELECT name FROM users WHERE id = $1", nfa.Recommender)
-		)
-
-		pdf := gofpdf.New("P", "mm", "A4", "")
-		pdf.SetMargins(20, 20, 20)
-		pdf.AddPage()
-
-		// Set footer callback
-		pdf.SetFooterFunc(func() {
-			pdf.SetY(-15) // Position at 15 mm from bottom
-			pdf.SetFont("Arial", "I", 8)
-			pdf.SetTextColor(128, 128, 128) // Gray color
-			pdf.CellFormat(0, 10, "This is a system generated Approved NFA, does not require signature.", "", 0, "C", false, 0, "")
-		})
-
-		// Download and add logo
-		logoURL := "https://nfa.blueinvent.com/api/get_file?file=1744967687116863871-image_2025_02_18T15_14_58_472Z.png"
-		logoPath, err := downloadImage(logoURL)
-		if err == nil {
-			pdf.Image(logoPath, 150, 10, 40, 0, false, "", 0, "")
-			// Clean up the temporary file
-			defer os.Remove(logoPath)
-		} else {
-			// Fallback to text if image download fails
-			pdf.SetFont("Arial", "B", 16)
-			pdf.SetXY(150, 10)
-			pdf.Cell(40, 10, "JAYPEE")
+		pdf, nfaNumber, err := renderNFAPDF(c.Request.Context(), db, nfaID, c.Query("include_comments") == "true")
+		if errors.Is(err, errNFANotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "NFA not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
 		}
 
-		// NFA Number with better spacing
-		pdf.SetFont("Arial", "B", 12)
-		pdf.SetXY(20, 20)
-		pdf.Cell(40, 10, "NFA No. "+strconv.Itoa(nfa.NFAID))
-
-		// Title centered with better spacing and dark blue color
-		pdf.SetFont("Arial", "B", 14)
-		pdf.SetTextColor(0, 0, 139) // Dark blue color
-		pdf.SetY(35)
-		pdf.CellFormat(170, 10, "Note For Approval", "", 0, "C", false, 0, "")
-		pdf.Ln(15)
-		pdf.SetTextColor(0, 0, 0) // Reset to black color
+		c.Header("Content-Description", "File Transfer")
+		c.Header("Content-Transfer-Encoding", "binary")
+		c.Header("Content-Disposition", "attachment; filename=NFA-"+numberFileName(nfaNumber)+".pdf")
+		c.Header("Content-Type", "application/pdf")
+		c.Header("Expires", "0")
+		c.Header("Cache-Control", "must-revalidate")
+		c.Header("Pragma", "public")
 
-		// Header section with improved alignment and spacing
-		pdf.SetFont("Arial", "B", 10)
-		pdf.Cell(25, 8, "Area:-")
-		pdf.SetFont("Arial", "", 10)
-		pdf.Cell(50, 8, areaName)
-		pdf.SetFont("Arial", "B", 10)
-		pdf.Cell(30, 8, "Project:-")
-		pdf.SetFont("Arial", "", 10)
-		pdf.Cell(65, 8, projectName)
-		pdf.Ln(10)
+		c.Data(http.StatusOK, "application/pdf", pdf)
+	}
+}
 
-		pdf.SetFont("Arial", "B", 10)
-		pdf.Cell(25, 8, "Tower:-")
-		pdf.SetFont("Arial", "", 10)
-		pdf.Cell(50, 8, towerName)
-		pdf.SetFont("Arial", "B", 10)
-		pdf.Cell(30, 8, "Department:-")
-		pdf.SetFont("Arial", "", 10)
-		pdf.Cell(65, 8, departmentName)
-		pdf.Ln(10)
+// renderNFAPDF renders the approval PDF of the NFA and returns it with the
+// number used to name the file. It returns errNFANotFound for unknown NFAs.
+func renderNFAPDF(ctx context.Context, db *sql.DB, nfaID int, includeComments bool) ([]byte, string, error) {
+	var nfa models.NFA
+	var customFieldValues []byte
+	err := db.QueryRow(`
+		SELECT nfa_id, project_id, tower_id, area_id, department_id, 
+		       priority, subject, description, reference, recommender, last_recommender, custom_fields,
+		       COALESCE(nfa_number, '')
+		FROM nfa WHERE nfa_id = $1`, nfaID).Scan(
+		&nfa.NFAID, &nfa.ProjectID, &nfa.TowerID, &nfa.AreaID, &nfa.DepartmentID,
+		&nfa.Priority, &nfa.Subject, &nfa.Description, &nfa.Reference, &nfa.Recommender, &nfa.LastRecommender,
+		&customFieldValues, &nfa.NFANumber)
+	if err != nil {
+		return nil, "", errNFANotFound
+	}
+	nfa.CustomFields = decodeCustomFields(customFieldValues)
 
-		// Reference section in original text format
-		pdf.SetFont("Arial", "B", 10)
-		pdf.Cell(25, 8, "Reference:-")
-		pdf.SetFont("Arial", "", 10)
-		pdf.Cell(50, 8, nfa.Reference)
-		pdf.SetFont("Arial", "B", 10)
-		pdf.Cell(30, 8, "Priority:-")
-		pdf.SetFont("Arial", "", 10)
-		pdf.Cell(65, 8, nfa.Priority)
-		pdf.Ln(12)
+	// NFAs raised before numbering was introduced only have their ID
+	nfaNumber := nfa.NFANumber
+	if nfaNumber == "" {
+		nfaNumber = strconv.Itoa(nfa.NFAID)
+	}
 
-		// Initiator with improved spacing
-		pdf.SetFont("Arial", "B", 10)
-		pdf.Cell(25, 8, "Initiator:-")
-		pdf.SetFont("Arial", "", 10)
-		pdf.Cell(0, 8, recommenderName)
-		pdf.Ln(12)
+	// Deactivated fields are still printed if the NFA has a value for them
+	customFields, err := fetchCustomFields(db, nfa.DepartmentID, true)
+	if err != nil {
+		return nil, "", err
+	}
 
-		// Subject on same line
-		pdf.SetFont("Arial", "B", 10)
-		pdf.Cell(25, 8, "Subject:-")
-		pdf.SetFont("Arial", "", 10)
-		pdf.Cell(50, 8, nfa.Subject)
-		pdf.Ln(12)
+	var (
+		projectName     = getName(db, "SELECT project_name FROM projects WHERE project_id = $1", nfa.ProjectID)
+		departmentName  = getName(db, "SELECT department_name FROM departments WHERE department_id = $1", nfa.DepartmentID)
+		areaName        = getName(db, "SELECT area_name FROM areas WHERE area_id = $1", nfa.AreaID)
+		towerName       = getName(db, "SELECT tower_name FROM towers WHERE tower_id = $1", nfa.TowerID)
+		recommenderName = getName(db, "SELECT name FROM users WHERE id = $1", nfa.Recommender)
+	)
+
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetMargins(20, 20, 20)
+	pdf.AddPage()
+
+	// Set footer callback
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-15) // Position at 15 mm from bottom
+		pdf.SetFont("Arial", "I", 8)
+		pdf.SetTextColor(128, 128, 128) // Gray color
+		pdf.CellFormat(0, 10, "This is a system generated Approved NFA, does not require signature.", "", 0, "C", false, 0, "")
+	})
+
+	// Add the logo
+	logo, err := readPDFLogo(ctx)
+	if err == nil {
+		pdf.RegisterImageOptionsReader("logo", gofpdf.ImageOptions{ImageType: "PNG"}, bytes.NewReader(logo))
+		pdf.ImageOptions("logo", 150, 10, 40, 0, false, gofpdf.ImageOptions{ImageType: "PNG"}, 0, "")
+	}
+	if err != nil || pdf.Err() {
+		// Fallback to text if the logo is missing or unreadable
+		pdf.ClearError()
+		pdf.SetFont("Arial", "B", 16)
+		pdf.SetXY(150, 10)
+		pdf.Cell(40, 10, "JAYPEE")
+	}
 
-		// Description with HTML handling
+	// NFA Number with better spacing
+	pdf.SetFont("Arial", "B", 12)
+	pdf.SetXY(20, 20)
+	pdf.Cell(40, 10, "NFA No. "+nfaNumber)
+
+	// Title centered with better spacing and dark blue color
+	pdf.SetFont("Arial", "B", 14)
+	pdf.SetTextColor(0, 0, 139) // Dark blue color
+	pdf.SetY(35)
+	pdf.CellFormat(170, 10, "Note For Approval", "", 0, "C", false, 0, "")
+	pdf.Ln(15)
+	pdf.SetTextColor(0, 0, 0) // Reset to black color
+
+	// Header section with improved alignment and spacing
+	pdf.SetFont("Arial", "B", 10)
+	pdf.Cell(25, 8, "Area:-")
+	pdf.SetFont("Arial", "", 10)
+	pdf.Cell(50, 8, areaName)
+	pdf.SetFont("Arial", "B", 10)
+	pdf.Cell(30, 8, "Project:-")
+	pdf.SetFont("Arial", "", 10)
+	pdf.Cell(65, 8, projectName)
+	pdf.Ln(10)
+
+	pdf.SetFont("Arial", "B", 10)
+	pdf.Cell(25, 8, "Tower:-")
+	pdf.SetFont("Arial", "", 10)
+	pdf.Cell(50, 8, towerName)
+	pdf.SetFont("Arial", "B", 10)
+	pdf.Cell(30, 8, "Department:-")
+	pdf.SetFont("Arial", "", 10)
+	pdf.Cell(65, 8, departmentName)
+	pdf.Ln(10)
+
+	// Reference section in original text format
+	pdf.SetFont("Arial", "B", 10)
+	pdf.Cell(25, 8, "Reference:-")
+	pdf.SetFont("Arial", "", 10)
+	pdf.Cell(50, 8, nfa.Reference)
+	pdf.SetFont("Arial", "B", 10)
+	pdf.Cell(30, 8, "Priority:-")
+	pdf.SetFont("Arial", "", 10)
+	pdf.Cell(65, 8, nfa.Priority)
+	pdf.Ln(12)
+
+	// Initiator with improved spacing
+	pdf.SetFont("Arial", "B", 10)
+	pdf.Cell(25, 8, "Initiator:-")
+	pdf.SetFont("Arial", "", 10)
+	pdf.Cell(0, 8, recommenderName)
+	pdf.Ln(12)
+
+	// Subject on same line
+	pdf.SetFont("Arial", "B", 10)
+	pdf.Cell(25, 8, "Subject:-")
+	pdf.SetFont("Arial", "", 10)
+	pdf.Cell(50, 8, nfa.Subject)
+	pdf.Ln(12)
+
+	// Department custom fields, one per line in the department's order
+	for _, field := range customFields {
+		value, ok := nfa.CustomFields[field.Name]
+		if !ok {
+			continue
+		}
 		pdf.SetFont("Arial", "B", 10)
-		pdf.Cell(25, 8, "Description:-")
+		pdf.CellFormat(45, 8, field.Label+":-", "", 0, "L", false, 0, "")
 		pdf.SetFont("Arial", "", 10)
-		pdf.Ln(8)
-		pdf.SetX(25)
-
-		if nfa.Description == "" {
-			pdf.MultiCell(0, 6, "No description provided", "", "L", false)
-		} else {
-			// Clean and format the HTML description
-			cleanedDescription := cleanHTML(nfa.Description)
-
-			// Split into lines and handle bullet points
-			lines := strings.Split(cleanedDescription, "\n")
-			for _, line := range lines {
-				line = strings.TrimSpace(line)
-				if line == "" {
-					continue
-				}
+		pdf.MultiCell(0, 8, formatCustomFieldValue(db, field, value), "", "L", false)
+	}
+	if len(nfa.CustomFields) > 0 {
+		pdf.Ln(4)
+	}
 
-				// If line starts with bullet point, add proper indentation
-				if strings.HasPrefix(line, "•") {
-					pdf.SetX(25)
-					pdf.MultiCell(0, 6, line, "", "L", false)
-				} else {
-					pdf.SetX(25)
-					pdf.MultiCell(0, 6, line, "", "L", false)
-				}
+	// Description with HTML handling
+	pdf.SetFont("Arial", "B", 10)
+	pdf.Cell(25, 8, "Description:-")
+	pdf.SetFont("Arial", "", 10)
+	pdf.Ln(8)
+	pdf.SetX(25)
+
+	if nfa.Description == "" {
+		pdf.MultiCell(0, 6, "No description provided", "", "L", false)
+	} else {
+		// Clean and format the HTML description
+		cleanedDescription := cleanHTML(nfa.Description)
+
+		// Split into lines and handle bullet points
+		lines := strings.Split(cleanedDescription, "\n")
+		for _, line := range lines {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
 			}
-		}
-		pdf.Ln(10)
-
-		// Approval Summary section with improved spacing
-		pdf.SetFont("Arial", "B", 14)
-		pdf.CellFormat(170, 10, "NFA Approval Summary", "", 0, "C", false, 0, "")
-		pdf.Ln(12)
-
-		// Table headers with better alignment
-		pdf.SetFont("Arial", "B", 10)
-		pdf.SetFillColor(240, 240, 240)
-		pdf.SetDrawColor(128, 128, 128)
-		headers := []string{"S. No.", "Particular", "Name & Desig.", "Received", "Approved"}
-		widths := []float64{15, 35, 40, 40, 40}
 
-		for i, h := range headers {
-			pdf.CellFormat(widths[i], 8, h, "1", 0, "C", true, 0, "")
+			// If line starts with bullet point, add proper indentation
+			if strings.HasPrefix(line, "•") {
+				pdf.SetX(25)
+				pdf.MultiCell(0, 6, line, "", "L", false)
+			} else {
+				pdf.SetX(25)
+				pdf.MultiCell(0, 6, line, "", "L", false)
+			}
 		}
-		pdf.Ln(-1)
-
-		// Table content with consistent formatting
-		pdf.SetFont("Arial", "", 10)
-		rows, err := db.Query(`
-			SELECT nal.order_value, u.name, nal.status, nal.started_at, nal.updated_at 
-			FROM nfa_approval_list nal 
-			JOIN users u ON nal.approver_id = u.id 
-			WHERE nal.nfa_id = $1 
-			ORDER BY nal.order_value`, nfaID)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch approval list: " + err.Error()})
-			return
+	}
+	pdf.Ln(10)
+
+	// Approval Summary section with improved spacing
+	pdf.SetFont("Arial", "B", 14)
+	pdf.CellFormat(170, 10, "NFA Approval Summary", "", 0, "C", false, 0, "")
+	pdf.Ln(12)
+
+	// Table headers with better alignment
+	pdf.SetFont("Arial", "B", 10)
+	pdf.SetFillColor(240, 240, 240)
+	pdf.SetDrawColor(128, 128, 128)
+	headers := []string{"S. No.", "Particular", "Name & Desig.", "Received", "Approved"}
+	widths := []float64{15, 35, 40, 40, 40}
+
+	for i, h := range headers {
+		pdf.CellFormat(widths[i], 8, h, "1", 0, "C", true, 0, "")
+	}
+	pdf.Ln(-1)
+
+	// Table content with consistent formatting
+	pdf.SetFont("Arial", "", 10)
+	rows, err := db.Query(`
+		SELECT nal.order_value, nal.approval_rule, nal.required_approvals, u.name,
+		       COALESCE(nal.acted_by, nal.approver_id), COALESCE(actor.name, ''), nal.status, nal.started_at, nal.updated_at 
+		FROM nfa_approval_list nal 
+		JOIN users u ON nal.approver_id = u.id 
+		LEFT JOIN users actor ON nal.acted_by = actor.id 
+		WHERE nal.nfa_id = $1 
+		ORDER BY nal.order_value`, nfaID)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to fetch approval list: %v", err)
+	}
+	defer rows.Close()
+
+	var approvals []models.NFAApprovalList
+	for rows.Next() {
+		var approval models.NFAApprovalList
+		if err := rows.Scan(&approval.Order, &approval.Rule, &approval.RequiredApprovals, &approval.ApproverName,
+			&approval.ActedBy, &approval.ActedByName, &approval.Status, &approval.StartedDate, &approval.CompletedDate); err != nil {
+			return nil, "", fmt.Errorf("Failed to scan approval data: %v", err)
 		}
-		defer rows.Close()
+		approvals = append(approvals, approval)
+	}
 
-		orderNo := 1
-		for rows.Next() {
-			var order int
-			var name, status string
-			var createdAt, updatedAt time.Time
+	if err = rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("Error iterating approval list: %v", err)
+	}
 
-			if err := rows.Scan(&order, &name, &status, &createdAt, &updatedAt); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan approval data: " + err.Error()})
-				return
+	orderNo := 1
+	for _, stage := range groupApprovalStages(approvals) {
+		// Parallel approvers get a heading row describing the stage rule
+		if len(stage.Approvals) > 1 {
+			label := fmt.Sprintf("Parallel stage - all %d must approve", len(stage.Approvals))
+			if stage.RequiredApprovals < len(stage.Approvals) {
+				label = fmt.Sprintf("Parallel stage - any %d of %d must approve", stage.RequiredApprovals, len(stage.Approvals))
 			}
+			pdf.SetFont("Arial", "I", 9)
+			pdf.CellFormat(170, 7, label, "1", 0, "L", true, 0, "")
+			pdf.Ln(-1)
+			pdf.SetFont("Arial", "", 10)
+		}
 
+		for _, approval := range stage.Approvals {
 			particular := "Initiator"
 			if orderNo == 2 {
 				particular = "Recommender"
@@ -274,40 +338,52 @@ func GenerateNFAPDF(db *sql.DB) gin.HandlerFunc {
 			data := []string{
 				strconv.Itoa(orderNo),
 				particular,
-				name,
-				createdAt.Format("02-01-2006 15:04"),
-				updatedAt.Format("02-01-2006 15:04"),
+				approval.ApproverName,
+				approval.StartedDate.Format("02-01-2006 15:04"),
+				approval.CompletedDate.Format("02-01-2006 15:04"),
 			}
 
 			for i, txt := range data {
 				pdf.CellFormat(widths[i], 8, txt, "1", 0, "C", false, 0, "")
 			}
 			pdf.Ln(-1)
-			orderNo++
-		}
 
-		if err = rows.Err(); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error iterating approval list: " + err.Error()})
-			return
+			// A delegate acted in place of the assigned approver
+			if approval.ActedByName != "" && approval.ActedByName != approval.ApproverName {
+				verb := "Approved"
+				if approval.Status == "Rejected" {
+					verb = "Rejected"
+				}
+				pdf.SetFont("Arial", "I", 9)
+				pdf.CellFormat(170, 7, fmt.Sprintf("%s by %s on behalf of %s", verb, approval.ActedByName, approval.ApproverName), "1", 0, "L", false, 0, "")
+				pdf.Ln(-1)
+				pdf.SetFont("Arial", "", 10)
+			}
+			orderNo++
 		}
+	}
 
-		var buf bytes.Buffer
-		err = pdf.Output(&buf)
+	// The discussion thread is added as an appendix on request
+	if includeComments {
+		comments, err := fetchCommentThread(db, nfaID)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate PDF: " + err.Error()})
-			return
+			return nil, "", fmt.Errorf("Failed to fetch comments: %v", err)
 		}
+		addCommentsAppendix(pdf, comments)
+	}
 
-		c.Header("Content-Description", "File Transfer")
-		c.Header("Content-Transfer-Encoding", "binary")
-		c.Header("Content-Disposition", "attachment; filename=DOC-"+time.Now().Format("20060102")+"-WA"+strconv.Itoa(nfaID)+".pdf")
-		c.Header("Content-Type", "application/pdf")
-		c.Header("Expires", "0")
-		c.Header("Cache-Control", "must-revalidate")
-		c.Header("Pragma", "public")
-
-		c.Data(http.StatusOK, "application/pdf", buf.Bytes())
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, "", fmt.Errorf("Failed to generate PDF: %v", err)
 	}
+	return buf.Bytes(), nfaNumber, nil
+}
+
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// numberFileName makes an NFA number safe to use in a file name.
+func numberFileName(number string) string {
+	return strings.Trim(unsafeFileNameChars.ReplaceAllString(number, "-"), "-")
 }
 
 // Helper function to safely fetch names with fallback
@@ -319,3 +395,50 @@ func getName(db *sql.DB, query string, id int) string {
 	}
 	return name
 }
+
+// addCommentsAppendix writes the discussion thread on a new page, indenting
+// replies under the comment they answer.
+func addCommentsAppendix(pdf *gofpdf.Fpdf, comments []models.NFAComment) {
+	pdf.AddPage()
+	pdf.SetFont("Arial", "B", 14)
+	pdf.CellFormat(170, 10, "Appendix - Discussion", "", 0, "C", false, 0, "")
+	pdf.Ln(12)
+
+	if len(comments) == 0 {
+		pdf.SetFont("Arial", "", 10)
+		pdf.MultiCell(0, 6, "No comments", "", "L", false)
+		return
+	}
+
+	var write func(comments []models.NFAComment, depth int)
+	write = func(comments []models.NFAComment, depth int) {
+		indent := 20 + float64(depth)*8
+		for _, comment := range comments {
+			heading := fmt.Sprintf("%s - %s", comment.AuthorName, comment.CreatedAt.Format("02-01-2006 15:04"))
+			if comment.UpdatedAt != nil {
+				heading += " (edited)"
+			}
+			pdf.SetX(indent)
+			pdf.SetFont("Arial", "B", 9)
+			pdf.MultiCell(0, 5, heading, "", "L", false)
+
+			body := cleanHTML(comment.Body)
+			if comment.Deleted {
+				body = "This comment was deleted."
+			}
+			pdf.SetX(indent)
+			pdf.SetFont("Arial", "", 10)
+			pdf.MultiCell(0, 6, body, "", "L", false)
+
+			if len(comment.Files) > 0 {
+				pdf.SetX(indent)
+				pdf.SetFont("Arial", "I", 9)
+				pdf.MultiCell(0, 5, "Attachments: "+strings.Join(comment.Files, ", "), "", "L", false)
+			}
+			pdf.Ln(3)
+
+			write(comment.Replies, depth+1)
+		}
+	}
+	write(comments, 0)
+}
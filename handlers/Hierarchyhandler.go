@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net/http"
 	"nfa-app/models"
+	"os"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -126,3 +128,95 @@ func DeleteHierarchy(db *sql.DB) gin.HandlerFunc {
 		c.JSON(http.StatusOK, gin.H{"message": "Hierarchy deleted"})
 	}
 }
+
+// hierarchyMaxLevel combines the requested level cap with the one configured
+// in HIERARCHY_MAX_LEVEL. Zero means no cap; when both are set the lower wins.
+func hierarchyMaxLevel(requested int) int {
+	configured, _ := strconv.Atoi(os.Getenv("HIERARCHY_MAX_LEVEL"))
+	if configured <= 0 {
+		return requested
+	}
+	if requested <= 0 || requested > configured {
+		return configured
+	}
+	return requested
+}
+
+// buildHierarchyChain builds an approval list from the department hierarchy,
+// one approver per stage in hierarchy order. Levels above maxLevel are left
+// out when it is positive. The initiator and repeated users are skipped.
+func buildHierarchyChain(db *sql.DB, departmentID, initiatorID, maxLevel int) ([]models.NFAApprovalList, error) {
+	rows, err := db.Query(`
+		SELECT h.user_id, h.order_value, COALESCE(u.name, '')
+		FROM hierarchy h
+		LEFT JOIN users u ON h.user_id = u.id
+		WHERE h.department_id = $1
+		AND ($2 <= 0 OR h.order_value <= $2)
+		ORDER BY h.order_value ASC, h.hierarchy_id ASC`, departmentID, maxLevel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch hierarchy: %v", err)
+	}
+	defer rows.Close()
+
+	chain := []models.NFAApprovalList{}
+	seen := map[int]bool{initiatorID: true}
+	for rows.Next() {
+		var userID, level int
+		var name string
+		if err := rows.Scan(&userID, &level, &name); err != nil {
+			return nil, err
+		}
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+		chain = append(chain, models.NFAApprovalList{
+			ApproverID:   userID,
+			Order:        len(chain) + 1,
+			Rule:         "all",
+			ApproverName: name,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return chain, nil
+}
+
+// PreviewHierarchyChain shows the approval list CreateNFA would build for the
+// session user with use_hierarchy set.
+func PreviewHierarchyChain(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := getSessionUserID(db, c)
+		if !ok {
+			return
+		}
+
+		departmentID, err := strconv.Atoi(c.Param("department_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid department_id"})
+			return
+		}
+
+		requested := 0
+		if v := c.Query("max_level"); v != "" {
+			if requested, err = strconv.Atoi(v); err != nil || requested < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "max_level must be a non-negative number"})
+				return
+			}
+		}
+		maxLevel := hierarchyMaxLevel(requested)
+
+		chain, err := buildHierarchyChain(db, departmentID, userID, maxLevel)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"department_id": departmentID,
+			"max_level":     maxLevel,
+			"approval_list": chain,
+		})
+	}
+}
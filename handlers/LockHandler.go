@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"nfa-app/storage"
+	"nfa-app/workflow"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// nfaLock describes whether an NFA's content may still be edited. Once an
+// approver has acted the content is locked, except while the NFA is returned
+// for clarification or after an admin has unlocked it. A closed NFA is
+// always locked.
+type nfaLock struct {
+	Status   string
+	Started  bool // an approver has approved or rejected
+	Unlocked bool // an admin unlock is waiting to be used
+}
+
+// Locked reports whether the content fields are read-only.
+func (l nfaLock) Locked() bool {
+	if l.Closed() {
+		return true
+	}
+	return l.Started && !l.Unlocked && l.Status != string(workflow.StateReturned)
+}
+
+// Closed reports whether the NFA has reached a state nothing leaves, such as
+// Completed or Withdrawn.
+func (l nfaLock) Closed() bool {
+	state, err := workflow.ParseState(l.Status)
+	return err == nil && workflow.NFA.IsFinal(state)
+}
+
+func fetchNFALock(q storage.Querier, nfaID int) (nfaLock, error) {
+	var lock nfaLock
+	err := q.QueryRow(`
+		SELECT COALESCE(n.status, ''), n.unlocked_at IS NOT NULL,
+		       EXISTS(SELECT 1 FROM nfa_approval_list
+		              WHERE nfa_id = n.nfa_id AND status IN ('Approved', 'Rejected', 'Complete'))
+		FROM nfa n WHERE n.nfa_id = $1`, nfaID).Scan(&lock.Status, &lock.Unlocked, &lock.Started)
+	return lock, err
+}
+
+// checkApprovalListChange checks that the session user may change the
+// approval list: only the initiator or an admin can, and not once the NFA is
+// closed. The NFA row must already be locked by requireIfMatch. When it
+// fails, the error response has already been written.
+func checkApprovalListChange(db *sql.DB, c *gin.Context, tx *sql.Tx, nfaID int) (actorID int, ok bool) {
+	actorID, ok = getSessionUserID(db, c)
+	if !ok {
+		return 0, false
+	}
+
+	lock, err := fetchNFALock(tx, nfaID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return 0, false
+	}
+	if lock.Closed() {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("The NFA is %s; its approval list can no longer change", lock.Status)})
+		return 0, false
+	}
+
+	var initiatorID int
+	if err := tx.QueryRow(`SELECT COALESCE(initiator_id, 0) FROM nfa WHERE nfa_id = $1`, nfaID).Scan(&initiatorID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return 0, false
+	}
+	allowed := initiatorID == actorID
+	if !allowed {
+		if allowed, err = isAdminUser(db, actorID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check access"})
+			return 0, false
+		}
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the initiator or an admin can change the approval list"})
+		return 0, false
+	}
+	return actorID, true
+}
+
+// UnlockNFA lets an admin open a locked NFA for one more edit. The reason is
+// required and recorded in the audit log; the unlock is used up by the next
+// update.
+func UnlockNFA(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		adminID, ok := requireAdmin(db, c)
+		if !ok {
+			return
+		}
+
+		nfaID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid NFA ID"})
+			return
+		}
+
+		var request struct {
+			Reason string `json:"reason"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input data"})
+			return
+		}
+		request.Reason = strings.TrimSpace(request.Reason)
+		if request.Reason == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A reason is required to unlock an NFA"})
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+			return
+		}
+		defer tx.Rollback()
+
+		var initiatorID int
+		err = tx.QueryRow(`SELECT COALESCE(initiator_id, 0) FROM nfa WHERE nfa_id = $1 FOR UPDATE`, nfaID).Scan(&initiatorID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "NFA not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		lock, err := fetchNFALock(tx, nfaID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if lock.Closed() {
+			c.JSON(http.StatusConflict, gin.H{"error": "A closed NFA cannot be unlocked"})
+			return
+		}
+		if !lock.Locked() {
+			c.JSON(http.StatusConflict, gin.H{"error": "NFA is not locked"})
+			return
+		}
+		if !requireIfMatch(c, tx, nfaID) {
+			return
+		}
+
+		_, err = tx.Exec(`
+			UPDATE nfa SET unlocked_by = $1, unlocked_at = CURRENT_TIMESTAMP, unlock_reason = $2
+			WHERE nfa_id = $3`, adminID, request.Reason, nfaID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock NFA"})
+			return
+		}
+		if err := storage.LogNFAChange(tx, nfaID, adminID, "unlock", request.Reason); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if initiatorID != 0 {
+			message := fmt.Sprintf("NFA #%d was unlocked for editing: %s", nfaID, request.Reason)
+			if _, err := storage.CreateNotification(tx, initiatorID, nfaID, message); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction", "details": err.Error()})
+			return
+		}
+		setNFAETag(db, c, nfaID)
+
+		c.JSON(http.StatusOK, gin.H{"message": "NFA unlocked for editing", "nfa_id": nfaID})
+	}
+}
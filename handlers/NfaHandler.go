@@ -2,91 +2,47 @@ package handlers
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"nfa-app/models"
-	"os"
+	"nfa-app/storage"
+	"nfa-app/workflow"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-func UploadNFAFile() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		err := c.Request.ParseMultipartForm(0)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "File too large"})
-			return
-		}
-
-		// Get the uploaded file
-		file, header, err := c.Request.FormFile("file")
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "File upload failed"})
-			return
-		}
-		defer file.Close()
-
-		// Define upload path (modify as needed)
-		uploadDir := "./uploads/nfa/"
-		if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload directory"})
-			return
-		}
-
-		// Save file
-		filePath := uploadDir + header.Filename
-		outFile, err := os.Create(filePath)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
-			return
-		}
-		defer outFile.Close()
-
-		_, err = io.Copy(outFile, file)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write file"})
-			return
-		}
-
-		// Return file path
-		c.JSON(http.StatusOK, gin.H{
-			"message":   "File uploaded successfully",
-			"file_path": "/uploads/nfa/" + header.Filename,
-		})
-	}
-}
-
 func GetNFAByProjectID(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		fetchNFAByField(db, c, "SELECT * FROM nfa WHERE project_id = $1", c.Param("project_id"))
+		fetchNFAByField(db, c, "project_id = $1", c.Param("project_id"))
 	}
 }
 
 func GetNFAByDepartmentID(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		fetchNFAByField(db, c, "SELECT * FROM nfa WHERE department_id = $1", c.Param("department_id"))
+		fetchNFAByField(db, c, "department_id = $1", c.Param("department_id"))
 	}
 }
 
 func GetNFAByAreaID(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		fetchNFAByField(db, c, "SELECT * FROM nfa WHERE area_id = $1", c.Param("area_id"))
+		fetchNFAByField(db, c, "area_id = $1", c.Param("area_id"))
 	}
 }
 
 func GetNFAByTowerID(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		fetchNFAByField(db, c, "SELECT * FROM nfa WHERE tower_id = $1", c.Param("tower_id"))
+		fetchNFAByField(db, c, "tower_id = $1", c.Param("tower_id"))
 	}
 }
 
 func GetNFAByPriority(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		fetchNFAByField(db, c, "SELECT * FROM nfa WHERE priority = $1", c.Param("priority"))
+		fetchNFAByField(db, c, "priority = $1", c.Param("priority"))
 	}
 }
 
@@ -133,7 +89,9 @@ func GetNFAByRecommender(db *sql.DB) gin.HandlerFunc {
                 COALESCE(p.project_name, '') as project_name,
                 COALESCE(t.tower_name, '') as tower_name,
                 COALESCE(a.area_name, '') as area_name,
-                COALESCE(d.department_name, '') as department_name
+                COALESCE(d.department_name, '') as department_name,
+                n.custom_fields,
+                COALESCE(n.nfa_number, '') as nfa_number
             FROM nfa n
             LEFT JOIN users initiator ON n.initiator_id = initiator.id
             LEFT JOIN users recommender ON n.recommender = recommender.id
@@ -143,9 +101,12 @@ func GetNFAByRecommender(db *sql.DB) gin.HandlerFunc {
             LEFT JOIN areas a ON n.area_id = a.area_id
             LEFT JOIN departments d ON n.department_id = d.department_id
             WHERE n.recommender = $1
-            ORDER BY n.nfa_id DESC`
+            AND COALESCE(n.status, '') <> $2`
+
+		filters, args := nfaListFilters(c, "n.", []interface{}{recommenderID, string(workflow.StateDraft)})
+		query += filters + " ORDER BY n.nfa_id DESC"
 
-		rows, err := db.Query(query, recommenderID)
+		rows, err := db.Query(query, args...)
 		if err != nil {
 			log.Printf("Database query error: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -171,6 +132,7 @@ func GetNFAByRecommender(db *sql.DB) gin.HandlerFunc {
 
 		for rows.Next() {
 			var nfa NFAWithNames
+			var customFields []byte
 
 			err := rows.Scan(
 				&nfa.NFAID, &nfa.ProjectID, &nfa.TowerID, &nfa.AreaID,
@@ -178,7 +140,7 @@ func GetNFAByRecommender(db *sql.DB) gin.HandlerFunc {
 				&nfa.Description, &nfa.Reference, &nfa.Recommender,
 				&nfa.LastRecommender, &nfa.InitiatorID, &nfa.InitiatorName,
 				&nfa.RecommenderName, &nfa.LastRecommenderName, &nfa.ProjectName,
-				&nfa.TowerName, &nfa.AreaName, &nfa.DepartmentName,
+				&nfa.TowerName, &nfa.AreaName, &nfa.DepartmentName, &customFields, &nfa.NFANumber,
 			)
 			if err != nil {
 				log.Printf("Row scan error: %v", err)
@@ -188,6 +150,7 @@ func GetNFAByRecommender(db *sql.DB) gin.HandlerFunc {
 					"scan_error": err.Error()})
 				return
 			}
+			nfa.CustomFields = decodeCustomFields(customFields)
 
 			if err := fetchApprovalsAndFiles(db, &nfa.NFA); err != nil {
 				log.Printf("Approvals and files fetch error: %v", err)
@@ -224,11 +187,41 @@ func GetNFAByRecommender(db *sql.DB) gin.HandlerFunc {
 
 func GetAllNFA(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		fetchNFAByField(db, c, "SELECT * FROM nfa")
+		fetchNFAByField(db, c, "")
 	}
 }
 
-func fetchNFAByField(db *sql.DB, c *gin.Context, query string, args ...interface{}) {
+// SearchNFAByNumber finds NFAs whose number contains the "number" query
+// parameter, ignoring case.
+func SearchNFAByNumber(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		number := strings.TrimSpace(c.Query("number"))
+		if number == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "number is required"})
+			return
+		}
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(number) + "%"
+		fetchNFAByField(db, c, "nfa_number ILIKE $1", pattern)
+	}
+}
+
+// fetchNFAByField lists the NFAs matching the where clause, which may be
+// empty. Drafts are never listed; only their initiator can see them.
+func fetchNFAByField(db *sql.DB, c *gin.Context, where string, args ...interface{}) {
+	query := fmt.Sprintf(`
+        SELECT nfa_id, project_id, tower_id, area_id, department_id,
+               COALESCE(priority, ''), COALESCE(subject, ''), COALESCE(description, ''), COALESCE(reference, ''),
+               recommender, last_recommender, COALESCE(initiator_id, 0), COALESCE(status, ''),
+               amount, COALESCE(currency, ''), COALESCE(cost_centre, ''), custom_fields, COALESCE(nfa_number, '')
+        FROM nfa
+        WHERE COALESCE(status, '') <> $%d`, len(args)+1)
+	if where != "" {
+		query += " AND (" + where + ")"
+	}
+	args = append(args, string(workflow.StateDraft))
+	filters, args := nfaListFilters(c, "", args)
+	query += filters + " ORDER BY nfa_id DESC"
+
 	rows, err := db.Query(query, args...)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch NFAs"})
@@ -240,10 +233,14 @@ func fetchNFAByField(db *sql.DB, c *gin.Context, query string, args ...interface
 
 	for rows.Next() {
 		var nfa models.NFA
-		if err := rows.Scan(&nfa.NFAID, &nfa.ProjectID, &nfa.TowerID, &nfa.AreaID, &nfa.DepartmentID, &nfa.Priority, &nfa.Subject, &nfa.Description, &nfa.Reference, &nfa.Recommender, &nfa.LastRecommender); err != nil {
+		var customFields []byte
+		if err := rows.Scan(&nfa.NFAID, &nfa.ProjectID, &nfa.TowerID, &nfa.AreaID, &nfa.DepartmentID, &nfa.Priority, &nfa.Subject,
+			&nfa.Description, &nfa.Reference, &nfa.Recommender, &nfa.LastRecommender, &nfa.InitiatorID, &nfa.Status,
+			&nfa.Amount, &nfa.Currency, &nfa.CostCentre, &customFields, &nfa.NFANumber); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan NFAs"})
 			return
 		}
+		nfa.CustomFields = decodeCustomFields(customFields)
 
 		if err := fetchApprovalsAndFiles(db, &nfa); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -265,6 +262,13 @@ func UpdateNFA(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
+		// Only participants edit an NFA, and only its initiator a draft; the
+		// editor is recorded with the new version
+		editorID, ok := requireParticipant(db, c, nfaID)
+		if !ok {
+			return
+		}
+
 		// Define the request structure
 		var request struct {
 			ProjectID       int                      `json:"project_id"`
@@ -277,8 +281,12 @@ func UpdateNFA(db *sql.DB) gin.HandlerFunc {
 			Reference       string                   `json:"reference"`
 			Recommender     int                      `json:"recommender"`
 			LastRecommender int                      `json:"last_recommender"`
+			Amount          models.Money             `json:"amount"`
+			Currency        string                   `json:"currency"`
+			CostCentre      string                   `json:"cost_centre"`
 			ApprovalList    []models.NFAApprovalList `json:"approval_list"`
 			Files           []models.NFAFile         `json:"files"`
+			CustomFields    map[string]interface{}   `json:"custom_fields"`
 		}
 
 		// Bind the JSON request
@@ -286,17 +294,121 @@ func UpdateNFA(db *sql.DB) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
 			return
 		}
+		// A negative amount would fall outside every band of the approval
+		// matrix and skip it
+		if request.Amount < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "amount must not be negative"})
+			return
+		}
+
+		if err := normalizeApprovalStages(request.ApprovalList); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid approval list", "details": err.Error()})
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+			return
+		}
+		defer tx.Rollback()
+
+		if !requireIfMatch(c, tx, nfaID) {
+			return
+		}
+
+		lock, err := fetchNFALock(tx, nfaID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch NFA"})
+			return
+		}
+		if lock.Closed() {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":   "NFA is locked",
+				"details": fmt.Sprintf("The NFA is %s and can no longer be edited", lock.Status)})
+			return
+		}
+		if lock.Locked() {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":   "NFA is locked",
+				"details": "Approval has started; the content can only be edited after the NFA is returned or unlocked by an admin"})
+			return
+		}
+
+		// An NFA raised from a template keeps following it
+		var templateID int
+		var storedFields []byte
+		err = tx.QueryRow(`SELECT COALESCE(template_id, 0), custom_fields FROM nfa WHERE nfa_id = $1`, nfaID).Scan(&templateID, &storedFields)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch NFA"})
+			return
+		}
+		nfa := models.NFA{
+			ProjectID:    request.ProjectID,
+			DepartmentID: request.DepartmentID,
+			Priority:     request.Priority,
+			Subject:      request.Subject,
+			Description:  request.Description,
+			Files:        request.Files,
+		}
+		if err := checkNFATemplate(db, tx, templateID, &nfa); errors.Is(err, errTemplate) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid NFA for template", "details": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		request.ProjectID = nfa.ProjectID
+		request.DepartmentID = nfa.DepartmentID
+		request.Priority = nfa.Priority
+		request.Description = nfa.Description
+
+		customFields, ok := checkCustomFields(db, c, request.DepartmentID, request.CustomFields, decodeCustomFields(storedFields))
+		if !ok {
+			return
+		}
+
+		// Once the NFA has left Pending its approval list carries the stage
+		// progress, so it is kept and only changes through AddApprover and
+		// RemoveApprover; the details and files are edited
+		keepApprovals := lock.Status != string(workflow.StateDraft) && lock.Status != string(workflow.StatePending)
+
+		approvers := approverIDs(request.ApprovalList)
+		if keepApprovals {
+			same, err := sameApprovalList(tx, nfaID, request.ApprovalList)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if !same {
+				c.JSON(http.StatusConflict, gin.H{
+					"error":   "Approval list cannot be changed",
+					"details": fmt.Sprintf("The NFA is %s; use the approver endpoints to add or remove approvers", lock.Status)})
+				return
+			}
+			approvers, err = currentApproverIDs(tx, nfaID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if err := checkApprovalMatrix(tx, request.DepartmentID, request.ProjectID, request.Amount, approvers); err != nil {
+			approvalMatrixErrorResponse(c, err)
+			return
+		}
 
 		// Update the NFA record
 		updateQuery := `UPDATE nfa SET 
             project_id = $1, tower_id = $2, area_id = $3, department_id = $4, 
             priority = $5, subject = $6, description = $7, reference = $8, 
-            recommender = $9, last_recommender = $10
-            WHERE nfa_id = $11`
+            recommender = $9, last_recommender = $10,
+            amount = $11, currency = NULLIF($12, ''), cost_centre = NULLIF($13, ''),
+            custom_fields = $14
+            WHERE nfa_id = $15`
 
-		_, err = db.Exec(updateQuery, request.ProjectID, request.TowerID, request.AreaID, request.DepartmentID,
+		_, err = tx.Exec(updateQuery, request.ProjectID, request.TowerID, request.AreaID, request.DepartmentID,
 			request.Priority, request.Subject, request.Description, request.Reference, request.Recommender,
-			request.LastRecommender, nfaID)
+			request.LastRecommender, request.Amount, request.Currency, request.CostCentre, customFields, nfaID)
 
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update NFA"})
@@ -304,46 +416,80 @@ func UpdateNFA(db *sql.DB) gin.HandlerFunc {
 		}
 
 		// Delete old approvals and insert updated approval list
-		_, err = db.Exec("DELETE FROM nfa_approval_list WHERE nfa_id = $1", nfaID)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear old approval list"})
-			return
-		}
-
-		for i := range request.ApprovalList {
-			request.ApprovalList[i].NFAID = nfaID
-			approvalQuery := `INSERT INTO nfa_approval_list (nfa_id, approver_id, "order_value") VALUES ($1, $2, $3) RETURNING id`
-			err := db.QueryRow(approvalQuery, request.ApprovalList[i].NFAID, request.ApprovalList[i].ApproverID, request.ApprovalList[i].Order).Scan(&request.ApprovalList[i].ID)
+		if !keepApprovals {
+			_, err = tx.Exec("DELETE FROM nfa_approval_list WHERE nfa_id = $1", nfaID)
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to insert approval list"})
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear old approval list"})
 				return
 			}
+
+			for i := range request.ApprovalList {
+				request.ApprovalList[i].NFAID = nfaID
+				approvalQuery := `INSERT INTO nfa_approval_list (nfa_id, approver_id, "order_value", approval_rule, required_approvals) VALUES ($1, $2, $3, $4, $5) RETURNING id`
+				err := tx.QueryRow(approvalQuery, request.ApprovalList[i].NFAID, request.ApprovalList[i].ApproverID, request.ApprovalList[i].Order,
+					request.ApprovalList[i].Rule, request.ApprovalList[i].RequiredApprovals).Scan(&request.ApprovalList[i].ID)
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to insert approval list"})
+					return
+				}
+			}
 		}
 
 		// Delete old files and insert updated files
-		_, err = db.Exec("DELETE FROM nfa_files WHERE nfa_id = $1", nfaID)
+		existingFiles, err := nfaFileKeys(tx, nfaID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		_, err = tx.Exec("DELETE FROM nfa_files WHERE nfa_id = $1", nfaID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear old file records"})
 			return
 		}
 
-		for i := range request.Files {
-			request.Files[i].NFAID = nfaID
-			fileQuery := `INSERT INTO nfa_files (nfa_id, file_name, file_path) VALUES ($1, $2, $3) RETURNING id`
-			err := db.QueryRow(fileQuery, request.Files[i].NFAID, request.Files[i].Name, request.Files[i].Path).Scan(&request.Files[i].ID)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to insert file records"})
+		if err := insertNFAFiles(db, tx, nfaID, editorID, request.Files, existingFiles); err != nil {
+			attachErrorResponse(c, err)
+			return
+		}
+
+		// Snapshot the saved content
+		version, err := storage.RecordNFAVersion(tx, nfaID, editorID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// An admin unlock covers a single edit
+		if lock.Unlocked {
+			if _, err := tx.Exec(`UPDATE nfa SET unlocked_by = NULL, unlocked_at = NULL, unlock_reason = NULL WHERE nfa_id = $1`, nfaID); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to relock NFA"})
+				return
+			}
+			if err := storage.LogNFAChange(tx, nfaID, editorID, "edit_after_unlock", fmt.Sprintf("saved as version %d", version)); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
 			}
 		}
 
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction", "details": err.Error()})
+			return
+		}
+		setNFAETag(db, c, nfaID)
+
 		// Success response
-		c.JSON(http.StatusOK, gin.H{
+		response := gin.H{
 			"message":       "NFA updated successfully",
 			"nfa_id":        nfaID,
+			"version":       version,
 			"approval_list": request.ApprovalList,
 			"files":         request.Files,
-		})
+		}
+		if keepApprovals {
+			delete(response, "approval_list")
+			response["approval_list_kept"] = true
+		}
+		c.JSON(http.StatusOK, response)
 	}
 }
 
@@ -363,27 +509,9 @@ func DeleteNFA(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		// Delete approval list associated with the NFA
-		_, err = tx.Exec("DELETE FROM nfa_approval_list WHERE nfa_id = $1", nfaID)
-		if err != nil {
+		if err := deleteNFARecords(tx, nfaID); err != nil {
 			tx.Rollback()
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete approval list"})
-			return
-		}
-
-		// Delete files associated with the NFA
-		_, err = tx.Exec("DELETE FROM nfa_files WHERE nfa_id = $1", nfaID)
-		if err != nil {
-			tx.Rollback()
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file records"})
-			return
-		}
-
-		// Delete the NFA record itself
-		_, err = tx.Exec("DELETE FROM nfa WHERE nfa_id = $1", nfaID)
-		if err != nil {
-			tx.Rollback()
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete NFA"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
@@ -402,6 +530,56 @@ func DeleteNFA(db *sql.DB) gin.HandlerFunc {
 	}
 }
 
+// deleteNFARecords removes the NFA together with everything stored against it.
+func deleteNFARecords(tx *sql.Tx, nfaID int) error {
+	// Delete approval list associated with the NFA
+	if _, err := tx.Exec("DELETE FROM nfa_approval_list WHERE nfa_id = $1", nfaID); err != nil {
+		return errors.New("Failed to delete approval list")
+	}
+
+	// Delete files associated with the NFA
+	if _, err := tx.Exec("DELETE FROM nfa_files WHERE nfa_id = $1", nfaID); err != nil {
+		return errors.New("Failed to delete file records")
+	}
+
+	// The stored files outlive the NFA; only their uploaders can still see them
+	_, err := tx.Exec(`UPDATE uploaded_files SET nfa_id = NULL, comment_id = NULL
+		WHERE nfa_id = $1 OR comment_id IN (SELECT id FROM nfa_comments WHERE nfa_id = $1)`, nfaID)
+	if err != nil {
+		return errors.New("Failed to release uploaded files")
+	}
+
+	// Delete the status history of the NFA
+	if _, err := tx.Exec("DELETE FROM nfa_status_history WHERE nfa_id = $1", nfaID); err != nil {
+		return errors.New("Failed to delete status history")
+	}
+
+	// Delete the comment thread along with its history, mentions and attachments
+	for _, table := range []string{"nfa_comment_history", "nfa_comment_mentions", "nfa_comment_files"} {
+		_, err := tx.Exec("DELETE FROM "+table+" WHERE comment_id IN (SELECT id FROM nfa_comments WHERE nfa_id = $1)", nfaID)
+		if err != nil {
+			return errors.New("Failed to delete comments")
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM nfa_comments WHERE nfa_id = $1", nfaID); err != nil {
+		return errors.New("Failed to delete comments")
+	}
+
+	if _, err := tx.Exec("DELETE FROM nfa_versions WHERE nfa_id = $1", nfaID); err != nil {
+		return errors.New("Failed to delete versions")
+	}
+
+	if _, err := tx.Exec("DELETE FROM nfa_relations WHERE nfa_id = $1 OR related_nfa_id = $1", nfaID); err != nil {
+		return errors.New("Failed to delete relations")
+	}
+
+	// Delete the NFA record itself
+	if _, err := tx.Exec("DELETE FROM nfa WHERE nfa_id = $1", nfaID); err != nil {
+		return errors.New("Failed to delete NFA")
+	}
+	return nil
+}
+
 func GetNFAApprovalList(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Convert nfa_id from string to integer
@@ -466,7 +644,10 @@ func GetNFAApprovalList(db *sql.DB) gin.HandlerFunc {
 }
 func AddApprover(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var newApprover models.NFAApprovalList
+		var newApprover struct {
+			models.NFAApprovalList
+			JoinStage bool `json:"join_stage"` // add as a parallel approver to the stage at order_value
+		}
 
 		// Bind JSON request body
 		if err := c.ShouldBindJSON(&newApprover); err != nil {
@@ -486,9 +667,77 @@ func AddApprover(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
+		if !requireIfMatch(c, tx, newApprover.NFAID) {
+			tx.Rollback()
+			return
+		}
+
+		actorID, ok := checkApprovalListChange(db, c, tx, newApprover.NFAID)
+		if !ok {
+			tx.Rollback()
+			return
+		}
+
+		if newApprover.JoinStage {
+			// Join an existing stage: take over its rule and, if it is already
+			// running, start the new approver's timer straight away
+			var rule string
+			var required int
+			var active bool
+			err = tx.QueryRow(`
+				SELECT MAX(approval_rule), MAX(required_approvals), BOOL_OR(status = 'Pending')
+				FROM nfa_approval_list
+				WHERE nfa_id = $1 AND order_value = $2
+				HAVING COUNT(*) > 0`, newApprover.NFAID, newApprover.Order).Scan(&rule, &required, &active)
+			if err == sql.ErrNoRows {
+				tx.Rollback()
+				c.JSON(http.StatusNotFound, gin.H{"error": "Approval stage not found"})
+				return
+			} else if err != nil {
+				tx.Rollback()
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch approval stage"})
+				return
+			}
+
+			status := "Waiting"
+			if active {
+				status = "Pending"
+			}
+			insertQuery := `INSERT INTO nfa_approval_list (nfa_id, approver_id, order_value, approval_rule, required_approvals, status, comments, started_at) 
+			                VALUES ($1, $2, $3, $4, $5, $6, $7, CASE WHEN $6 = 'Pending' THEN CURRENT_TIMESTAMP END)`
+			_, err = tx.Exec(insertQuery, newApprover.NFAID, newApprover.ApproverID, newApprover.Order, rule, required, status, newApprover.Comments)
+			if err != nil {
+				tx.Rollback()
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to insert new approver"})
+				return
+			}
+
+			if err := checkNFAApprovalMatrix(tx, newApprover.NFAID); err != nil {
+				tx.Rollback()
+				approvalMatrixErrorResponse(c, err)
+				return
+			}
+
+			details := fmt.Sprintf("approver %d added to stage %d", newApprover.ApproverID, newApprover.Order)
+			if err := storage.LogNFAChange(tx, newApprover.NFAID, actorID, "add_approver", details); err != nil {
+				tx.Rollback()
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+
+			if err := tx.Commit(); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+				return
+			}
+			setNFAETag(db, c, newApprover.NFAID)
+
+			c.JSON(http.StatusOK, gin.H{"message": "Approver added to stage successfully"})
+			return
+		}
+
 		// Step 1: Check if there's a "Pending" approver
 		var pendingOrder int
-		err = tx.QueryRow(`SELECT order_value FROM nfa_approval_list WHERE nfa_id = $1 AND status = 'Pending'`, newApprover.NFAID).Scan(&pendingOrder)
+		err = tx.QueryRow(`SELECT order_value FROM nfa_approval_list WHERE nfa_id = $1 AND status = 'Pending' LIMIT 1`, newApprover.NFAID).Scan(&pendingOrder)
 		if err != nil && err != sql.ErrNoRows {
 			tx.Rollback()
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check pending approver"})
@@ -522,18 +771,41 @@ func AddApprover(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
+		if err := checkNFAApprovalMatrix(tx, newApprover.NFAID); err != nil {
+			tx.Rollback()
+			approvalMatrixErrorResponse(c, err)
+			return
+		}
+
+		details := fmt.Sprintf("approver %d inserted at order %d", newApprover.ApproverID, newApprover.Order)
+		if err := storage.LogNFAChange(tx, newApprover.NFAID, actorID, "add_approver", details); err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
 		// Commit transaction
 		if err := tx.Commit(); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
 			return
 		}
+		setNFAETag(db, c, newApprover.NFAID)
 
 		c.JSON(http.StatusOK, gin.H{"message": "Approver added successfully"})
 	}
 }
 
+// ApproveNFA is the older approval endpoint, kept for clients that approve
+// by URL. It approves as the session user through the same path as
+// ApproveOrRejectNFA; approver_id must be the session user or an approver
+// they are standing in for.
 func ApproveNFA(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		userID, ok := getSessionUserID(db, c)
+		if !ok {
+			return
+		}
+
 		nfaID, err := strconv.Atoi(c.Param("nfa_id"))
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid nfa_id"})
@@ -546,73 +818,39 @@ func ApproveNFA(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		// Start transaction
 		tx, err := db.Begin()
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
 			return
 		}
+		defer tx.Rollback()
 
-		// Step 1: Check if the approver is the currently active one (`Pending`)
-		var currentOrder int
-		checkApprover := `SELECT order_value FROM nfa_approval_list 
-		                  WHERE nfa_id = $1 AND approver_id = $2 AND status = 'Pending'`
-		err = tx.QueryRow(checkApprover, nfaID, approverID).Scan(&currentOrder)
-		if err == sql.ErrNoRows {
-			tx.Rollback()
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Approver is not next in line or already approved"})
-			return
-		} else if err != nil {
-			tx.Rollback()
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify approver status"})
-			return
-		}
-
-		// Step 2: Mark the current approver as "Complete"
-		updateCurrent := `UPDATE nfa_approval_list 
-		                  SET status = 'Complete' 
-		                  WHERE nfa_id = $1 AND approver_id = $2`
-		_, err = tx.Exec(updateCurrent, nfaID, approverID)
+		result, err := applyNFAAction(tx, nfaID, userID, "approve", "", 0)
 		if err != nil {
-			tx.Rollback()
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update current approver"})
+			c.JSON(nfaActionStatus(err), gin.H{"error": "Failed to approve NFA", "details": err.Error()})
 			return
 		}
 
-		// Step 3: Find and activate the next approver in order
-		var nextApproverID int
-		findNext := `SELECT approver_id FROM nfa_approval_list 
-		             WHERE nfa_id = $1 AND order_value > $2 AND status = 'Pending' 
-		             ORDER BY order_value ASC LIMIT 1`
-		err = tx.QueryRow(findNext, nfaID, currentOrder).Scan(&nextApproverID)
-
-		if err == sql.ErrNoRows {
-			// No next approver; final approval complete
-			tx.Commit()
-			c.JSON(http.StatusOK, gin.H{"message": "Final approval completed. No more approvers remaining."})
-			return
-		} else if err != nil {
-			tx.Rollback()
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch next approver"})
-			return
+		// The approval just applied must be the one named in the URL
+		actedFor := userID
+		if result.OnBehalfOf != 0 {
+			actedFor = result.OnBehalfOf
 		}
-
-		// Step 4: Activate the next approver (set status to "Pending")
-		updateNext := `UPDATE nfa_approval_list SET status = 'Pending' WHERE nfa_id = $1 AND approver_id = $2`
-		_, err = tx.Exec(updateNext, nfaID, nextApproverID)
-		if err != nil {
-			tx.Rollback()
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to activate next approver"})
+		if result.Role != "approver" || actedFor != approverID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Approver is not next in line or already approved"})
 			return
 		}
 
-		// Commit transaction
 		if err := tx.Commit(); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"message": "Approval completed. Next approver activated."})
+		response := gin.H{"message": "Approval recorded", "nfa_id": nfaID}
+		if result.OnBehalfOf != 0 {
+			response["on_behalf_of"] = result.OnBehalfOf
+		}
+		c.JSON(http.StatusOK, response)
 	}
 }
 
@@ -637,9 +875,27 @@ func RemoveApprover(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
+		if !requireIfMatch(c, tx, nfaID) {
+			tx.Rollback()
+			return
+		}
+
+		actorID, ok := checkApprovalListChange(db, c, tx, nfaID)
+		if !ok {
+			tx.Rollback()
+			return
+		}
+
 		// Step 1: Get the order of the approver to be deleted
 		var deletedOrder int
-		err = tx.QueryRow(`SELECT order_value FROM nfa_approval_list WHERE nfa_id = $1 AND approver_id = $2`, nfaID, approverID).Scan(&deletedOrder)
+		var approverStatus string
+		var active bool
+		err = tx.QueryRow(`
+			SELECT l.order_value, COALESCE(l.status, ''),
+			       l.status = 'Pending' AND l.started_at IS NOT NULL AND n.status = $3
+			FROM nfa_approval_list l JOIN nfa n ON n.nfa_id = l.nfa_id
+			WHERE l.nfa_id = $1 AND l.approver_id = $2`,
+			nfaID, approverID, string(workflow.StateInitiated)).Scan(&deletedOrder, &approverStatus, &active)
 		if err == sql.ErrNoRows {
 			tx.Rollback()
 			c.JSON(http.StatusNotFound, gin.H{"error": "Approver not found"})
@@ -650,6 +906,13 @@ func RemoveApprover(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
+		// A decision already taken stays on the record
+		if approverStatus == "Approved" || approverStatus == "Rejected" || approverStatus == "Complete" {
+			tx.Rollback()
+			c.JSON(http.StatusConflict, gin.H{"error": "Cannot remove an approver who has already acted"})
+			return
+		}
+
 		// Step 2: Delete the approver
 		deleteQuery := `DELETE FROM nfa_approval_list WHERE nfa_id = $1 AND approver_id = $2`
 		_, err = tx.Exec(deleteQuery, nfaID, approverID)
@@ -659,10 +922,35 @@ func RemoveApprover(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		// Step 3: Shift orders for remaining approvers
+		// Step 3: The stage being worked on may now be decided by those who
+		// already approved; it moves on the same way as after an approval
+		if active {
+			stage, err := workflow.LoadStage(tx, nfaID, deletedOrder)
+			if err != nil {
+				tx.Rollback()
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if stage.Failed() {
+				tx.Rollback()
+				c.JSON(http.StatusConflict, gin.H{"error": "Removing this approver would leave the stage unable to reach its required approvals"})
+				return
+			}
+			if stage.Satisfied() {
+				if err := advanceStage(tx, nfaID, deletedOrder, actorID, ""); err != nil {
+					tx.Rollback()
+					c.JSON(nfaActionStatus(err), gin.H{"error": "Failed to advance approval stage", "details": err.Error()})
+					return
+				}
+			}
+		}
+
+		// Step 4: Shift orders for remaining approvers, unless parallel
+		// approvers are still left in the same stage
 		updateQuery := `UPDATE nfa_approval_list 
 		                SET order_value = order_value - 1 
-		                WHERE nfa_id = $1 AND order_value > $2`
+		                WHERE nfa_id = $1 AND order_value > $2
+		                AND NOT EXISTS (SELECT 1 FROM nfa_approval_list WHERE nfa_id = $1 AND order_value = $2)`
 		_, err = tx.Exec(updateQuery, nfaID, deletedOrder)
 		if err != nil {
 			tx.Rollback()
@@ -670,26 +958,18 @@ func RemoveApprover(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		// Step 4: Check if a "Pending" approver exists
-		var pendingExists bool
-		err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM nfa_approval_list WHERE nfa_id = $1 AND status = 'Pending')`, nfaID).Scan(&pendingExists)
-		if err != nil {
+		// The approvers who are left must still satisfy the approval matrix
+		if err := checkNFAApprovalMatrix(tx, nfaID); err != nil {
 			tx.Rollback()
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check pending approver"})
+			approvalMatrixErrorResponse(c, err)
 			return
 		}
 
-		// Step 5: If no "Pending" approver exists, set the next in line to "Pending"
-		if !pendingExists {
-			updateNextQuery := `UPDATE nfa_approval_list 
-			                    SET status = 'Pending' 
-			                    WHERE nfa_id = $1 AND order_value = (SELECT MIN(order_value) FROM nfa_approval_list WHERE nfa_id = $1 AND status = 'Waiting')`
-			_, err = tx.Exec(updateNextQuery, nfaID)
-			if err != nil {
-				tx.Rollback()
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update next approver status"})
-				return
-			}
+		details := fmt.Sprintf("approver %d removed from order %d", approverID, deletedOrder)
+		if err := storage.LogNFAChange(tx, nfaID, actorID, "remove_approver", details); err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
 		}
 
 		// Commit transaction
@@ -697,6 +977,7 @@ func RemoveApprover(db *sql.DB) gin.HandlerFunc {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
 			return
 		}
+		setNFAETag(db, c, nfaID)
 
 		c.JSON(http.StatusOK, gin.H{"message": "Approver removed successfully"})
 	}
@@ -745,7 +1026,9 @@ func GetNFAByInitiator(db *sql.DB) gin.HandlerFunc {
                 COALESCE(p.project_name, '') as project_name,
                 COALESCE(t.tower_name, '') as tower_name,
                 COALESCE(a.area_name, '') as area_name,
-                COALESCE(d.department_name, '') as department_name
+                COALESCE(d.department_name, '') as department_name,
+                n.custom_fields,
+                COALESCE(n.nfa_number, '') as nfa_number
             FROM nfa n
             LEFT JOIN users initiator ON n.initiator_id = initiator.id
             LEFT JOIN users recommender ON n.recommender = recommender.id
@@ -754,10 +1037,12 @@ func GetNFAByInitiator(db *sql.DB) gin.HandlerFunc {
             LEFT JOIN towers t ON n.tower_id = t.tower_id
             LEFT JOIN areas a ON n.area_id = a.area_id
             LEFT JOIN departments d ON n.department_id = d.department_id
-            WHERE n.initiator_id = $1
-            ORDER BY n.nfa_id DESC`
+            WHERE n.initiator_id = $1`
 
-		rows, err := db.Query(query, initiatorID)
+		filters, args := nfaListFilters(c, "n.", []interface{}{initiatorID})
+		query += filters + " ORDER BY n.nfa_id DESC"
+
+		rows, err := db.Query(query, args...)
 		if err != nil {
 			log.Printf("Database query error: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -784,6 +1069,7 @@ func GetNFAByInitiator(db *sql.DB) gin.HandlerFunc {
 
 		for rows.Next() {
 			var nfa NFAWithNames
+			var customFields []byte
 
 			err := rows.Scan(
 				&nfa.NFAID, &nfa.ProjectID, &nfa.TowerID, &nfa.AreaID,
@@ -791,7 +1077,7 @@ func GetNFAByInitiator(db *sql.DB) gin.HandlerFunc {
 				&nfa.Description, &nfa.Reference, &nfa.Recommender,
 				&nfa.LastRecommender, &nfa.InitiatorID, &nfa.InitiatorName,
 				&nfa.RecommenderName, &nfa.LastRecommenderName, &nfa.ProjectName,
-				&nfa.TowerName, &nfa.AreaName, &nfa.DepartmentName,
+				&nfa.TowerName, &nfa.AreaName, &nfa.DepartmentName, &customFields, &nfa.NFANumber,
 			)
 			if err != nil {
 				log.Printf("Row scan error: %v", err)
@@ -801,6 +1087,7 @@ func GetNFAByInitiator(db *sql.DB) gin.HandlerFunc {
 					"scan_error": err.Error()})
 				return
 			}
+			nfa.CustomFields = decodeCustomFields(customFields)
 
 			if err := fetchApprovalsAndFiles(db, &nfa.NFA); err != nil {
 				log.Printf("Approvals and files fetch error: %v", err)
@@ -843,13 +1130,18 @@ func fetchApprovalsAndFiles(db *sql.DB, nfa *models.NFA) error {
             al.nfa_id, 
             al.approver_id, 
             al.order_value,
+            al.approval_rule,
+            al.required_approvals,
             COALESCE(al.status, 'Waiting') as status,
             COALESCE(al.comments, '') as comments,
             COALESCE(u.name, '') as approver_name,
+            COALESCE(al.acted_by, 0) as acted_by,
+            COALESCE(actor.name, '') as acted_by_name,
             al.started_at,
             al.updated_at
         FROM nfa_approval_list al
         LEFT JOIN users u ON al.approver_id = u.id
+        LEFT JOIN users actor ON al.acted_by = actor.id
         WHERE al.nfa_id = $1
         ORDER BY al.order_value`
 
@@ -878,9 +1170,13 @@ func fetchApprovalsAndFiles(db *sql.DB, nfa *models.NFA) error {
 			&approval.NFAID,
 			&approval.ApproverID,
 			&approval.Order,
+			&approval.Rule,
+			&approval.RequiredApprovals,
 			&approval.Status,
 			&approval.Comments,
 			&approval.ApproverName,
+			&approval.ActedBy,
+			&approval.ActedByName,
 			&startedAt,
 			&updatedAt,
 		); err != nil {
@@ -904,8 +1200,10 @@ func fetchApprovalsAndFiles(db *sql.DB, nfa *models.NFA) error {
             id, 
             nfa_id, 
             COALESCE(file_name, '') as file_name, 
-            COALESCE(file_path, '') as file_path 
-        FROM nfa_files 
+            COALESCE(file_path, '') as file_path,
+            COALESCE(file_type, '') as file_type,
+            COALESCE((SELECT scan_status FROM uploaded_files WHERE file_name = nfa_files.file_key), '') as scan_status
+        FROM nfa_files
         WHERE nfa_id = $1`
 
 	fileRows, err := db.Query(filesQuery, nfa.NFAID)
@@ -917,7 +1215,7 @@ func fetchApprovalsAndFiles(db *sql.DB, nfa *models.NFA) error {
 	var files []models.NFAFile
 	for fileRows.Next() {
 		var file models.NFAFile
-		if err := fileRows.Scan(&file.ID, &file.NFAID, &file.Name, &file.Path); err != nil {
+		if err := fileRows.Scan(&file.ID, &file.NFAID, &file.Name, &file.Path, &file.Type, &file.ScanStatus); err != nil {
 			return fmt.Errorf("file scan error: %v", err)
 		}
 		files = append(files, file)
@@ -930,7 +1228,95 @@ func fetchApprovalsAndFiles(db *sql.DB, nfa *models.NFA) error {
 		nfa.Approvals[i].ApproverName = approval.ApproverName
 	}
 
-	return nil
+	return nil
+}
+
+// normalizeApprovalStages validates the approvers that share an order_value
+// and copies each stage's rule onto all of its rows so they are stored
+// consistently.
+func normalizeApprovalStages(list []models.NFAApprovalList) error {
+	type stageInfo struct {
+		rule      string
+		required  int
+		total     int
+		approvers map[int]bool
+	}
+	stages := make(map[int]*stageInfo)
+	var orders []int
+
+	for _, approval := range list {
+		if approval.Order <= 0 {
+			return fmt.Errorf("order_value must be greater than zero for approver %d", approval.ApproverID)
+		}
+		stage, ok := stages[approval.Order]
+		if !ok {
+			stage = &stageInfo{approvers: make(map[int]bool)}
+			stages[approval.Order] = stage
+			orders = append(orders, approval.Order)
+		}
+		if stage.approvers[approval.ApproverID] {
+			return fmt.Errorf("approver %d appears twice in stage %d", approval.ApproverID, approval.Order)
+		}
+		stage.approvers[approval.ApproverID] = true
+		stage.total++
+
+		if approval.Rule != "" {
+			if stage.rule != "" && stage.rule != approval.Rule {
+				return fmt.Errorf("stage %d has conflicting approval rules", approval.Order)
+			}
+			stage.rule = approval.Rule
+		}
+		if approval.RequiredApprovals > stage.required {
+			stage.required = approval.RequiredApprovals
+		}
+	}
+
+	for _, order := range orders {
+		stage := stages[order]
+		if stage.rule == "" {
+			stage.rule = string(workflow.RuleAll)
+		}
+		if err := workflow.ValidateStage(order, stage.rule, stage.required, stage.total); err != nil {
+			return err
+		}
+	}
+
+	for i := range list {
+		stage := stages[list[i].Order]
+		list[i].Rule = stage.rule
+		list[i].RequiredApprovals = stage.required
+	}
+	return nil
+}
+
+// groupApprovalStages groups an ordered approval list into its stages.
+func groupApprovalStages(approvals []models.NFAApprovalList) []models.NFAApprovalStage {
+	var stages []models.NFAApprovalStage
+	for _, approval := range approvals {
+		if len(stages) == 0 || stages[len(stages)-1].Order != approval.Order {
+			stages = append(stages, models.NFAApprovalStage{
+				Order: approval.Order,
+				Rule:  approval.Rule,
+			})
+		}
+		stages[len(stages)-1].Approvals = append(stages[len(stages)-1].Approvals, approval)
+	}
+
+	for i := range stages {
+		rule, err := workflow.ParseRule(stages[i].Rule)
+		if err != nil {
+			rule = workflow.RuleAll
+		}
+		stage := workflow.Stage{Rule: rule, Total: len(stages[i].Approvals)}
+		for _, approval := range stages[i].Approvals {
+			if approval.RequiredApprovals > stage.Required {
+				stage.Required = approval.RequiredApprovals
+			}
+		}
+		stages[i].Rule = string(rule)
+		stages[i].RequiredApprovals = stage.RequiredApprovals()
+	}
+	return stages
 }
 
 func ApproveOrRejectNFA(db *sql.DB) gin.HandlerFunc {
@@ -957,8 +1343,11 @@ func ApproveOrRejectNFA(db *sql.DB) gin.HandlerFunc {
 		// Request structure
 		var request struct {
 			NFAID   int    `json:"nfa_id"`
-			Action  string `json:"action"` // "approve" or "reject"
+			Action  string `json:"action"` // "approve", "reject" or "return"
 			Comment string `json:"comment"`
+			// ReturnTo is the earlier approver a "return" is sent back to; 0
+			// returns the NFA to the initiator
+			ReturnTo int `json:"return_to"`
 		}
 
 		if err := c.ShouldBindJSON(&request); err != nil {
@@ -972,8 +1361,13 @@ func ApproveOrRejectNFA(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		if request.Action != "approve" && request.Action != "reject" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Action must be either 'approve' or 'reject'"})
+		if request.Action != "approve" && request.Action != "reject" && request.Action != "return" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Action must be one of 'approve', 'reject' or 'return'"})
+			return
+		}
+
+		if request.Action == "return" && strings.TrimSpace(request.Comment) == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A comment is required when returning an NFA"})
 			return
 		}
 
@@ -985,73 +1379,19 @@ func ApproveOrRejectNFA(db *sql.DB) gin.HandlerFunc {
 		}
 		defer tx.Rollback()
 
-		// First, check if the NFA exists
-		var nfaExists bool
-		err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM nfa WHERE nfa_id = $1)`, request.NFAID).Scan(&nfaExists)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
-			return
-		}
-		if !nfaExists {
+		result, err := applyNFAAction(tx, request.NFAID, userID, request.Action, request.Comment, request.ReturnTo)
+		if errors.Is(err, errNFANotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "NFA not found"})
 			return
-		}
-
-		// Check if user is a recommender for this NFA
-		var isRecommender bool
-		err = tx.QueryRow(`
-            SELECT EXISTS(
-                SELECT 1 FROM nfa 
-                WHERE nfa_id = $1 
-                AND recommender = $2 
-                AND status = 'Pending'
-            )`, request.NFAID, userID).Scan(&isRecommender)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
-			return
-		}
-
-		// If not recommender, check if user is current approver
-		var isApprover bool
-		var currentOrder int
-		if !isRecommender {
-			err = tx.QueryRow(`
-                SELECT order_value 
-                FROM nfa_approval_list 
-                WHERE nfa_id = $1 
-                AND approver_id = $2 
-                AND started_at IS NOT NULL 
-                AND updated_at IS NULL
-                AND status = 'Pending'`,
-				request.NFAID, userID).Scan(&currentOrder)
-
-			isApprover = err != sql.ErrNoRows
-			if err != nil && err != sql.ErrNoRows {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
-				return
-			}
-		}
-
-		// If neither recommender nor current approver, return error
-		if !isRecommender && !isApprover {
+		} else if errors.Is(err, errNotCurrentActor) {
 			c.JSON(http.StatusForbidden, gin.H{
 				"error":   "Not authorized to perform this action",
 				"details": "You must be either the current recommender or the current approver"})
 			return
-		}
-
-		var actionErr error
-		// In ApproveOrRejectNFA function, update the function call:
-		if isRecommender {
-			actionErr = processRecommenderAction(tx, request.NFAID, request.Action, request.Comment)
-		} else {
-			actionErr = processApproverAction(tx, request.NFAID, currentOrder, request.Action, request.Comment, userID)
-		}
-
-		if actionErr != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
+		} else if err != nil {
+			c.JSON(nfaActionStatus(err), gin.H{
 				"error":   "Failed to process action",
-				"details": actionErr.Error()})
+				"details": err.Error()})
 			return
 		}
 
@@ -1062,66 +1402,191 @@ func ApproveOrRejectNFA(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{
+		response := gin.H{
 			"message": "Action processed successfully",
-			"role":    map[bool]string{true: "recommender", false: "approver"}[isRecommender],
+			"role":    result.Role,
 			"nfa_id":  request.NFAID,
 			"action":  request.Action,
-		})
+		}
+		if result.OnBehalfOf != 0 {
+			response["on_behalf_of"] = result.OnBehalfOf
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+var (
+	// errNFANotFound is returned by applyNFAAction for an unknown NFA.
+	errNFANotFound = errors.New("NFA not found")
+	// errNotCurrentActor is returned by applyNFAAction when the user is
+	// neither the current recommender nor a current approver.
+	errNotCurrentActor = errors.New("you must be either the current recommender or the current approver")
+	// errAlreadyInStage is returned by applyNFAAction when the user already
+	// has a say in the stage, as an approver or as someone's delegate.
+	errAlreadyInStage = errors.New("you already take part in this approval stage and cannot act again in it")
+)
+
+// nfaActionResult describes in which capacity an action was taken.
+type nfaActionResult struct {
+	Role string
+	// OnBehalfOf is the approver a delegate acted for, or 0
+	OnBehalfOf int
+}
+
+// applyNFAAction checks that the user may act on the NFA now and applies an
+// "approve", "reject" or "return" within tx.
+func applyNFAAction(tx *sql.Tx, nfaID, userID int, action, comment string, returnTo int) (nfaActionResult, error) {
+	var result nfaActionResult
+
+	// Lock the NFA first, so approvers of the same stage acting at the same
+	// time are counted one after the other and the last one advances it
+	var locked int
+	err := tx.QueryRow(`SELECT 1 FROM nfa WHERE nfa_id = $1 FOR UPDATE`, nfaID).Scan(&locked)
+	if err == sql.ErrNoRows {
+		return result, errNFANotFound
+	} else if err != nil {
+		return result, fmt.Errorf("failed to check NFA: %v", err)
+	}
+
+	// Check if user is a recommender for this NFA
+	var isRecommender bool
+	err = tx.QueryRow(`
+        SELECT EXISTS(
+            SELECT 1 FROM nfa 
+            WHERE nfa_id = $1 
+            AND recommender = $2 
+            AND status = $3
+        )`, nfaID, userID, string(workflow.StatePending)).Scan(&isRecommender)
+	if err != nil {
+		return result, fmt.Errorf("failed to check recommender: %v", err)
+	}
+
+	// If not recommender, check if user is current approver, either
+	// directly or as the delegate of an approver who is away
+	var currentOrder, assignedApproverID int
+	if !isRecommender {
+		err = tx.QueryRow(`
+            SELECT order_value, approver_id 
+            FROM nfa_approval_list 
+            WHERE nfa_id = $1 
+            AND (approver_id = $2 OR approver_id IN (`+activeDelegators("$2")+`))
+            AND started_at IS NOT NULL 
+            AND updated_at IS NULL
+            AND status = 'Pending'
+            ORDER BY (approver_id = $2) DESC
+            LIMIT 1`,
+			nfaID, userID).Scan(&currentOrder, &assignedApproverID)
+
+		// If neither recommender nor current approver, return error
+		if err == sql.ErrNoRows {
+			return result, errNotCurrentActor
+		} else if err != nil {
+			return result, fmt.Errorf("failed to check approver: %v", err)
+		}
+
+		// One person gets one say per stage, whether on their own row or
+		// standing in for someone else
+		var actedInStage bool
+		err = tx.QueryRow(`
+            SELECT EXISTS(
+                SELECT 1 FROM nfa_approval_list
+                WHERE nfa_id = $1
+                AND order_value = $2
+                AND approver_id <> $3
+                AND (approver_id = $4 OR acted_by = $4)
+            )`, nfaID, currentOrder, assignedApproverID, userID).Scan(&actedInStage)
+		if err != nil {
+			return result, fmt.Errorf("failed to check approver: %v", err)
+		}
+		if actedInStage {
+			return result, errAlreadyInStage
+		}
+	}
+
+	if action == "return" {
+		var fromOrder sql.NullInt64
+		if !isRecommender {
+			fromOrder = sql.NullInt64{Int64: int64(currentOrder), Valid: true}
+		}
+		err = processReturnAction(tx, nfaID, fromOrder, returnTo, comment, userID)
+	} else if isRecommender {
+		err = processRecommenderAction(tx, nfaID, action, comment, userID)
+	} else {
+		err = processApproverAction(tx, nfaID, currentOrder, action, comment, assignedApproverID, userID)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	result.Role = "approver"
+	if isRecommender {
+		result.Role = "recommender"
+	} else if assignedApproverID != userID {
+		result.OnBehalfOf = assignedApproverID
+	}
+	return result, nil
+}
+
+// nfaActionStatus maps an error from applyNFAAction to an HTTP status.
+func nfaActionStatus(err error) int {
+	var transitionErr *workflow.TransitionError
+	switch {
+	case errors.Is(err, errNFANotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errNotCurrentActor):
+		return http.StatusForbidden
+	case errors.Is(err, errAlreadyInStage):
+		return http.StatusConflict
+	case errors.As(err, &transitionErr):
+		return http.StatusConflict
+	case errors.Is(err, errInvalidReturnTarget):
+		return http.StatusBadRequest
 	}
+	return http.StatusInternalServerError
 }
 
-func processRecommenderAction(tx *sql.Tx, nfaID int, action, comment string) error {
+func processRecommenderAction(tx *sql.Tx, nfaID int, action, comment string, userID int) error {
 	if action == "approve" {
 		// First check if there are any approvers
-		var hasApprovers bool
+		var firstOrder sql.NullInt64
 		err := tx.QueryRow(`
-            SELECT EXISTS(
-                SELECT 1 FROM nfa_approval_list 
-                WHERE nfa_id = $1 AND order_value = 1
-            )`, nfaID).Scan(&hasApprovers)
+            SELECT MIN(order_value) FROM nfa_approval_list 
+            WHERE nfa_id = $1`, nfaID).Scan(&firstOrder)
 		if err != nil {
 			return fmt.Errorf("failed to check approvers: %v", err)
 		}
 
-		if !hasApprovers {
+		if !firstOrder.Valid {
 			// If no approvers, mark NFA as completed
-			_, err = tx.Exec(`
-                UPDATE nfa 
-                SET status = 'Completed' 
-                WHERE nfa_id = $1`,
-				nfaID)
-			if err != nil {
-				return fmt.Errorf("failed to update NFA status: %v", err)
+			if err := workflow.NFA.Transition(tx, nfaID, workflow.StateCompleted, userID, comment); err != nil {
+				return err
 			}
 		} else {
 			// First update NFA status
-			_, err = tx.Exec(`
-                UPDATE nfa 
-                SET status = 'Initiated' 
-                WHERE nfa_id = $1`,
-				nfaID)
-			if err != nil {
-				return fmt.Errorf("failed to update NFA status: %v", err)
+			if err := workflow.NFA.Transition(tx, nfaID, workflow.StateInitiated, userID, comment); err != nil {
+				return err
 			}
 
-			// Then update approval list
+			// Then start every approver in the first stage
 			_, err = tx.Exec(`
                 UPDATE nfa_approval_list 
                 SET started_at = CURRENT_TIMESTAMP,
                     status = 'Pending'
-                WHERE nfa_id = $1 AND order_value = 1`,
-				nfaID)
+                WHERE nfa_id = $1 AND order_value = $2`,
+				nfaID, firstOrder.Int64)
 			if err != nil {
 				return fmt.Errorf("failed to update approval status: %v", err)
 			}
 		}
 
 	} else if action == "reject" {
+		if err := workflow.NFA.Transition(tx, nfaID, workflow.StateRejected, userID, comment); err != nil {
+			return err
+		}
+
 		_, err := tx.Exec(`
             UPDATE nfa 
-            SET status = 'Rejected',
-                comments = NULLIF($1, '')
+            SET comments = NULLIF($1, '')
             WHERE nfa_id = $2`,
 			comment, nfaID)
 		if err != nil {
@@ -1131,55 +1596,34 @@ func processRecommenderAction(tx *sql.Tx, nfaID int, action, comment string) err
 	return nil
 }
 
-func processApproverAction(tx *sql.Tx, nfaID int, currentOrder int, action, comment string, userID int) error {
+// processApproverAction applies the action to the row assigned to approverID.
+// userID is who actually acted, which differs from approverID for a delegate.
+func processApproverAction(tx *sql.Tx, nfaID int, currentOrder int, action, comment string, approverID, userID int) error {
 	if action == "approve" {
 		// Update current approver's status
 		_, err := tx.Exec(`
             UPDATE nfa_approval_list 
             SET status = 'Approved',
                 comments = NULLIF($1, ''),
+                acted_by = $5,
                 updated_at = CURRENT_TIMESTAMP 
             WHERE nfa_id = $2 
             AND approver_id = $3 
             AND order_value = $4`,
-			comment, nfaID, userID, currentOrder)
+			comment, nfaID, approverID, currentOrder, userID)
 		if err != nil {
 			return fmt.Errorf("failed to update approval: %v", err)
 		}
 
-		// Check if there's a next approver
-		var nextApproverExists bool
-		err = tx.QueryRow(`
-            SELECT EXISTS(
-                SELECT 1 FROM nfa_approval_list 
-                WHERE nfa_id = $1 AND order_value = $2
-            )`, nfaID, currentOrder+1).Scan(&nextApproverExists)
+		// Parallel approvers share the order_value; wait until the stage rule is met
+		stage, err := workflow.LoadStage(tx, nfaID, currentOrder)
 		if err != nil {
-			return fmt.Errorf("failed to check next approver: %v", err)
+			return err
 		}
-
-		if nextApproverExists {
-			// Start next approver's timer
-			_, err = tx.Exec(`
-                UPDATE nfa_approval_list 
-                SET started_at = CURRENT_TIMESTAMP,
-                    status = 'Pending'
-                WHERE nfa_id = $1 AND order_value = $2`,
-				nfaID, currentOrder+1)
-			if err != nil {
-				return fmt.Errorf("failed to start next approval: %v", err)
-			}
-		} else {
-			// If no next approver, mark NFA as completed
-			_, err = tx.Exec(`
-                UPDATE nfa 
-                SET status = 'Completed' 
-                WHERE nfa_id = $1`,
-				nfaID)
-			if err != nil {
-				return fmt.Errorf("failed to complete NFA: %v", err)
-			}
+		if !stage.Satisfied() {
+			return nil
 		}
+		return advanceStage(tx, nfaID, currentOrder, userID, comment)
 
 	} else if action == "reject" {
 		// Update approval status
@@ -1187,24 +1631,94 @@ func processApproverAction(tx *sql.Tx, nfaID int, currentOrder int, action, comm
             UPDATE nfa_approval_list 
             SET status = 'Rejected',
                 comments = NULLIF($1, ''),
+                acted_by = $5,
                 updated_at = CURRENT_TIMESTAMP 
             WHERE nfa_id = $2 
             AND approver_id = $3 
             AND order_value = $4`,
-			comment, nfaID, userID, currentOrder)
+			comment, nfaID, approverID, currentOrder, userID)
 		if err != nil {
 			return fmt.Errorf("failed to update approval status: %v", err)
 		}
 
-		// Update NFA status
-		_, err = tx.Exec(`
-            UPDATE nfa 
-            SET status = 'Rejected_By_Approver' 
-            WHERE nfa_id = $1`,
-			nfaID)
+		// In an "any N of M" stage a single rejection only ends the NFA once
+		// the remaining approvers can no longer reach N
+		stage, err := workflow.LoadStage(tx, nfaID, currentOrder)
 		if err != nil {
-			return fmt.Errorf("failed to update NFA status: %v", err)
+			return err
+		}
+		if !stage.Failed() {
+			return nil
 		}
+		if err := skipRemainingInStage(tx, nfaID, currentOrder); err != nil {
+			return err
+		}
+
+		// Update NFA status
+		if err := workflow.NFA.Transition(tx, nfaID, workflow.StateRejectedByApprover, userID, comment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// advanceStage closes the satisfied stage at order and moves the NFA on:
+// back to whoever returned it, to the next stage, or to Completed when no
+// stage is left.
+func advanceStage(tx *sql.Tx, nfaID, order, userID int, comment string) error {
+	if err := skipRemainingInStage(tx, nfaID, order); err != nil {
+		return err
+	}
+
+	// An earlier approver answering a return hands the NFA back to the
+	// stage that returned it
+	var status string
+	if err := tx.QueryRow(`SELECT COALESCE(status, '') FROM nfa WHERE nfa_id = $1`, nfaID).Scan(&status); err != nil {
+		return fmt.Errorf("failed to read NFA status: %v", err)
+	}
+	if status == string(workflow.StateReturned) {
+		return resumeReturnedNFA(tx, nfaID, userID, comment)
+	}
+
+	// Check if there's a next stage
+	var nextOrder sql.NullInt64
+	err := tx.QueryRow(`
+        SELECT MIN(order_value) FROM nfa_approval_list 
+        WHERE nfa_id = $1 AND order_value > $2`, nfaID, order).Scan(&nextOrder)
+	if err != nil {
+		return fmt.Errorf("failed to check next approver: %v", err)
+	}
+
+	if !nextOrder.Valid {
+		// If no next approver, mark NFA as completed
+		return workflow.NFA.Transition(tx, nfaID, workflow.StateCompleted, userID, comment)
+	}
+
+	// Start the timer for every approver in the next stage
+	_, err = tx.Exec(`
+        UPDATE nfa_approval_list 
+        SET started_at = CURRENT_TIMESTAMP,
+            status = 'Pending'
+        WHERE nfa_id = $1 AND order_value = $2`,
+		nfaID, nextOrder.Int64)
+	if err != nil {
+		return fmt.Errorf("failed to start next approval: %v", err)
+	}
+	return nil
+}
+
+// skipRemainingInStage closes the rows of a decided stage that never acted.
+func skipRemainingInStage(tx *sql.Tx, nfaID, order int) error {
+	_, err := tx.Exec(`
+        UPDATE nfa_approval_list 
+        SET status = 'Skipped',
+            updated_at = CURRENT_TIMESTAMP 
+        WHERE nfa_id = $1 
+        AND order_value = $2 
+        AND status = 'Pending'`,
+		nfaID, order)
+	if err != nil {
+		return fmt.Errorf("failed to close approval stage: %v", err)
 	}
 	return nil
 }
@@ -1240,11 +1754,21 @@ func CreateNFA(db *sql.DB) gin.HandlerFunc {
 			Subject         string                   `json:"subject"`
 			Description     string                   `json:"description"`
 			Reference       string                   `json:"reference"`
-			Status          string                   `json:"status"`
 			Recommender     int                      `json:"recommender"`
 			LastRecommender int                      `json:"last_recommender"`
+			Amount          models.Money             `json:"amount"`
+			Currency        string                   `json:"currency"`
+			CostCentre      string                   `json:"cost_centre"`
 			ApprovalList    []models.NFAApprovalList `json:"approval_list"`
 			Files           []models.NFAFile         `json:"files"`
+			// UseHierarchy builds the approval list from the department
+			// hierarchy instead of approval_list, up to MaxLevel if set
+			UseHierarchy bool `json:"use_hierarchy"`
+			MaxLevel     int  `json:"max_level"`
+			// TemplateID pre-fills empty fields from a template and checks
+			// the NFA against it
+			TemplateID   int                    `json:"template_id"`
+			CustomFields map[string]interface{} `json:"custom_fields"`
 		}
 
 		// Bind the JSON request
@@ -1252,15 +1776,111 @@ func CreateNFA(db *sql.DB) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
 			return
 		}
+		// A negative amount would fall outside every band of the approval
+		// matrix and skip it
+		if request.Amount < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "amount must not be negative"})
+			return
+		}
+
+		if request.TemplateID != 0 {
+			template, err := fetchTemplate(db, request.TemplateID)
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Template not found"})
+				return
+			} else if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if !template.IsActive {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid NFA for template",
+					"details": fmt.Sprintf("template %q is no longer active", template.Name)})
+				return
+			}
+			attached, err := attachmentTypes(db, request.Files)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+
+			nfa := models.NFA{
+				ProjectID:    request.ProjectID,
+				DepartmentID: request.DepartmentID,
+				Priority:     request.Priority,
+				Subject:      request.Subject,
+				Description:  request.Description,
+				Files:        request.Files,
+			}
+			if err := applyTemplate(template, &nfa, attached); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid NFA for template", "details": err.Error()})
+				return
+			}
+			request.ProjectID = nfa.ProjectID
+			request.DepartmentID = nfa.DepartmentID
+			request.Priority = nfa.Priority
+			request.Description = nfa.Description
+
+			// The template's chain is the default unless the request brings
+			// its own or asks for the hierarchy
+			if len(request.ApprovalList) == 0 && !request.UseHierarchy {
+				request.ApprovalList = append([]models.NFAApprovalList(nil), template.ApprovalList...)
+			}
+		}
+
+		if request.UseHierarchy {
+			chain, err := buildHierarchyChain(db, request.DepartmentID, initiatorID, hierarchyMaxLevel(request.MaxLevel))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if len(chain) == 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "The department hierarchy has no approvers for this NFA"})
+				return
+			}
+			request.ApprovalList = chain
+		}
+
+		if err := checkApprovalMatrix(db, request.DepartmentID, request.ProjectID, request.Amount, approverIDs(request.ApprovalList)); err != nil {
+			approvalMatrixErrorResponse(c, err)
+			return
+		}
+
+		if err := normalizeApprovalStages(request.ApprovalList); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid approval list", "details": err.Error()})
+			return
+		}
+
+		customFields, ok := checkCustomFields(db, c, request.DepartmentID, request.CustomFields, nil)
+		if !ok {
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+			return
+		}
+		defer tx.Rollback()
+
+		// The number is allocated in the same transaction as the insert so
+		// a failed create does not leave a gap in the series
+		nfaNumber, err := storage.AllocateNFANumber(tx, request.DepartmentID, request.ProjectID, time.Now())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
 
 		// Insert NFA details and get NFA ID
 		var nfaID int
 		query := `INSERT INTO nfa 
-            (project_id, tower_id, area_id, department_id, priority, subject, description, reference, recommender, last_recommender, initiator_id, status) 
-            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, 'Pending') RETURNING nfa_id`
+            (project_id, tower_id, area_id, department_id, priority, subject, description, reference, recommender, last_recommender, initiator_id, status,
+             amount, currency, cost_centre, template_id, custom_fields, nfa_number) 
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, NULLIF($14, ''), NULLIF($15, ''), NULLIF($16, 0), $17, $18) RETURNING nfa_id`
 
-		err = db.QueryRow(query, request.ProjectID, request.TowerID, request.AreaID, request.DepartmentID, request.Priority,
-			request.Subject, request.Description, request.Reference, request.Recommender, request.LastRecommender, initiatorID).Scan(&nfaID)
+		err = tx.QueryRow(query, request.ProjectID, request.TowerID, request.AreaID, request.DepartmentID, request.Priority,
+			request.Subject, request.Description, request.Reference, request.Recommender, request.LastRecommender, initiatorID,
+			string(workflow.InitialState), request.Amount, request.Currency, request.CostCentre, request.TemplateID,
+			customFields, nfaNumber).Scan(&nfaID)
 
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -1270,8 +1890,9 @@ func CreateNFA(db *sql.DB) gin.HandlerFunc {
 		// Insert into NFA approval list and store nfa_id
 		for i := range request.ApprovalList {
 			request.ApprovalList[i].NFAID = nfaID
-			approvalQuery := `INSERT INTO nfa_approval_list (nfa_id, approver_id, "order_value") VALUES ($1, $2, $3) RETURNING id`
-			err := db.QueryRow(approvalQuery, request.ApprovalList[i].NFAID, request.ApprovalList[i].ApproverID, request.ApprovalList[i].Order).Scan(&request.ApprovalList[i].ID)
+			approvalQuery := `INSERT INTO nfa_approval_list (nfa_id, approver_id, "order_value", approval_rule, required_approvals) VALUES ($1, $2, $3, $4, $5) RETURNING id`
+			err := tx.QueryRow(approvalQuery, request.ApprovalList[i].NFAID, request.ApprovalList[i].ApproverID, request.ApprovalList[i].Order,
+				request.ApprovalList[i].Rule, request.ApprovalList[i].RequiredApprovals).Scan(&request.ApprovalList[i].ID)
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to insert approval list"})
 				return
@@ -1279,20 +1900,28 @@ func CreateNFA(db *sql.DB) gin.HandlerFunc {
 		}
 
 		// Insert files and store nfa_id
-		for i := range request.Files {
-			request.Files[i].NFAID = nfaID
-			fileQuery := `INSERT INTO nfa_files (nfa_id, file_name, file_path) VALUES ($1, $2, $3) RETURNING id`
-			err := db.QueryRow(fileQuery, request.Files[i].NFAID, request.Files[i].Name, request.Files[i].Path).Scan(&request.Files[i].ID)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to insert file records"})
-				return
-			}
+		if err := insertNFAFiles(db, tx, nfaID, initiatorID, request.Files, nil); err != nil {
+			attachErrorResponse(c, err)
+			return
+		}
+
+		version, err := storage.RecordNFAVersion(tx, nfaID, initiatorID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction", "details": err.Error()})
+			return
 		}
 
 		// Success response
 		c.JSON(http.StatusCreated, gin.H{
 			"message":       "NFA created successfully",
 			"nfa_id":        nfaID,
+			"nfa_number":    nfaNumber,
+			"version":       version,
 			"initiator_id":  initiatorID,
 			"approval_list": request.ApprovalList,
 			"files":         request.Files,
@@ -1351,9 +1980,12 @@ func GetPendingApprovals(db *sql.DB) gin.HandlerFunc {
                 COALESCE(a.area_name, '') as area_name,
                 COALESCE(d.department_name, '') as department_name,
                 al.order_value,
-                al.started_at
+                al.started_at,
+                al.approver_id,
+                COALESCE(assigned.name, '') as assigned_approver_name
             FROM nfa n
             INNER JOIN nfa_approval_list al ON n.nfa_id = al.nfa_id
+            LEFT JOIN users assigned ON al.approver_id = assigned.id
             LEFT JOIN users initiator ON n.initiator_id = initiator.id
             LEFT JOIN users recommender ON n.recommender = recommender.id
             LEFT JOIN users last_recommender ON n.last_recommender = last_recommender.id
@@ -1361,7 +1993,7 @@ func GetPendingApprovals(db *sql.DB) gin.HandlerFunc {
             LEFT JOIN towers t ON n.tower_id = t.tower_id
             LEFT JOIN areas a ON n.area_id = a.area_id
             LEFT JOIN departments d ON n.department_id = d.department_id
-            WHERE al.approver_id = $1
+            WHERE (al.approver_id = $1 OR al.approver_id IN (` + activeDelegators("$1") + `))
             AND al.status = 'Pending'
             AND al.started_at IS NOT NULL
             AND al.updated_at IS NULL
@@ -1390,12 +2022,20 @@ func GetPendingApprovals(db *sql.DB) gin.HandlerFunc {
 			DepartmentName      string    `json:"department_name"`
 			OrderValue          int       `json:"order_value"`
 			StartedAt           time.Time `json:"started_at"`
+			// OnBehalfOf is set when the item reached the user as a delegate
+			OnBehalfOf     int    `json:"on_behalf_of,omitempty"`
+			OnBehalfOfName string `json:"on_behalf_of_name,omitempty"`
+			// Stages groups the approval list so parallel approvers of the
+			// current order_value can be shown together
+			Stages []models.NFAApprovalStage `json:"stages"`
 		}
 
 		var pendingNFAs []NFAWithNames
 
 		for rows.Next() {
 			var nfa NFAWithNames
+			var assignedApproverID int
+			var assignedApproverName string
 
 			err := rows.Scan(
 				&nfa.NFAID,
@@ -1420,6 +2060,8 @@ func GetPendingApprovals(db *sql.DB) gin.HandlerFunc {
 				&nfa.DepartmentName,
 				&nfa.OrderValue,
 				&nfa.StartedAt,
+				&assignedApproverID,
+				&assignedApproverName,
 			)
 			if err != nil {
 				log.Printf("Row scan error: %v", err)
@@ -1439,6 +2081,11 @@ func GetPendingApprovals(db *sql.DB) gin.HandlerFunc {
 					"fetch_error": err.Error()})
 				return
 			}
+			nfa.Stages = groupApprovalStages(nfa.Approvals)
+			if assignedApproverID != userID {
+				nfa.OnBehalfOf = assignedApproverID
+				nfa.OnBehalfOfName = assignedApproverName
+			}
 
 			pendingNFAs = append(pendingNFAs, nfa)
 		}
@@ -1481,6 +2128,23 @@ func GetNFAByID(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
+		// The tag is read before anything else. A change made while the
+		// details are read then leaves the client with a tag that is already
+		// stale, so its next update is refused instead of overwriting data
+		// it has not seen
+		etag, err := fetchNFAETag(db, nfaID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error":   "NFA not found",
+				"details": fmt.Sprintf("No NFA found with ID: %d", nfaID)})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Database error",
+				"details": err.Error()})
+			return
+		}
+
 		// Updated query removing created_at and updated_at
 		query := `
             SELECT 
@@ -1506,11 +2170,25 @@ func GetNFAByID(db *sql.DB) gin.HandlerFunc {
                 COALESCE(p.project_name, '') as project_name,
                 COALESCE(t.tower_name, '') as tower_name,
                 COALESCE(a.area_name, '') as area_name,
-                COALESCE(d.department_name, '') as department_name
+                COALESCE(d.department_name, '') as department_name,
+                COALESCE(n.returned_by, 0) as returned_by,
+                COALESCE(returned_by.name, '') as returned_by_name,
+                COALESCE(n.returned_to, 0) as returned_to,
+                COALESCE(n.comments, '') as comments,
+                COALESCE(n.revision_of, 0) as revision_of,
+                n.revision,
+                n.amount,
+                COALESCE(n.currency, '') as currency,
+                COALESCE(n.cost_centre, '') as cost_centre,
+                COALESCE(n.template_id, 0) as template_id,
+                COALESCE(n.cloned_from, 0) as cloned_from,
+                n.custom_fields,
+                COALESCE(n.nfa_number, '') as nfa_number
             FROM nfa n
             LEFT JOIN users initiator ON n.initiator_id = initiator.id
             LEFT JOIN users recommender ON n.recommender = recommender.id
             LEFT JOIN users last_recommender ON n.last_recommender = last_recommender.id
+            LEFT JOIN users returned_by ON n.returned_by = returned_by.id
             LEFT JOIN projects p ON n.project_id = p.project_id
             LEFT JOIN towers t ON n.tower_id = t.tower_id
             LEFT JOIN areas a ON n.area_id = a.area_id
@@ -1530,9 +2208,21 @@ func GetNFAByID(db *sql.DB) gin.HandlerFunc {
 			TowerName            string `json:"tower_name"`
 			AreaName             string `json:"area_name"`
 			DepartmentName       string `json:"department_name"`
+			Comments             string `json:"comments"`
+			// Set while the NFA is returned for clarification; ReturnedTo is 0
+			// when it is waiting on the initiator
+			ReturnedBy     int    `json:"returned_by,omitempty"`
+			ReturnedByName string `json:"returned_by_name,omitempty"`
+			ReturnedTo     int    `json:"returned_to,omitempty"`
+			RevisionOf     int    `json:"revision_of,omitempty"`
+			Revision       int    `json:"revision"`
+			TemplateID     int    `json:"template_id,omitempty"`
+			ClonedFrom     int    `json:"cloned_from,omitempty"`
+			Locked         bool   `json:"locked"`
 		}
 
 		var nfaDetail NFADetailResponse
+		var customFields []byte
 
 		// Updated scan removing timestamps
 		err = db.QueryRow(query, nfaID).Scan(
@@ -1559,6 +2249,19 @@ func GetNFAByID(db *sql.DB) gin.HandlerFunc {
 			&nfaDetail.TowerName,
 			&nfaDetail.AreaName,
 			&nfaDetail.DepartmentName,
+			&nfaDetail.ReturnedBy,
+			&nfaDetail.ReturnedByName,
+			&nfaDetail.ReturnedTo,
+			&nfaDetail.Comments,
+			&nfaDetail.RevisionOf,
+			&nfaDetail.Revision,
+			&nfaDetail.Amount,
+			&nfaDetail.Currency,
+			&nfaDetail.CostCentre,
+			&nfaDetail.TemplateID,
+			&nfaDetail.ClonedFrom,
+			&customFields,
+			&nfaDetail.NFANumber,
 		)
 
 		// Rest of the code remains the same...
@@ -1575,6 +2278,20 @@ func GetNFAByID(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
+		nfaDetail.CustomFields = decodeCustomFields(customFields)
+
+		// Drafts are private to their initiator
+		if nfaDetail.Status == string(workflow.StateDraft) {
+			var sessionUserID int
+			err := db.QueryRow("SELECT user_id FROM session WHERE session_id = $1", c.GetHeader("Authorization")).Scan(&sessionUserID)
+			if err != nil || sessionUserID != nfaDetail.InitiatorID {
+				c.JSON(http.StatusNotFound, gin.H{
+					"error":   "NFA not found",
+					"details": fmt.Sprintf("No NFA found with ID: %d", nfaID)})
+				return
+			}
+		}
+
 		// Fetch approvals with approver details
 		approvalQuery := `
             SELECT 
@@ -1582,14 +2299,19 @@ func GetNFAByID(db *sql.DB) gin.HandlerFunc {
                 al.nfa_id,
                 al.approver_id,
                 al.order_value,
+                al.approval_rule,
+                al.required_approvals,
                 COALESCE(al.status, '') as status,
                 COALESCE(al.comments, '') as comments,
                 COALESCE(u.name, '') as approver_name,
                 COALESCE(u.email, '') as approver_email,
+                COALESCE(al.acted_by, 0) as acted_by,
+                COALESCE(actor.name, '') as acted_by_name,
                 al.started_at,
                 al.updated_at
             FROM nfa_approval_list al
             LEFT JOIN users u ON al.approver_id = u.id
+            LEFT JOIN users actor ON al.acted_by = actor.id
             WHERE al.nfa_id = $1
             ORDER BY al.order_value`
 
@@ -1609,6 +2331,7 @@ func GetNFAByID(db *sql.DB) gin.HandlerFunc {
 		}
 
 		var approvals []ApprovalDetail
+		var approvalList []models.NFAApprovalList
 
 		for approvalRows.Next() {
 			var approval ApprovalDetail
@@ -1619,10 +2342,14 @@ func GetNFAByID(db *sql.DB) gin.HandlerFunc {
 				&approval.NFAID,
 				&approval.ApproverID,
 				&approval.Order,
+				&approval.Rule,
+				&approval.RequiredApprovals,
 				&approval.Status,
 				&approval.Comments,
 				&approval.ApproverName,
 				&approval.ApproverEmail,
+				&approval.ActedBy,
+				&approval.ActedByName,
 				&startedAt,
 				&completedAt,
 			)
@@ -1641,6 +2368,8 @@ func GetNFAByID(db *sql.DB) gin.HandlerFunc {
 			}
 
 			approvals = append(approvals, approval)
+			approval.NFAApprovalList.ApproverName = approval.ApproverName
+			approvalList = append(approvalList, approval.NFAApprovalList)
 		}
 
 		// Fetch files
@@ -1649,7 +2378,9 @@ func GetNFAByID(db *sql.DB) gin.HandlerFunc {
                 id,
                 nfa_id,
                 COALESCE(file_name, '') as file_name,
-                COALESCE(file_path, '') as file_path
+                COALESCE(file_path, '') as file_path,
+                COALESCE(file_type, '') as file_type,
+                COALESCE((SELECT scan_status FROM uploaded_files WHERE file_name = nfa_files.file_key), '') as scan_status
             FROM nfa_files
             WHERE nfa_id = $1`
 
@@ -1665,7 +2396,7 @@ func GetNFAByID(db *sql.DB) gin.HandlerFunc {
 		var files []models.NFAFile
 		for fileRows.Next() {
 			var file models.NFAFile
-			if err := fileRows.Scan(&file.ID, &file.NFAID, &file.Name, &file.Path); err != nil {
+			if err := fileRows.Scan(&file.ID, &file.NFAID, &file.Name, &file.Path, &file.Type, &file.ScanStatus); err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{
 					"error":   "Data scan failed",
 					"details": fmt.Sprintf("Failed to scan file data: %v", err)})
@@ -1674,10 +2405,77 @@ func GetNFAByID(db *sql.DB) gin.HandlerFunc {
 			files = append(files, file)
 		}
 
-		c.JSON(http.StatusOK, gin.H{
+		lock, err := fetchNFALock(db, nfaID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Database error",
+				"details": err.Error()})
+			return
+		}
+		nfaDetail.Locked = lock.Locked()
+
+		revisions, err := fetchRevisionChain(db, nfaID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Database error",
+				"details": err.Error()})
+			return
+		}
+
+		relations, err := fetchNFARelations(db, nfaID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Database error",
+				"details": err.Error()})
+			return
+		}
+		children, err := fetchChildRollup(db, nfaID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Database error",
+				"details": err.Error()})
+			return
+		}
+		infected, err := fetchInfectedFiles(db, nfaID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Database error",
+				"details": err.Error()})
+			return
+		}
+
+		// The thread is only embedded for those who may read it
+		var comments []models.NFAComment
+		readsThread, err := canReadThread(db, c, nfaID)
+		if err == nil && readsThread {
+			comments, err = fetchCommentThread(db, nfaID)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Database error",
+				"details": err.Error()})
+			return
+		}
+
+		c.Header("ETag", etag)
+
+		response := gin.H{
 			"details":   nfaDetail,
 			"approvals": approvals,
+			"stages":    groupApprovalStages(approvalList),
 			"files":     files,
-		})
+			"revisions": revisions,
+			"relations": relations,
+		}
+		if children != nil {
+			response["children"] = children
+		}
+		if infected != nil {
+			response["infected_files"] = infected
+		}
+		if readsThread {
+			response["comments"] = comments
+		}
+		c.JSON(http.StatusOK, response)
 	}
 }
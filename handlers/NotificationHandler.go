@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"nfa-app/models"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+func GetNotifications(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := getSessionUserID(db, c)
+		if !ok {
+			return
+		}
+
+		query := `SELECT id, user_id, COALESCE(nfa_id, 0), message, is_read, created_at
+			FROM notifications WHERE user_id = $1`
+		if c.Query("unread") == "true" {
+			query += ` AND is_read = FALSE`
+		}
+		query += ` ORDER BY created_at DESC LIMIT 100`
+
+		rows, err := db.Query(query, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		notifications := []models.Notification{}
+		for rows.Next() {
+			var n models.Notification
+			if err := rows.Scan(&n.ID, &n.UserID, &n.NFAID, &n.Message, &n.IsRead, &n.CreatedAt); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			notifications = append(notifications, n)
+		}
+		c.JSON(http.StatusOK, notifications)
+	}
+}
+
+func MarkNotificationRead(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := getSessionUserID(db, c)
+		if !ok {
+			return
+		}
+
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification ID"})
+			return
+		}
+
+		result, err := db.Exec(`UPDATE notifications SET is_read = TRUE WHERE id = $1 AND user_id = $2`, id, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Notification marked as read"})
+	}
+}
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"nfa-app/models"
+	"nfa-app/storage"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// bindNumberingSeries reads and validates a numbering series from the request
+// body. It writes the error response itself.
+func bindNumberingSeries(c *gin.Context) (models.NumberingSeries, bool) {
+	var series models.NumberingSeries
+	if err := c.ShouldBindJSON(&series); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input data"})
+		return series, false
+	}
+	series.Pattern = strings.TrimSpace(series.Pattern)
+	if err := storage.ValidateNumberPattern(series.Pattern); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return series, false
+	}
+	if len(series.Pattern) > 64 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "pattern must be at most 64 characters"})
+		return series, false
+	}
+	series.Example = storage.PreviewNFANumber(series.Pattern, series.DepartmentID, series.ProjectID, time.Now())
+	return series, true
+}
+
+// isUniqueViolation reports whether err is a unique constraint violation.
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
+func CreateNumberingSeries(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := requireAdmin(db, c); !ok {
+			return
+		}
+
+		series, ok := bindNumberingSeries(c)
+		if !ok {
+			return
+		}
+
+		err := db.QueryRow(`
+			INSERT INTO numbering_series (department_id, project_id, pattern)
+			VALUES (NULLIF($1, 0), NULLIF($2, 0), $3) RETURNING id`,
+			series.DepartmentID, series.ProjectID, series.Pattern).Scan(&series.ID)
+		if isUniqueViolation(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "A numbering series already exists for this department and project"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create numbering series: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message": "Numbering series created successfully",
+			"series":  series,
+		})
+	}
+}
+
+func GetNumberingSeries(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rows, err := db.Query(`
+			SELECT id, COALESCE(department_id, 0), COALESCE(project_id, 0), pattern
+			FROM numbering_series
+			ORDER BY department_id NULLS FIRST, project_id NULLS FIRST`)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		now := time.Now()
+		list := []models.NumberingSeries{}
+		for rows.Next() {
+			var series models.NumberingSeries
+			if err := rows.Scan(&series.ID, &series.DepartmentID, &series.ProjectID, &series.Pattern); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			series.Example = storage.PreviewNFANumber(series.Pattern, series.DepartmentID, series.ProjectID, now)
+			list = append(list, series)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"default": storage.DefaultNumberPattern,
+			"series":  list,
+		})
+	}
+}
+
+// UpdateNumberingSeries changes a series' scope or pattern. Numbers already
+// issued keep their value; the new pattern applies to the next NFA.
+func UpdateNumberingSeries(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := requireAdmin(db, c); !ok {
+			return
+		}
+
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid series ID"})
+			return
+		}
+
+		series, ok := bindNumberingSeries(c)
+		if !ok {
+			return
+		}
+		series.ID = id
+
+		result, err := db.Exec(`
+			UPDATE numbering_series
+			SET department_id = NULLIF($1, 0), project_id = NULLIF($2, 0), pattern = $3
+			WHERE id = $4`,
+			series.DepartmentID, series.ProjectID, series.Pattern, id)
+		if isUniqueViolation(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "A numbering series already exists for this department and project"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Numbering series not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Numbering series updated",
+			"series":  series,
+		})
+	}
+}
+
+func DeleteNumberingSeries(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := requireAdmin(db, c); !ok {
+			return
+		}
+
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid series ID"})
+			return
+		}
+
+		result, err := db.Exec(`DELETE FROM numbering_series WHERE id = $1`, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Numbering series not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Numbering series deleted"})
+	}
+}
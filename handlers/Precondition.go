@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"nfa-app/storage"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fetchNFAETag returns the entity tag of an NFA. It combines the row version
+// of the NFA with those of its approval rows, so any change to either, as
+// well as an approver being added or removed, produces a new tag.
+func fetchNFAETag(q storage.Querier, nfaID int) (string, error) {
+	var etag string
+	err := q.QueryRow(`
+		SELECT '"' || n.row_version || '-' || LEFT(MD5(COALESCE((
+			SELECT STRING_AGG(al.id || ':' || al.row_version, ',' ORDER BY al.id)
+			FROM nfa_approval_list al WHERE al.nfa_id = n.nfa_id), '')), 12) || '"'
+		FROM nfa n WHERE n.nfa_id = $1`, nfaID).Scan(&etag)
+	return etag, err
+}
+
+// setNFAETag sets the ETag header to the NFA's current tag. It is called
+// after a successful change so the client can chain further edits.
+func setNFAETag(db *sql.DB, c *gin.Context, nfaID int) {
+	if etag, err := fetchNFAETag(db, nfaID); err == nil {
+		c.Header("ETag", etag)
+	}
+}
+
+// touchNFA gives the NFA a new row version, and so a new ETag, for a change
+// stored outside the nfa and nfa_approval_list rows.
+func touchNFA(tx *sql.Tx, nfaID int) error {
+	if _, err := tx.Exec(`UPDATE nfa SET row_version = row_version WHERE nfa_id = $1`, nfaID); err != nil {
+		return fmt.Errorf("failed to update NFA version: %v", err)
+	}
+	return nil
+}
+
+// requireIfMatch locks the NFA row and checks the request's If-Match header
+// against the NFA's current ETag. A missing header is answered with 428 and a
+// stale one with 412, so a client never overwrites a change it has not seen.
+// When it fails, the error response has already been written.
+func requireIfMatch(c *gin.Context, tx *sql.Tx, nfaID int) bool {
+	var exists int
+	err := tx.QueryRow(`SELECT 1 FROM nfa WHERE nfa_id = $1 FOR UPDATE`, nfaID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "NFA not found"})
+		return false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+
+	ifMatch := strings.TrimSpace(c.GetHeader("If-Match"))
+	if ifMatch == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match header is required; fetch the NFA to get its current ETag"})
+		return false
+	}
+
+	current, err := fetchNFAETag(tx, nfaID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	if ifMatch == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == current {
+			return true
+		}
+	}
+
+	c.Header("ETag", current)
+	c.JSON(http.StatusPreconditionFailed, gin.H{
+		"error": "NFA has been changed by someone else",
+		"etag":  current,
+	})
+	return false
+}
@@ -0,0 +1,386 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"nfa-app/models"
+	"nfa-app/storage"
+	"nfa-app/workflow"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Relation types between NFAs. A relation is stored from nfa_id to
+// related_nfa_id: the first supersedes, is a child of or is related to the
+// second.
+const (
+	relationSupersedes = "supersedes"
+	relationChildOf    = "child_of"
+	relationRelatedTo  = "related_to"
+)
+
+// relationLabels names each type from the side of related_nfa_id.
+var relationLabels = map[string]string{
+	relationSupersedes: "superseded_by",
+	relationChildOf:    "parent_of",
+	relationRelatedTo:  relationRelatedTo,
+}
+
+// errInvalidRelation is returned when a relation would be inconsistent with
+// the ones already recorded.
+var errInvalidRelation = errors.New("invalid relation")
+
+// checkRelation verifies that linking nfaID to relatedID would not create a
+// cycle of supersedes or child_of relations, and that a child keeps a single
+// parent. The relations table must already be locked by tx.
+func checkRelation(tx *sql.Tx, nfaID, relatedID int, relationType string) error {
+	if relationType == relationChildOf {
+		var parentID int
+		err := tx.QueryRow(`SELECT related_nfa_id FROM nfa_relations WHERE nfa_id = $1 AND relation_type = $2`,
+			nfaID, relationChildOf).Scan(&parentID)
+		if err == nil {
+			return fmt.Errorf("%w: NFA %d is already a child of NFA %d", errInvalidRelation, nfaID, parentID)
+		} else if err != sql.ErrNoRows {
+			return fmt.Errorf("failed to check parent: %v", err)
+		}
+	}
+	if relationType == relationRelatedTo {
+		return nil
+	}
+
+	// The new edge closes a cycle if nfaID can already be reached from
+	// relatedID along relations of the same type
+	var cycle bool
+	err := tx.QueryRow(`
+		WITH RECURSIVE reachable AS (
+			SELECT related_nfa_id AS nfa_id FROM nfa_relations WHERE nfa_id = $1 AND relation_type = $3
+			UNION
+			SELECT r.related_nfa_id FROM nfa_relations r
+			JOIN reachable ON r.nfa_id = reachable.nfa_id
+			WHERE r.relation_type = $3
+		)
+		SELECT EXISTS(SELECT 1 FROM reachable WHERE nfa_id = $2)`,
+		relatedID, nfaID, relationType).Scan(&cycle)
+	if err != nil {
+		return fmt.Errorf("failed to check for cycles: %v", err)
+	}
+	if cycle {
+		return fmt.Errorf("%w: NFA %d %s NFA %d would form a cycle", errInvalidRelation, nfaID, relationType, relatedID)
+	}
+	return nil
+}
+
+// fetchNFARelations returns every relation of the NFA in either direction,
+// labelled from its side.
+func fetchNFARelations(db *sql.DB, nfaID int) ([]models.NFARelation, error) {
+	rows, err := db.Query(`
+		SELECT r.id, r.relation_type, r.nfa_id = $1, other.nfa_id, COALESCE(other.nfa_number, ''),
+		       COALESCE(other.subject, ''), COALESCE(other.status, ''), COALESCE(r.created_by, 0), r.created_at
+		FROM nfa_relations r
+		JOIN nfa other ON other.nfa_id = CASE WHEN r.nfa_id = $1 THEN r.related_nfa_id ELSE r.nfa_id END
+		WHERE r.nfa_id = $1 OR r.related_nfa_id = $1
+		ORDER BY r.relation_type, r.id`, nfaID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch relations: %v", err)
+	}
+	defer rows.Close()
+
+	relations := []models.NFARelation{}
+	for rows.Next() {
+		var relation models.NFARelation
+		var outgoing bool
+		if err := rows.Scan(&relation.ID, &relation.Type, &outgoing, &relation.NFAID, &relation.NFANumber,
+			&relation.Subject, &relation.Status, &relation.CreatedBy, &relation.CreatedAt); err != nil {
+			return nil, err
+		}
+		relation.Label = relation.Type
+		if !outgoing {
+			relation.Label = relationLabels[relation.Type]
+		}
+		relations = append(relations, relation)
+	}
+	return relations, rows.Err()
+}
+
+// fetchChildRollup counts the NFA's children by status. It returns nil when
+// the NFA has no children.
+func fetchChildRollup(db *sql.DB, nfaID int) (*models.NFARollup, error) {
+	rows, err := db.Query(`
+		SELECT COALESCE(n.status, ''), COUNT(*)
+		FROM nfa_relations r
+		JOIN nfa n ON n.nfa_id = r.nfa_id
+		WHERE r.related_nfa_id = $1 AND r.relation_type = $2
+		GROUP BY 1`, nfaID, relationChildOf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch child statuses: %v", err)
+	}
+	defer rows.Close()
+
+	rollup := &models.NFARollup{Statuses: map[string]int{}}
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		rollup.Statuses[status] = count
+		rollup.Total += count
+		if state, err := workflow.ParseState(status); err == nil && workflow.NFA.IsFinal(state) {
+			rollup.Done += count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if rollup.Total == 0 {
+		return nil, nil
+	}
+	return rollup, nil
+}
+
+// relationFilters turns the ?child_of=, ?supersedes=, ?superseded_by= and
+// ?related_to=<nfa_id> query parameters into conditions on the NFA ID column,
+// appending their arguments. related_to matches a relation of any type in
+// either direction.
+func relationFilters(c *gin.Context, column string, args []interface{}) (string, []interface{}) {
+	var conditions strings.Builder
+	add := func(param, condition string) {
+		id, err := strconv.Atoi(c.Query(param))
+		if err != nil {
+			return
+		}
+		args = append(args, id)
+		fmt.Fprintf(&conditions, " AND "+condition, column, len(args))
+	}
+	add("child_of", "%s IN (SELECT nfa_id FROM nfa_relations WHERE relation_type = 'child_of' AND related_nfa_id = $%d)")
+	add("supersedes", "%s IN (SELECT nfa_id FROM nfa_relations WHERE relation_type = 'supersedes' AND related_nfa_id = $%d)")
+	add("superseded_by", "%s IN (SELECT related_nfa_id FROM nfa_relations WHERE relation_type = 'supersedes' AND nfa_id = $%[2]d)")
+	add("related_to", `%s IN (SELECT nfa_id FROM nfa_relations WHERE related_nfa_id = $%[2]d
+		UNION SELECT related_nfa_id FROM nfa_relations WHERE nfa_id = $%[2]d)`)
+	return conditions.String(), args
+}
+
+// nfaListFilters combines the custom field and relation filters accepted by
+// the NFA list endpoints. prefix is the table alias of nfa, e.g. "n.".
+func nfaListFilters(c *gin.Context, prefix string, args []interface{}) (string, []interface{}) {
+	customFilters, args := customFieldFilters(c, prefix+"custom_fields", args)
+	relatedFilters, args := relationFilters(c, prefix+"nfa_id", args)
+	return customFilters + relatedFilters, args
+}
+
+// AddNFARelation links the NFA to another one. The caller must be able to
+// see both NFAs.
+func AddNFARelation(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		nfaID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid NFA ID"})
+			return
+		}
+
+		var request struct {
+			RelatedNFAID int    `json:"related_nfa_id"`
+			Type         string `json:"type"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+			return
+		}
+		if _, ok := relationLabels[request.Type]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "type must be one of 'supersedes', 'child_of' or 'related_to'"})
+			return
+		}
+		if request.RelatedNFAID <= 0 || request.RelatedNFAID == nfaID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "related_nfa_id must be another NFA"})
+			return
+		}
+
+		userID, ok := requireParticipant(db, c, nfaID)
+		if !ok {
+			return
+		}
+		if _, ok := requireParticipant(db, c, request.RelatedNFAID); !ok {
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+			return
+		}
+		defer tx.Rollback()
+
+		if !requireIfMatch(c, tx, nfaID) {
+			return
+		}
+
+		// Two relations added at the same time could each pass the cycle
+		// check and close a cycle together
+		if _, err := tx.Exec(`LOCK TABLE nfa_relations IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to lock relations"})
+			return
+		}
+
+		var found int
+		err = tx.QueryRow(`SELECT COUNT(*) FROM nfa WHERE nfa_id IN ($1, $2)`, nfaID, request.RelatedNFAID).Scan(&found)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if found != 2 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "NFA not found"})
+			return
+		}
+
+		from, to := nfaID, request.RelatedNFAID
+		if request.Type == relationRelatedTo && from > to {
+			from, to = to, from
+		}
+
+		if err := checkRelation(tx, from, to, request.Type); errors.Is(err, errInvalidRelation) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		var relationID int
+		err = tx.QueryRow(`
+			INSERT INTO nfa_relations (nfa_id, related_nfa_id, relation_type, created_by)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (nfa_id, related_nfa_id, relation_type) DO NOTHING
+			RETURNING id`, from, to, request.Type, userID).Scan(&relationID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusConflict, gin.H{"error": "NFAs are already related this way"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to add relation: %v", err)})
+			return
+		}
+
+		details := fmt.Sprintf("%s NFA %d", request.Type, request.RelatedNFAID)
+		if err := storage.LogNFAChange(tx, nfaID, userID, "add_relation", details); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := touchNFA(tx, nfaID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction", "details": err.Error()})
+			return
+		}
+		setNFAETag(db, c, nfaID)
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message":        "Relation added",
+			"id":             relationID,
+			"nfa_id":         nfaID,
+			"related_nfa_id": request.RelatedNFAID,
+			"type":           request.Type,
+		})
+	}
+}
+
+// GetNFARelations lists the NFA's relations and, for a parent, the roll-up of
+// its children's statuses.
+func GetNFARelations(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		nfaID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid NFA ID"})
+			return
+		}
+		if _, ok := requireParticipant(db, c, nfaID); !ok {
+			return
+		}
+
+		relations, err := fetchNFARelations(db, nfaID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		rollup, err := fetchChildRollup(db, nfaID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		response := gin.H{"nfa_id": nfaID, "relations": relations}
+		if rollup != nil {
+			response["children"] = rollup
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// DeleteNFARelation removes a relation from either of its NFAs.
+func DeleteNFARelation(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		nfaID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid NFA ID"})
+			return
+		}
+		relationID, err := strconv.Atoi(c.Param("relation_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid relation ID"})
+			return
+		}
+
+		userID, ok := requireParticipant(db, c, nfaID)
+		if !ok {
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+			return
+		}
+		defer tx.Rollback()
+
+		if !requireIfMatch(c, tx, nfaID) {
+			return
+		}
+
+		var relationType string
+		var from, to int
+		err = tx.QueryRow(`
+			DELETE FROM nfa_relations
+			WHERE id = $1 AND (nfa_id = $2 OR related_nfa_id = $2)
+			RETURNING nfa_id, related_nfa_id, relation_type`, relationID, nfaID).Scan(&from, &to, &relationType)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Relation not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete relation"})
+			return
+		}
+
+		details := fmt.Sprintf("NFA %d %s NFA %d", from, relationType, to)
+		if err := storage.LogNFAChange(tx, nfaID, userID, "remove_relation", details); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := touchNFA(tx, nfaID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction", "details": err.Error()})
+			return
+		}
+		setNFAETag(db, c, nfaID)
+
+		c.JSON(http.StatusOK, gin.H{"message": "Relation removed"})
+	}
+}
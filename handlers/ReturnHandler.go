@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"nfa-app/storage"
+	"nfa-app/workflow"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errInvalidReturnTarget is returned when an NFA is sent back to someone who
+// cannot answer it.
+var errInvalidReturnTarget = errors.New("invalid return target")
+
+// processReturnAction sends the NFA back for clarification, either to the
+// initiator (returnTo is 0) or to an approver of an earlier stage. fromOrder is
+// the stage that returned it and is not valid when the recommender did.
+func processReturnAction(tx *sql.Tx, nfaID int, fromOrder sql.NullInt64, returnTo int, comment string, userID int) error {
+	var recipientID int
+	var returnedTo, returnedToOrder sql.NullInt64
+
+	if returnTo == 0 {
+		err := tx.QueryRow(`SELECT COALESCE(initiator_id, 0) FROM nfa WHERE nfa_id = $1`, nfaID).Scan(&recipientID)
+		if err != nil {
+			return fmt.Errorf("failed to fetch initiator: %v", err)
+		}
+	} else {
+		if !fromOrder.Valid {
+			return fmt.Errorf("%w: the recommender can only return an NFA to the initiator", errInvalidReturnTarget)
+		}
+
+		// Only someone who already approved an earlier stage can be asked
+		err := tx.QueryRow(`
+            SELECT MAX(order_value) FROM nfa_approval_list
+            WHERE nfa_id = $1
+            AND approver_id = $2
+            AND order_value < $3
+            AND status = 'Approved'`,
+			nfaID, returnTo, fromOrder.Int64).Scan(&returnedToOrder)
+		if err != nil {
+			return fmt.Errorf("failed to check return target: %v", err)
+		}
+		if !returnedToOrder.Valid {
+			return fmt.Errorf("%w: user %d has not approved an earlier stage of this NFA", errInvalidReturnTarget, returnTo)
+		}
+		recipientID = returnTo
+		returnedTo = sql.NullInt64{Int64: int64(returnTo), Valid: true}
+	}
+
+	if err := workflow.NFA.Transition(tx, nfaID, workflow.StateReturned, userID, comment); err != nil {
+		return err
+	}
+
+	if fromOrder.Valid {
+		// Pause the stage that returned the NFA; it picks up again from the
+		// same approvers once the question is answered
+		_, err := tx.Exec(`
+            UPDATE nfa_approval_list
+            SET status = 'Waiting',
+                started_at = NULL,
+                overdue_at = NULL
+            WHERE nfa_id = $1
+            AND order_value = $2
+            AND status = 'Pending'`,
+			nfaID, fromOrder.Int64)
+		if err != nil {
+			return fmt.Errorf("failed to pause approval stage: %v", err)
+		}
+	}
+
+	if returnedTo.Valid {
+		// Re-open the earlier approver's row so it shows up in their pending list
+		_, err := tx.Exec(`
+            UPDATE nfa_approval_list
+            SET status = 'Pending',
+                started_at = CURRENT_TIMESTAMP,
+                updated_at = NULL,
+                overdue_at = NULL,
+                acted_by = NULL
+            WHERE nfa_id = $1
+            AND approver_id = $2
+            AND order_value = $3`,
+			nfaID, returnTo, returnedToOrder.Int64)
+		if err != nil {
+			return fmt.Errorf("failed to reopen approval: %v", err)
+		}
+	}
+
+	_, err := tx.Exec(`
+        UPDATE nfa
+        SET returned_by = $1,
+            returned_to = $2,
+            returned_order = $3,
+            comments = NULLIF($4, '')
+        WHERE nfa_id = $5`,
+		userID, returnedTo, fromOrder, comment, nfaID)
+	if err != nil {
+		return fmt.Errorf("failed to record return: %v", err)
+	}
+
+	if recipientID != 0 {
+		message := fmt.Sprintf("NFA #%d has been returned to you for clarification: %s", nfaID, comment)
+		if _, err := storage.CreateNotification(tx, recipientID, nfaID, message); err != nil {
+			return fmt.Errorf("failed to notify user %d: %v", recipientID, err)
+		}
+	}
+	return nil
+}
+
+// resumeReturnedNFA hands a returned NFA back to whoever returned it. The
+// approval chain continues from the stage that returned it rather than
+// starting again from the first stage.
+func resumeReturnedNFA(tx *sql.Tx, nfaID, userID int, comment string) error {
+	var returnedBy, returnedOrder sql.NullInt64
+	err := tx.QueryRow(`SELECT returned_by, returned_order FROM nfa WHERE nfa_id = $1`, nfaID).Scan(&returnedBy, &returnedOrder)
+	if err != nil {
+		return fmt.Errorf("failed to fetch return details: %v", err)
+	}
+
+	to := workflow.StatePending
+	if returnedOrder.Valid {
+		to = workflow.StateInitiated
+	}
+	if err := workflow.NFA.Transition(tx, nfaID, to, userID, comment); err != nil {
+		return err
+	}
+
+	if returnedOrder.Valid {
+		_, err = tx.Exec(`
+            UPDATE nfa_approval_list
+            SET started_at = CURRENT_TIMESTAMP,
+                status = 'Pending'
+            WHERE nfa_id = $1
+            AND order_value = $2
+            AND status = 'Waiting'`,
+			nfaID, returnedOrder.Int64)
+		if err != nil {
+			return fmt.Errorf("failed to resume approval stage: %v", err)
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE nfa SET returned_by = NULL, returned_to = NULL, returned_order = NULL WHERE nfa_id = $1`, nfaID)
+	if err != nil {
+		return fmt.Errorf("failed to clear return: %v", err)
+	}
+
+	if returnedBy.Valid {
+		message := fmt.Sprintf("NFA #%d has been resubmitted after your request for clarification.", nfaID)
+		if _, err := storage.CreateNotification(tx, int(returnedBy.Int64), nfaID, message); err != nil {
+			return fmt.Errorf("failed to notify user %d: %v", returnedBy.Int64, err)
+		}
+	}
+	return nil
+}
+
+// ResubmitNFA lets the initiator send an NFA that was returned to them back
+// into the approval chain, after editing it with UpdateNFA if needed.
+func ResubmitNFA(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := getSessionUserID(db, c)
+		if !ok {
+			return
+		}
+
+		nfaID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid NFA ID"})
+			return
+		}
+
+		var request struct {
+			Comment string `json:"comment"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+			return
+		}
+		defer tx.Rollback()
+
+		var initiatorID int
+		var status string
+		var returnedTo sql.NullInt64
+		err = tx.QueryRow(`SELECT COALESCE(initiator_id, 0), COALESCE(status, ''), returned_to FROM nfa WHERE nfa_id = $1 FOR UPDATE`,
+			nfaID).Scan(&initiatorID, &status, &returnedTo)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "NFA not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		if initiatorID != userID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the initiator can resubmit this NFA"})
+			return
+		}
+		if status != string(workflow.StateReturned) || returnedTo.Valid {
+			c.JSON(http.StatusConflict, gin.H{"error": "NFA is not waiting on the initiator"})
+			return
+		}
+		if !requireIfMatch(c, tx, nfaID) {
+			return
+		}
+
+		if err := resumeReturnedNFA(tx, nfaID, userID, request.Comment); err != nil {
+			status := http.StatusInternalServerError
+			var transitionErr *workflow.TransitionError
+			if errors.As(err, &transitionErr) {
+				status = http.StatusConflict
+			}
+			c.JSON(status, gin.H{"error": "Failed to resubmit NFA", "details": err.Error()})
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction", "details": err.Error()})
+			return
+		}
+		setNFAETag(db, c, nfaID)
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "NFA resubmitted successfully",
+			"nfa_id":  nfaID,
+		})
+	}
+}
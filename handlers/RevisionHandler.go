@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"nfa-app/models"
+	"nfa-app/storage"
+	"nfa-app/workflow"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReviseNFA creates a new revision of a rejected NFA. The subject,
+// description, reference, files and approval list are copied and the new
+// revision starts the workflow again; the rejected NFA is left untouched so
+// its rejection comments stay visible in the revision chain.
+func ReviseNFA(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := getSessionUserID(db, c)
+		if !ok {
+			return
+		}
+
+		nfaID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid NFA ID"})
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+			return
+		}
+		defer tx.Rollback()
+
+		var initiatorID, revision, departmentID, projectID int
+		var status string
+		err = tx.QueryRow(`
+			SELECT COALESCE(initiator_id, 0), COALESCE(status, ''), revision, department_id, project_id
+			FROM nfa WHERE nfa_id = $1 FOR UPDATE`, nfaID).Scan(&initiatorID, &status, &revision, &departmentID, &projectID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "NFA not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		if initiatorID != userID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the initiator can revise this NFA"})
+			return
+		}
+		if status != string(workflow.StateRejected) && status != string(workflow.StateRejectedByApprover) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Only a rejected NFA can be revised", "status": status})
+			return
+		}
+
+		// The chain stays linear: a rejected NFA is revised at most once
+		var revisedAs int
+		err = tx.QueryRow(`SELECT nfa_id FROM nfa WHERE revision_of = $1`, nfaID).Scan(&revisedAs)
+		if err == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "NFA has already been revised", "revision_id": revisedAs})
+			return
+		} else if err != sql.ErrNoRows {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		// A revision is a new NFA and gets its own number
+		nfaNumber, err := storage.AllocateNFANumber(tx, departmentID, projectID, time.Now())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		var newID int
+		err = tx.QueryRow(`
+			INSERT INTO nfa
+				(project_id, tower_id, area_id, department_id, priority, subject, description, reference,
+				 recommender, last_recommender, initiator_id, amount, currency, cost_centre, custom_fields, template_id,
+				 status, revision_of, revision, nfa_number)
+			SELECT project_id, tower_id, area_id, department_id, priority, subject, description, reference,
+				recommender, last_recommender, initiator_id, amount, currency, cost_centre, custom_fields, template_id,
+				$1, nfa_id, revision + 1, $3
+			FROM nfa WHERE nfa_id = $2
+			RETURNING nfa_id`,
+			string(workflow.InitialState), nfaID, nfaNumber).Scan(&newID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create revision: %v", err)})
+			return
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO nfa_approval_list (nfa_id, approver_id, order_value, approval_rule, required_approvals)
+			SELECT $1, approver_id, order_value, approval_rule, required_approvals
+			FROM nfa_approval_list WHERE nfa_id = $2
+			ORDER BY order_value, id`, newID, nfaID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to copy approval list"})
+			return
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO nfa_files (nfa_id, file_name, file_path, file_type, file_key)
+			SELECT $1, file_name, file_path, file_type, file_key FROM nfa_files WHERE nfa_id = $2
+			ORDER BY id`, newID, nfaID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to copy files"})
+			return
+		}
+
+		if _, err := storage.RecordNFAVersion(tx, newID, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction", "details": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message":     "NFA revision created successfully",
+			"nfa_id":      newID,
+			"nfa_number":  nfaNumber,
+			"revision_of": nfaID,
+			"revision":    revision + 1,
+		})
+	}
+}
+
+// fetchRevisionChain returns every revision linked to the NFA, from the
+// original to the latest, with the rejection that led to each revision.
+func fetchRevisionChain(db *sql.DB, nfaID int) ([]models.NFARevision, error) {
+	rows, err := db.Query(`
+		WITH RECURSIVE ancestors AS (
+			SELECT nfa_id, revision_of FROM nfa WHERE nfa_id = $1
+			UNION ALL
+			SELECT n.nfa_id, n.revision_of FROM nfa n JOIN ancestors a ON n.nfa_id = a.revision_of
+		),
+		chain AS (
+			SELECT n.nfa_id FROM nfa n JOIN ancestors a ON n.nfa_id = a.nfa_id WHERE a.revision_of IS NULL
+			UNION ALL
+			SELECT n.nfa_id FROM nfa n JOIN chain ch ON n.revision_of = ch.nfa_id
+		)
+		SELECT n.nfa_id, n.revision, COALESCE(n.revision_of, 0), COALESCE(n.status, ''), COALESCE(n.subject, ''),
+		       COALESCE(h.actor_id, 0), COALESCE(u.name, ''), COALESCE(h.comment, n.comments, '')
+		FROM chain ch
+		JOIN nfa n ON n.nfa_id = ch.nfa_id
+		LEFT JOIN LATERAL (
+			SELECT actor_id, comment FROM nfa_status_history
+			WHERE nfa_id = n.nfa_id AND to_status IN ($2, $3)
+			ORDER BY created_at DESC, id DESC
+			LIMIT 1
+		) h ON n.status IN ($2, $3)
+		LEFT JOIN users u ON h.actor_id = u.id
+		ORDER BY n.revision`,
+		nfaID, string(workflow.StateRejected), string(workflow.StateRejectedByApprover))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch revision chain: %v", err)
+	}
+	defer rows.Close()
+
+	revisions := []models.NFARevision{}
+	for rows.Next() {
+		var r models.NFARevision
+		if err := rows.Scan(&r.NFAID, &r.Revision, &r.RevisionOf, &r.Status, &r.Subject,
+			&r.RejectedBy, &r.RejectedByName, &r.RejectionComment); err != nil {
+			return nil, err
+		}
+		if r.Status != string(workflow.StateRejected) && r.Status != string(workflow.StateRejectedByApprover) {
+			r.RejectionComment = ""
+		}
+		revisions = append(revisions, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
@@ -0,0 +1,303 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"nfa-app/models"
+	"nfa-app/storage"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Pending approval rows whose SLA clock is running. Rows are joined to the
+// SLA of their NFA's priority; NFAs without a matching policy never go overdue.
+const slaPendingApprovalsFrom = `
+	FROM nfa_approval_list al
+	JOIN nfa n ON al.nfa_id = n.nfa_id
+	JOIN sla_policies sp ON LOWER(sp.priority) = LOWER(n.priority)
+	WHERE al.status = 'Pending'
+	AND al.started_at IS NOT NULL
+	AND al.updated_at IS NULL`
+
+func UpsertSLAPolicy(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := requireAdmin(db, c); !ok {
+			return
+		}
+
+		var policy models.SLAPolicy
+		if err := c.ShouldBindJSON(&policy); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input data"})
+			return
+		}
+
+		policy.Priority = strings.TrimSpace(policy.Priority)
+		if policy.Priority == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "priority is required"})
+			return
+		}
+		if policy.DueHours <= 0 || policy.EscalateHours <= policy.DueHours {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "due_hours must be positive and escalate_hours must be greater than due_hours"})
+			return
+		}
+
+		_, err := db.Exec(`
+			INSERT INTO sla_policies (priority, due_hours, escalate_hours)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (priority) DO UPDATE
+			SET due_hours = EXCLUDED.due_hours,
+			    escalate_hours = EXCLUDED.escalate_hours,
+			    updated_at = CURRENT_TIMESTAMP`,
+			policy.Priority, policy.DueHours, policy.EscalateHours)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to save SLA policy: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "SLA policy saved successfully",
+			"policy":  policy,
+		})
+	}
+}
+
+func GetSLAPolicies(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rows, err := db.Query(`SELECT priority, due_hours, escalate_hours FROM sla_policies ORDER BY due_hours`)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		policies := []models.SLAPolicy{}
+		for rows.Next() {
+			var policy models.SLAPolicy
+			if err := rows.Scan(&policy.Priority, &policy.DueHours, &policy.EscalateHours); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			policies = append(policies, policy)
+		}
+		c.JSON(http.StatusOK, policies)
+	}
+}
+
+// GetOverdueApprovals lists the approvals of a department that are past their
+// SLA due time.
+func GetOverdueApprovals(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		departmentID, err := strconv.Atoi(c.Param("department_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid department_id"})
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT n.nfa_id, COALESCE(n.subject, ''), COALESCE(n.priority, ''),
+			       al.approver_id, COALESCE(u.name, ''), al.order_value, al.started_at,
+			       al.started_at + make_interval(hours => sp.due_hours) AS due_at,
+			       COALESCE(al.escalated_from, 0), al.escalated_at`+slaPendingApprovalsFrom+`
+			AND n.department_id = $1
+			AND al.started_at + make_interval(hours => sp.due_hours) < CURRENT_TIMESTAMP
+			ORDER BY due_at ASC`, departmentID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		type OverdueApproval struct {
+			NFAID         int        `json:"nfa_id"`
+			Subject       string     `json:"subject"`
+			Priority      string     `json:"priority"`
+			ApproverID    int        `json:"approver_id"`
+			ApproverName  string     `json:"approver_name"`
+			OrderValue    int        `json:"order_value"`
+			StartedAt     time.Time  `json:"started_at"`
+			DueAt         time.Time  `json:"due_at"`
+			OverdueHours  int        `json:"overdue_hours"`
+			EscalatedFrom int        `json:"escalated_from,omitempty"`
+			EscalatedAt   *time.Time `json:"escalated_at,omitempty"`
+		}
+
+		overdue := []OverdueApproval{}
+		for rows.Next() {
+			var item OverdueApproval
+			var escalatedAt sql.NullTime
+			if err := rows.Scan(&item.NFAID, &item.Subject, &item.Priority, &item.ApproverID, &item.ApproverName,
+				&item.OrderValue, &item.StartedAt, &item.DueAt, &item.EscalatedFrom, &escalatedAt); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if escalatedAt.Valid {
+				item.EscalatedAt = &escalatedAt.Time
+			}
+			item.OverdueHours = int(time.Since(item.DueAt).Hours())
+			overdue = append(overdue, item)
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"department_id": departmentID,
+			"overdue":       overdue,
+			"count":         len(overdue),
+		})
+	}
+}
+
+// ProcessApprovalSLAs is run by the scheduler. It flags approvals that have
+// passed their due time and reminds the approver, then escalates approvals
+// past the escalation threshold to the next user in the department hierarchy.
+func ProcessApprovalSLAs(db *sql.DB) error {
+	if err := flagOverdueApprovals(db); err != nil {
+		return err
+	}
+	return escalateOverdueApprovals(db)
+}
+
+func flagOverdueApprovals(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		UPDATE nfa_approval_list
+		SET overdue_at = CURRENT_TIMESTAMP
+		WHERE id IN (
+			SELECT al.id` + slaPendingApprovalsFrom + `
+			AND al.overdue_at IS NULL
+			AND al.started_at + make_interval(hours => sp.due_hours) < CURRENT_TIMESTAMP
+		)
+		RETURNING nfa_id, approver_id`)
+	if err != nil {
+		return fmt.Errorf("failed to flag overdue approvals: %v", err)
+	}
+
+	type reminder struct{ nfaID, approverID int }
+	var reminders []reminder
+	for rows.Next() {
+		var r reminder
+		if err := rows.Scan(&r.nfaID, &r.approverID); err != nil {
+			rows.Close()
+			return err
+		}
+		reminders = append(reminders, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range reminders {
+		message := fmt.Sprintf("Reminder: NFA #%d is waiting for your approval and is past its SLA.", r.nfaID)
+		if _, err := storage.CreateNotification(tx, r.approverID, r.nfaID, message); err != nil {
+			return fmt.Errorf("failed to notify approver %d: %v", r.approverID, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func escalateOverdueApprovals(db *sql.DB) error {
+	// escalated_at later than started_at means an earlier run found nobody to
+	// escalate to; a successful escalation restarts the clock for the new approver
+	rows, err := db.Query(`
+		SELECT al.id, al.nfa_id, al.approver_id, al.order_value, n.department_id` + slaPendingApprovalsFrom + `
+		AND al.overdue_at IS NOT NULL
+		AND (al.escalated_at IS NULL OR al.escalated_at <= al.started_at)
+		AND al.started_at + make_interval(hours => sp.escalate_hours) < CURRENT_TIMESTAMP`)
+	if err != nil {
+		return fmt.Errorf("failed to fetch approvals to escalate: %v", err)
+	}
+
+	type candidate struct{ id, nfaID, approverID, order, departmentID int }
+	var candidates []candidate
+	for rows.Next() {
+		var cand candidate
+		if err := rows.Scan(&cand.id, &cand.nfaID, &cand.approverID, &cand.order, &cand.departmentID); err != nil {
+			rows.Close()
+			return err
+		}
+		candidates = append(candidates, cand)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, cand := range candidates {
+		if err := escalateApproval(db, cand.id, cand.nfaID, cand.approverID, cand.order, cand.departmentID); err != nil {
+			log.Printf("Error escalating approval %d of NFA %d: %v", cand.id, cand.nfaID, err)
+		}
+	}
+	return nil
+}
+
+func escalateApproval(db *sql.DB, approvalID, nfaID, approverID, order, departmentID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Next user above the current approver in the department hierarchy, or
+	// the top of the hierarchy if the approver is not part of it. Users who
+	// already sit in the same stage are skipped.
+	var nextApproverID int
+	err = tx.QueryRow(`
+		SELECT h.user_id FROM hierarchy h
+		WHERE h.department_id = $1
+		AND h.user_id <> $2
+		AND h.order_value > COALESCE(
+			(SELECT MIN(order_value) FROM hierarchy WHERE department_id = $1 AND user_id = $2), 0)
+		AND NOT EXISTS (
+			SELECT 1 FROM nfa_approval_list
+			WHERE nfa_id = $3 AND order_value = $4 AND approver_id = h.user_id)
+		ORDER BY h.order_value ASC
+		LIMIT 1`, departmentID, approverID, nfaID, order).Scan(&nextApproverID)
+	if err == sql.ErrNoRows {
+		log.Printf("No one to escalate approval %d of NFA %d to in department %d", approvalID, nfaID, departmentID)
+		_, err = tx.Exec(`UPDATE nfa_approval_list SET escalated_at = CURRENT_TIMESTAMP WHERE id = $1`, approvalID)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	} else if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`
+		UPDATE nfa_approval_list
+		SET approver_id = $1,
+		    escalated_from = $2,
+		    escalated_at = CURRENT_TIMESTAMP,
+		    started_at = CURRENT_TIMESTAMP,
+		    overdue_at = NULL
+		WHERE id = $3 AND status = 'Pending' AND updated_at IS NULL`,
+		nextApproverID, approverID, approvalID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		// The approver acted while the job was running
+		return nil
+	}
+
+	if _, err := storage.CreateNotification(tx, nextApproverID, nfaID,
+		fmt.Sprintf("NFA #%d has been escalated to you because the previous approver did not act within the SLA.", nfaID)); err != nil {
+		return err
+	}
+	if _, err := storage.CreateNotification(tx, approverID, nfaID,
+		fmt.Sprintf("NFA #%d was escalated to the next approver in the hierarchy after passing its SLA.", nfaID)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"nfa-app/filestore"
+	"nfa-app/models"
+	"nfa-app/scanner"
+	"nfa-app/storage"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Malware scan states of an upload. Pending files are quarantined: they can
+// be attached but not downloaded until the scanner has cleared them. Files
+// the scanner could not give a verdict on stay blocked as failed.
+const (
+	scanPending    = "pending"
+	scanClean      = "clean"
+	scanInfected   = "infected"
+	scanFailed     = "failed"
+	scanNotScanned = "not_scanned"
+)
+
+// maxScanBatch bounds the uploads ScanPendingUploads handles per run.
+const maxScanBatch = 100
+
+// maxScanAttempts is how often a scan is tried before the upload is given up
+// on as failed.
+const maxScanAttempts = 5
+
+// scanRunning keeps scheduled runs of ScanPendingUploads from overlapping when
+// a batch takes longer than the schedule's interval.
+var scanRunning sync.Mutex
+
+// errInfectedFile is returned when a file the scanner flagged is attached.
+var errInfectedFile = errors.New("file is infected")
+
+// initialScanStatus is the state a new upload starts in.
+func initialScanStatus() string {
+	if scanner.Get() == nil {
+		return scanNotScanned
+	}
+	return scanPending
+}
+
+// fileScanStatus returns the scan state of a stored file, or "" for files
+// uploaded before uploads were recorded.
+func fileScanStatus(q storage.Querier, key string) (string, error) {
+	var status string
+	err := q.QueryRow(`SELECT scan_status FROM uploaded_files WHERE file_name = $1`, key).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return status, err
+}
+
+// requireScannedFile blocks downloads of quarantined and infected files. When
+// it fails, the error response has already been written.
+func requireScannedFile(db *sql.DB, c *gin.Context, key string) bool {
+	status, err := fileScanStatus(db, key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check scan status"})
+		return false
+	}
+	switch status {
+	case scanPending:
+		c.JSON(http.StatusConflict, gin.H{"error": "File is waiting for a malware scan; try again shortly"})
+		return false
+	case scanInfected:
+		c.JSON(http.StatusForbidden, gin.H{"error": "File is blocked because malware was found in it"})
+		return false
+	case scanFailed:
+		c.JSON(http.StatusForbidden, gin.H{"error": "File is blocked because it could not be scanned for malware"})
+		return false
+	}
+	return true
+}
+
+// scanUploadsAsync scans freshly uploaded files in the background. Files it
+// does not get to are picked up by ScanPendingUploads.
+func scanUploadsAsync(db *sql.DB, files []models.UploadedFile) {
+	s := scanner.Get()
+	if s == nil {
+		return
+	}
+	go func() {
+		for _, file := range files {
+			if err := scanUpload(context.Background(), db, s, file.FileName); err != nil {
+				log.Printf("Error scanning upload %s: %v", file.FileName, err)
+			}
+		}
+	}()
+}
+
+// ScanPendingUploads is run by the scheduler and scans uploads that are still
+// pending, e.g. because the scanner was unreachable or the server restarted.
+// Without a scanner they stay quarantined. A run that starts while the last
+// one is still going does nothing.
+func ScanPendingUploads(db *sql.DB) error {
+	s := scanner.Get()
+	if s == nil {
+		return nil
+	}
+	if !scanRunning.TryLock() {
+		return nil
+	}
+	defer scanRunning.Unlock()
+
+	rows, err := db.Query(`SELECT file_name FROM uploaded_files WHERE scan_status = $1 ORDER BY id LIMIT $2`,
+		scanPending, maxScanBatch)
+	if err != nil {
+		return fmt.Errorf("failed to fetch pending uploads: %v", err)
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := scanUpload(context.Background(), db, s, key); err != nil {
+			log.Printf("Error scanning upload %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// scanUpload scans a pending upload and records the verdict. When the
+// scanner gives none, the error is kept as the scan result and the file stays
+// pending for another try, or is marked failed once the scanner refuses it or
+// maxScanAttempts is reached.
+func scanUpload(ctx context.Context, db *sql.DB, s scanner.Scanner, key string) error {
+	object, err := filestore.Get().Open(ctx, key)
+	if errors.Is(err, filestore.ErrNotFound) {
+		// Nothing left to serve, so nothing to keep in quarantine
+		_, err := db.Exec(`
+			UPDATE uploaded_files SET scan_status = $2, scan_result = 'file missing from store', scanned_at = CURRENT_TIMESTAMP
+			WHERE file_name = $1 AND scan_status = $3`, key, scanNotScanned, scanPending)
+		return err
+	} else if err != nil {
+		return err
+	}
+	result, err := s.Scan(ctx, object)
+	object.Close()
+	if err != nil {
+		if dbErr := recordScanFailure(db, key, err); dbErr != nil {
+			log.Printf("Error recording scan failure for %s: %v", key, dbErr)
+		}
+		return err
+	}
+
+	status := scanClean
+	if result.Infected {
+		status = scanInfected
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var originalName string
+	err = tx.QueryRow(`
+		UPDATE uploaded_files SET scan_status = $2, scan_result = NULLIF($3, ''), scanned_at = CURRENT_TIMESTAMP
+		WHERE file_name = $1 AND scan_status = $4
+		RETURNING original_name`, key, status, result.Signature, scanPending).Scan(&originalName)
+	if err == sql.ErrNoRows {
+		// Another scan got there first
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to record scan result: %v", err)
+	}
+
+	if result.Infected {
+		log.Printf("Malware found in upload %s: %s", key, result.Signature)
+		if err := flagInfectedFile(db, tx, key, originalName, result.Signature); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// recordScanFailure counts a scan that gave no verdict and gives up on the
+// upload when the failure is final or too many attempts have failed.
+func recordScanFailure(db *sql.DB, key string, scanErr error) error {
+	var attempts int
+	err := db.QueryRow(`
+		UPDATE uploaded_files SET scan_attempts = scan_attempts + 1, scan_result = $2
+		WHERE file_name = $1 AND scan_status = $3
+		RETURNING scan_attempts`, key, scanErr.Error(), scanPending).Scan(&attempts)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !errors.Is(scanErr, scanner.ErrUnscannable) && attempts < maxScanAttempts {
+		return nil
+	}
+
+	log.Printf("Giving up scanning upload %s after %d attempt(s): %v", key, attempts, scanErr)
+	_, err = db.Exec(`
+		UPDATE uploaded_files SET scan_status = $2, scanned_at = CURRENT_TIMESTAMP
+		WHERE file_name = $1 AND scan_status = $3`, key, scanFailed, scanPending)
+	return err
+}
+
+// flagInfectedFile records the finding on every NFA the file belongs to and
+// tells their initiators.
+func flagInfectedFile(db *sql.DB, tx *sql.Tx, key, originalName, signature string) error {
+	nfaIDs, err := fileNFAIDs(db, key)
+	if err != nil {
+		return fmt.Errorf("failed to fetch NFAs of file: %v", err)
+	}
+	for _, nfaID := range nfaIDs {
+		details := fmt.Sprintf("%s was blocked: %s", originalName, signature)
+		if err := storage.LogNFAChange(tx, nfaID, 0, "infected_file", details); err != nil {
+			return err
+		}
+
+		var initiatorID int
+		err := tx.QueryRow(`SELECT COALESCE(initiator_id, 0) FROM nfa WHERE nfa_id = $1`, nfaID).Scan(&initiatorID)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if initiatorID != 0 {
+			message := fmt.Sprintf("Malware was found in the attachment %s on NFA #%d; it has been blocked.", originalName, nfaID)
+			if _, err := storage.CreateNotification(tx, initiatorID, nfaID, message); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fetchInfectedFiles returns the attachments of the NFA and its comments that
+// the scanner flagged.
+func fetchInfectedFiles(db *sql.DB, nfaID int) ([]models.UploadedFile, error) {
+	rows, err := db.Query(`
+		SELECT id, file_name, original_name, size, mime_type, sha256, COALESCE(uploaded_by, 0),
+			scan_status, COALESCE(scan_result, ''), created_at
+		FROM uploaded_files
+		WHERE scan_status = $2 AND file_name IN (
+			SELECT file_key FROM nfa_files WHERE nfa_id = $1
+			UNION
+			SELECT f.file_name FROM nfa_comment_files f JOIN nfa_comments c ON c.id = f.comment_id WHERE c.nfa_id = $1
+		)
+		ORDER BY id`, nfaID, scanInfected)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch infected files: %v", err)
+	}
+	defer rows.Close()
+
+	var files []models.UploadedFile
+	for rows.Next() {
+		var file models.UploadedFile
+		err := rows.Scan(&file.ID, &file.FileName, &file.OriginalName, &file.Size, &file.MimeType, &file.SHA256,
+			&file.UploadedBy, &file.ScanStatus, &file.ScanResult, &file.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
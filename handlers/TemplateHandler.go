@@ -0,0 +1,427 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"nfa-app/models"
+	"nfa-app/storage"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+var (
+	templatePlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+	templateTag         = regexp.MustCompile(`</?\s*([a-zA-Z0-9]+)[^>]*>`)
+)
+
+// templateTags are the tags cleanHTML turns into text for the PDF; anything
+// else in a description skeleton would silently disappear from the document.
+var templateTags = map[string]bool{"p": true, "ul": true, "li": true}
+
+// errTemplate is returned when an NFA does not follow its template.
+var errTemplate = errors.New("invalid NFA for template")
+
+// subjectMatcher turns a subject pattern into an anchored regular expression.
+// Literal text must match exactly and each {placeholder} must be filled in.
+func subjectMatcher(pattern string) *regexp.Regexp {
+	var expr strings.Builder
+	expr.WriteString(`^`)
+	last := 0
+	for _, loc := range templatePlaceholder.FindAllStringIndex(pattern, -1) {
+		expr.WriteString(regexp.QuoteMeta(pattern[last:loc[0]]))
+		expr.WriteString(`\S.*?`)
+		last = loc[1]
+	}
+	expr.WriteString(regexp.QuoteMeta(pattern[last:]))
+	expr.WriteString(`$`)
+	return regexp.MustCompile(expr.String())
+}
+
+func validateTemplate(template *models.NFATemplate) error {
+	template.Name = strings.TrimSpace(template.Name)
+	if template.Name == "" {
+		return errors.New("name is required")
+	}
+	for _, match := range templateTag.FindAllStringSubmatch(template.Description, -1) {
+		if !templateTags[strings.ToLower(match[1])] {
+			return fmt.Errorf("description may only use <p>, <ul> and <li>, found <%s>", match[1])
+		}
+	}
+	if err := normalizeApprovalStages(template.ApprovalList); err != nil {
+		return fmt.Errorf("invalid approval list: %v", err)
+	}
+
+	types := make([]string, 0, len(template.RequiredAttachments))
+	seen := make(map[string]bool)
+	for _, t := range template.RequiredAttachments {
+		t = strings.TrimSpace(t)
+		if t != "" && !seen[t] {
+			seen[t] = true
+			types = append(types, t)
+		}
+	}
+	template.RequiredAttachments = types
+	return nil
+}
+
+// fetchTemplate loads a template with its default approval chain.
+func fetchTemplate(db *sql.DB, templateID int) (*models.NFATemplate, error) {
+	var t models.NFATemplate
+	var attachments pq.StringArray
+	err := db.QueryRow(`
+		SELECT id, name, COALESCE(department_id, 0), COALESCE(project_id, 0), subject_pattern,
+		       description, default_priority, required_attachments, is_active, created_at
+		FROM nfa_templates WHERE id = $1`, templateID).Scan(
+		&t.ID, &t.Name, &t.DepartmentID, &t.ProjectID, &t.SubjectPattern,
+		&t.Description, &t.DefaultPriority, &attachments, &t.IsActive, &t.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	t.RequiredAttachments = []string(attachments)
+	if t.RequiredAttachments == nil {
+		t.RequiredAttachments = []string{}
+	}
+
+	rows, err := db.Query(`
+		SELECT approver_id, order_value, approval_rule, required_approvals
+		FROM nfa_template_approvers WHERE template_id = $1
+		ORDER BY order_value, id`, templateID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch template approvers: %v", err)
+	}
+	defer rows.Close()
+
+	t.ApprovalList = []models.NFAApprovalList{}
+	for rows.Next() {
+		var approval models.NFAApprovalList
+		if err := rows.Scan(&approval.ApproverID, &approval.Order, &approval.Rule, &approval.RequiredApprovals); err != nil {
+			return nil, err
+		}
+		t.ApprovalList = append(t.ApprovalList, approval)
+	}
+	return &t, rows.Err()
+}
+
+func saveTemplateApprovers(tx *sql.Tx, templateID int, list []models.NFAApprovalList) error {
+	if _, err := tx.Exec(`DELETE FROM nfa_template_approvers WHERE template_id = $1`, templateID); err != nil {
+		return fmt.Errorf("failed to clear template approvers: %v", err)
+	}
+	for _, approval := range list {
+		_, err := tx.Exec(`
+			INSERT INTO nfa_template_approvers (template_id, approver_id, order_value, approval_rule, required_approvals)
+			VALUES ($1, $2, $3, $4, $5)`,
+			templateID, approval.ApproverID, approval.Order, approval.Rule, approval.RequiredApprovals)
+		if err != nil {
+			return fmt.Errorf("failed to insert template approvers: %v", err)
+		}
+	}
+	return nil
+}
+
+// attachmentTypes returns what the files can satisfy in a template's required
+// attachments: the MIME type sniffed when each was uploaded and its kind of
+// attachment. Only files in the file store count, and not ones found infected
+// or that could not be scanned; a link or a path with no upload behind it
+// proves nothing about its content.
+func attachmentTypes(q storage.Querier, files []models.NFAFile) (map[string]bool, error) {
+	types := make(map[string]bool)
+	for _, file := range files {
+		key := fileKey(file.Path)
+		if key == "" {
+			continue
+		}
+		var mimeType, status string
+		err := q.QueryRow(`SELECT mime_type, scan_status FROM uploaded_files WHERE file_name = $1`, key).Scan(&mimeType, &status)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to check attachment %s: %v", key, err)
+		}
+		if status == scanInfected || status == scanFailed {
+			continue
+		}
+		types[mimeType] = true
+		if file.Type != "" {
+			types[file.Type] = true
+		}
+	}
+	return types, nil
+}
+
+// applyTemplate fills the department, project, priority and description from
+// the template when the NFA left them empty and checks the subject and
+// attachments. The template must be scoped to the NFA's department and
+// project; attached is what the NFA's files provide, from attachmentTypes.
+func applyTemplate(template *models.NFATemplate, nfa *models.NFA, attached map[string]bool) error {
+	if nfa.DepartmentID == 0 {
+		nfa.DepartmentID = template.DepartmentID
+	}
+	if nfa.ProjectID == 0 {
+		nfa.ProjectID = template.ProjectID
+	}
+	if template.DepartmentID != 0 && nfa.DepartmentID != template.DepartmentID {
+		return fmt.Errorf("template %q is for department %d", template.Name, template.DepartmentID)
+	}
+	if template.ProjectID != 0 && nfa.ProjectID != template.ProjectID {
+		return fmt.Errorf("template %q is for project %d", template.Name, template.ProjectID)
+	}
+
+	if nfa.Priority == "" {
+		nfa.Priority = template.DefaultPriority
+	}
+	if strings.TrimSpace(nfa.Description) == "" {
+		nfa.Description = template.Description
+	}
+
+	if template.SubjectPattern != "" && !subjectMatcher(template.SubjectPattern).MatchString(strings.TrimSpace(nfa.Subject)) {
+		return fmt.Errorf("subject must follow the pattern %q", template.SubjectPattern)
+	}
+
+	var missing []string
+	for _, t := range template.RequiredAttachments {
+		if !attached[t] {
+			missing = append(missing, t)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required attachments: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkNFATemplate runs applyTemplate for an NFA raised from a template, so
+// later edits still follow it. An NFA without a template passes. A template
+// deactivated since the NFA was raised is still applied.
+func checkNFATemplate(db *sql.DB, q storage.Querier, templateID int, nfa *models.NFA) error {
+	if templateID == 0 {
+		return nil
+	}
+	template, err := fetchTemplate(db, templateID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch template: %v", err)
+	}
+	attached, err := attachmentTypes(q, nfa.Files)
+	if err != nil {
+		return err
+	}
+	if err := applyTemplate(template, nfa, attached); err != nil {
+		return fmt.Errorf("%w: %v", errTemplate, err)
+	}
+	return nil
+}
+
+func CreateTemplate(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := requireAdmin(db, c); !ok {
+			return
+		}
+
+		var template models.NFATemplate
+		if err := c.ShouldBindJSON(&template); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input data"})
+			return
+		}
+		if err := validateTemplate(&template); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+			return
+		}
+		defer tx.Rollback()
+
+		err = tx.QueryRow(`
+			INSERT INTO nfa_templates (name, department_id, project_id, subject_pattern, description, default_priority, required_attachments)
+			VALUES ($1, NULLIF($2, 0), NULLIF($3, 0), $4, $5, $6, $7) RETURNING id, is_active, created_at`,
+			template.Name, template.DepartmentID, template.ProjectID, template.SubjectPattern, template.Description,
+			template.DefaultPriority, pq.Array(template.RequiredAttachments)).Scan(&template.ID, &template.IsActive, &template.CreatedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create template: %v", err)})
+			return
+		}
+		if err := saveTemplateApprovers(tx, template.ID, template.ApprovalList); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction", "details": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message":  "Template created successfully",
+			"template": template,
+		})
+	}
+}
+
+// GetTemplates lists the active templates. With department_id or project_id
+// only the templates available to that department or project are returned.
+func GetTemplates(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		departmentID, _ := strconv.Atoi(c.Query("department_id"))
+		projectID, _ := strconv.Atoi(c.Query("project_id"))
+
+		rows, err := db.Query(`
+			SELECT id FROM nfa_templates
+			WHERE is_active
+			AND ($1 = 0 OR department_id IS NULL OR department_id = $1)
+			AND ($2 = 0 OR project_id IS NULL OR project_id = $2)
+			ORDER BY name, id`, departmentID, projectID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		templates := []models.NFATemplate{}
+		for _, id := range ids {
+			template, err := fetchTemplate(db, id)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			templates = append(templates, *template)
+		}
+		c.JSON(http.StatusOK, templates)
+	}
+}
+
+func GetTemplate(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid template ID"})
+			return
+		}
+
+		template, err := fetchTemplate(db, id)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, template)
+	}
+}
+
+func UpdateTemplate(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := requireAdmin(db, c); !ok {
+			return
+		}
+
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid template ID"})
+			return
+		}
+
+		// is_active is left unchanged when the request omits it
+		var request struct {
+			models.NFATemplate
+			IsActive *bool `json:"is_active"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input data"})
+			return
+		}
+		template := request.NFATemplate
+		if err := validateTemplate(&template); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		template.ID = id
+
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+			return
+		}
+		defer tx.Rollback()
+
+		err = tx.QueryRow(`
+			UPDATE nfa_templates
+			SET name = $1, department_id = NULLIF($2, 0), project_id = NULLIF($3, 0), subject_pattern = $4,
+			    description = $5, default_priority = $6, required_attachments = $7, is_active = COALESCE($8, is_active)
+			WHERE id = $9
+			RETURNING is_active, created_at`,
+			template.Name, template.DepartmentID, template.ProjectID, template.SubjectPattern, template.Description,
+			template.DefaultPriority, pq.Array(template.RequiredAttachments), request.IsActive, id).Scan(&template.IsActive, &template.CreatedAt)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := saveTemplateApprovers(tx, id, template.ApprovalList); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction", "details": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":  "Template updated",
+			"template": template,
+		})
+	}
+}
+
+// DeleteTemplate deactivates a template. NFAs raised from it keep their
+// template_id, so the row is not removed.
+func DeleteTemplate(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := requireAdmin(db, c); !ok {
+			return
+		}
+
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid template ID"})
+			return
+		}
+
+		result, err := db.Exec(`UPDATE nfa_templates SET is_active = FALSE WHERE id = $1`, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Template deleted"})
+	}
+}
@@ -1,173 +1,392 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"os"
+	"net/url"
+	"nfa-app/filestore"
+	"nfa-app/models"
 	"path/filepath"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-// Directory where images are stored
-// const imageDir = "/root/nfa_files/"
-const imageDir = "/var/nfa/uploads/"
-
-//const imageDir = "/Users/riteshrai/Documents/GitHub/nfa/images/"
-
-func ServeNFAFile(c *gin.Context) {
-	// Get the file name from the query parameter
-	fileName := c.Query("file") // Use ?file=filename in the URL
-	if fileName == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "file parameter is required"})
-		return
-	}
-
-	// Secure file path to prevent directory traversal attacks
-	cleanFileName := filepath.Clean(fileName)
-	if cleanFileName != fileName || strings.Contains(cleanFileName, "..") {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file path"})
-		return
-	}
+const (
+	// defaultFileURLExpiry is used when a signed URL is requested without
+	// expires_in.
+	defaultFileURLExpiry = 15 * time.Minute
+	maxFileURLExpiry     = 7 * 24 * time.Hour
+)
 
-	// Get absolute image directory path
-	absoluteImageDir, err := filepath.Abs(imageDir)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "server error"})
-		return
-	}
+// ServeNFAFile streams a stored file. Range and conditional requests are
+// answered by http.ServeContent. A request carrying expires and signature
+// from GetFileURL needs no session but must have a valid signature; any
+// other request needs a session user who can see the file. Files waiting for
+// or failing the malware scan are never served.
+func ServeNFAFile(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get the file name from the query parameter
+		fileName := c.Query("file") // Use ?file=filename in the URL
+		if fileName == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "file parameter is required"})
+			return
+		}
+		if !filestore.ValidKey(fileName) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file path"})
+			return
+		}
 
-	// Construct full file path
-	filePath := filepath.Join(absoluteImageDir, cleanFileName)
+		if signature := c.Query("signature"); signature != "" {
+			if err := filestore.Verify(fileName, c.Query("expires"), signature); err != nil {
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+				return
+			}
+		} else if !requireFileAccess(db, c, fileName) {
+			return
+		}
+		if !requireScannedFile(db, c, fileName) {
+			return
+		}
 
-	// Ensure the requested file is within the allowed directory
-	if !strings.HasPrefix(filePath, absoluteImageDir+string(os.PathSeparator)) {
-		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
-		return
+		serveStoredFile(c, fileName)
 	}
+}
 
-	// Check if the file exists and is not a directory
-	info, err := os.Stat(filePath)
-	if os.IsNotExist(err) || info.IsDir() {
-		c.JSON(http.StatusNotFound, gin.H{"error": "file not found", "path": filePath})
+// serveStoredFile writes the object under fileName to the response.
+func serveStoredFile(c *gin.Context, fileName string) {
+	object, err := filestore.Get().Open(c.Request.Context(), fileName)
+	if errors.Is(err, filestore.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
 		return
-	}
-
-	// Open file to detect MIME type
-	file, err := os.Open(filePath)
-	if err != nil {
+	} else if err != nil {
+		log.Printf("Error opening file %s: %v", fileName, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "server error"})
 		return
 	}
-	defer file.Close()
+	defer object.Close()
 
-	// Read part of the file to determine its MIME type
-	buffer := make([]byte, 512)
-	_, err = file.Read(buffer)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "server error"})
-		return
+	// Without a stored type, ServeContent detects it from the name or content
+	info := object.Info()
+	if info.ContentType != "" {
+		c.Writer.Header().Set("Content-Type", info.ContentType)
 	}
+	http.ServeContent(c.Writer, c.Request, filepath.Base(fileName), info.ModTime, object)
+}
 
-	// Detect content type and set response header
-	contentType := http.DetectContentType(buffer)
-	c.Writer.Header().Set("Content-Type", contentType)
+// GetFileURL returns a time-limited URL for a stored file. Stores that can
+// presign hand out a direct URL; otherwise the URL points back at
+// ServeNFAFile with a signature. Only users who can see the file get one.
+func GetFileURL(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		fileName := c.Query("file")
+		if !filestore.ValidKey(fileName) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file path"})
+			return
+		}
+		if !requireFileAccess(db, c, fileName) || !requireScannedFile(db, c, fileName) {
+			return
+		}
 
-	// Serve the file
-	c.File(filePath)
-}
-func UploadFiles(c *gin.Context) {
-	// Get the list of uploaded files
-	file, err := c.MultipartForm()
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Error retrieving the files",
-		})
-		return
-	}
+		expiry := defaultFileURLExpiry
+		if raw := c.Query("expires_in"); raw != "" {
+			seconds, err := strconv.Atoi(raw)
+			if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > maxFileURLExpiry {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in must be between 1 second and 7 days"})
+				return
+			}
+			expiry = time.Duration(seconds) * time.Second
+		}
+		expires := time.Now().Add(expiry)
 
-	files := file.File["file"] // Get files under the key "image"
+		exists, err := filestore.Exists(c.Request.Context(), filestore.Get(), fileName)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "server error"})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+			return
+		}
 
-	if len(files) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "No files uploaded",
-		})
-		return
-	}
+		if presigner, ok := filestore.Get().(filestore.Presigner); ok {
+			signed, err := presigner.PresignGet(fileName, expiry)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"url": signed, "expires_at": expires})
+			return
+		}
 
-	//Validate and ensure the directory exists
-	if err := os.MkdirAll(imageDir, 0755); err != nil {
-		log.Println("Error creating directory:", err) // Log the error to your server logs
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "Unable to create directory",
-			"details": err.Error(), // This will display the error details
-		})
-		return
+		signature, err := filestore.Sign(fileName, expires)
+		if errors.Is(err, filestore.ErrSigningDisabled) {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		query := url.Values{
+			"file":      {fileName},
+			"expires":   {strconv.FormatInt(expires.Unix(), 10)},
+			"signature": {signature},
+		}
+		c.JSON(http.StatusOK, gin.H{"url": "/api/get_file?" + query.Encode(), "expires_at": expires})
 	}
+}
 
-	// Prepare to store the uploaded file info
-	var uploadedFiles []map[string]string
+// rejectedUpload reports a file of a multi-file upload that failed
+// validation.
+type rejectedUpload struct {
+	FileName string `json:"file_name"`
+	Error    string `json:"error"`
+}
 
-	// Process each file
-	for _, file := range files {
-		// Ensure the file name is sanitized
-		filename := filepath.Base(file.Filename)
-		if filename == "" {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": fmt.Sprintf("Invalid file name for %s", file.Filename),
-			})
+// UploadFiles streams every "file" part of a multipart request into the file
+// store without buffering the whole request, and records who uploaded it with
+// its size, type and SHA-256 hash. The upload has no owner until it is
+// attached to an NFA or comment. When a scanner is configured, the files are
+// quarantined until it has cleared them.
+//
+// Each file is checked against the upload policy: its type is sniffed from
+// the content and must be on the allow-list and fit the extension, and it
+// must be within the size limit. With ?nfa_id= the NFA's attachment quota is
+// checked up front as well. Files that fail are listed under "rejected" and
+// the rest are kept. If storing fails, the files already stored by the
+// request are removed again.
+func UploadFiles(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := getSessionUserID(db, c)
+		if !ok {
 			return
 		}
 
-		// Create a unique file name
-		uniqueName := fmt.Sprintf("%d-%s", time.Now().UnixNano(), filename)
-		dstPath := filepath.Join(imageDir, uniqueName)
+		policy := loadUploadPolicy()
+		// quotaLeft is negative when the upload is not for a particular NFA
+		quotaLeft := int64(-1)
+		if raw := c.Query("nfa_id"); raw != "" {
+			nfaID, err := strconv.Atoi(raw)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid NFA ID"})
+				return
+			}
+			if _, ok := requireParticipant(db, c, nfaID); !ok {
+				return
+			}
+			used, err := nfaUploadSize(db, nfaID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check attachment quota"})
+				return
+			}
+			quotaLeft = policy.MaxNFASize - used
+			if quotaLeft < 0 {
+				quotaLeft = 0
+			}
+		}
 
-		// Open the uploaded file (file is a *multipart.FileHeader)
-		src, err := file.Open()
+		reader, err := c.Request.MultipartReader()
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error":   "Unable to open uploaded file",
-				"details": err.Error(),
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Error retrieving the files",
 			})
 			return
 		}
-		defer src.Close()
 
-		// Create the destination file
-		dst, err := os.Create(dstPath)
+		tx, err := db.Begin()
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error":   "Unable to create file",
-				"details": err.Error(),
-			})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
 			return
 		}
-		defer dst.Close()
+		defer tx.Rollback()
+
+		store := filestore.Get()
+		ctx := c.Request.Context()
+
+		// Prepare to store the uploaded file info
+		uploadedFiles := []models.UploadedFile{}
+		rejected := []rejectedUpload{}
+		succeeded := false
+		defer func() {
+			if succeeded {
+				return
+			}
+			// The request's context may already be cancelled
+			for _, uploaded := range uploadedFiles {
+				if err := store.Delete(context.Background(), uploaded.FileName); err != nil {
+					log.Printf("Error removing partial upload %s: %v", uploaded.FileName, err)
+				}
+			}
+		}()
+
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error":   "Error reading the upload",
+					"details": err.Error(),
+				})
+				return
+			}
+			if part.FormName() != "file" || part.FileName() == "" {
+				part.Close()
+				continue
+			}
+			reject := func(message string) {
+				rejected = append(rejected, rejectedUpload{FileName: part.FileName(), Error: message})
+				part.Close()
+			}
+
+			filename := sanitizeFileName(part.FileName())
+			if filename == "" {
+				reject("Invalid file name")
+				continue
+			}
+
+			// The type comes from the content; the client's Content-Type and
+			// the extension are not trusted
+			head := make([]byte, filestore.SniffLen)
+			n, err := io.ReadFull(part, head)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Error reading the upload", "details": err.Error()})
+				return
+			}
+			head = head[:n]
+			if n == 0 {
+				reject("File is empty")
+				continue
+			}
+			mimeType, err := filestore.Sniff(head, filename)
+			if err != nil {
+				reject(err.Error())
+				continue
+			}
+			if !policy.AllowedTypes[mimeType] {
+				reject(fmt.Sprintf("File type %s is not allowed", mimeType))
+				continue
+			}
+			if !filestore.MatchesExtension(mimeType, filename) {
+				reject(fmt.Sprintf("File content (%s) does not match the extension %s", mimeType, filepath.Ext(filename)))
+				continue
+			}
+
+			limit := policy.MaxFileSize
+			if quotaLeft >= 0 && quotaLeft < limit {
+				limit = quotaLeft
+			}
+
+			// Create a unique file name
+			uniqueName := fmt.Sprintf("%d-%s", time.Now().UnixNano(), filename)
+			hash := sha256.New()
+			counter := &byteCounter{}
+			scripts := &filestore.ScriptDetector{}
+			sinks := []io.Writer{hash, counter}
+			if filestore.IsText(mimeType) {
+				sinks = append(sinks, scripts)
+			}
+			body := &sizeLimitReader{r: io.MultiReader(bytes.NewReader(head), part), limit: limit}
+			err = store.Put(ctx, uniqueName, io.TeeReader(body, io.MultiWriter(sinks...)), mimeType)
+			if body.exceeded {
+				if limit < policy.MaxFileSize {
+					reject(fmt.Sprintf("File would take the NFA over its attachment quota of %d MB", policy.MaxNFASize>>20))
+				} else {
+					reject(fmt.Sprintf("File is larger than %d MB", policy.MaxFileSize>>20))
+				}
+				continue
+			}
+			if err != nil {
+				log.Printf("Error storing file %s: %v", uniqueName, err)
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": fmt.Sprintf("Unable to save file %s", part.FileName()),
+				})
+				return
+			}
+			part.Close()
+			if scripts.Found() {
+				if err := store.Delete(ctx, uniqueName); err != nil {
+					log.Printf("Error removing rejected upload %s: %v", uniqueName, err)
+				}
+				reject(fmt.Sprintf("%v: contains script or HTML markup", filestore.ErrDangerousType))
+				continue
+			}
+			if quotaLeft >= 0 {
+				quotaLeft -= counter.n
+			}
+
+			// Appended before the insert so the deferred cleanup also covers a
+			// failed one
+			uploadedFiles = append(uploadedFiles, models.UploadedFile{
+				FileName:     uniqueName,
+				OriginalName: filename,
+				Size:         counter.n,
+				MimeType:     mimeType,
+				SHA256:       hex.EncodeToString(hash.Sum(nil)),
+				UploadedBy:   userID,
+				ScanStatus:   initialScanStatus(),
+			})
+			uploaded := &uploadedFiles[len(uploadedFiles)-1]
+			err = tx.QueryRow(`
+				INSERT INTO uploaded_files (file_name, original_name, size, mime_type, sha256, uploaded_by, scan_status)
+				VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at`,
+				uploaded.FileName, uploaded.OriginalName, uploaded.Size, uploaded.MimeType, uploaded.SHA256,
+				uploaded.UploadedBy, uploaded.ScanStatus).Scan(&uploaded.ID, &uploaded.CreatedAt)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record upload", "details": err.Error()})
+				return
+			}
+		}
 
-		// Copy the file content from src (multipart.File) to the destination file
-		if _, err := io.Copy(dst, src); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": fmt.Sprintf("Unable to save file %s", file.Filename),
+		if len(uploadedFiles) == 0 {
+			if len(rejected) > 0 {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error":    "No files were accepted",
+					"rejected": rejected,
+				})
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "No files uploaded",
 			})
 			return
 		}
 
-		// Generate a unique URL for the uploaded file
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction", "details": err.Error()})
+			return
+		}
+		succeeded = true
+		scanUploadsAsync(db, uploadedFiles)
 
-		// Store the file information in the response
-		uploadedFiles = append(uploadedFiles, map[string]string{
-			"file_name": uniqueName,
+		message := "Files uploaded successfully"
+		if len(rejected) > 0 {
+			message = "Some files were rejected"
+		}
+		// Success response with all uploaded file information
+		c.JSON(http.StatusOK, gin.H{
+			"message":  message,
+			"files":    uploadedFiles,
+			"rejected": rejected,
 		})
 	}
+}
+
+// byteCounter counts the bytes written to it.
+type byteCounter struct {
+	n int64
+}
 
-	// Success response with all uploaded file information
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Files uploaded successfully",
-		"files":   uploadedFiles,
-	})
+func (w *byteCounter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
 }
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"nfa-app/storage"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// defaultMaxUploadMB is used when UPLOAD_MAX_FILE_MB is not set.
+	defaultMaxUploadMB = 25
+	// defaultMaxNFAUploadMB is used when UPLOAD_MAX_NFA_MB is not set.
+	defaultMaxNFAUploadMB = 200
+	// maxFileNameLength bounds stored file names, in bytes.
+	maxFileNameLength = 200
+)
+
+// defaultUploadTypes is used when UPLOAD_ALLOWED_TYPES is not set.
+var defaultUploadTypes = []string{
+	"application/pdf",
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"text/plain",
+	"text/csv",
+	"application/zip",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	"application/msword",
+	"application/vnd.ms-excel",
+	"application/vnd.ms-powerpoint",
+}
+
+// errNFAQuota is returned when attaching files takes an NFA over
+// UPLOAD_MAX_NFA_MB.
+var errNFAQuota = errors.New("NFA attachment quota exceeded")
+
+// uploadPolicy holds the upload limits configured in the environment:
+//
+//	UPLOAD_MAX_FILE_MB     largest single file
+//	UPLOAD_MAX_NFA_MB      total of the files attached to one NFA and its comments
+//	UPLOAD_ALLOWED_TYPES   comma-separated content types, as sniffed from the content
+type uploadPolicy struct {
+	MaxFileSize  int64
+	MaxNFASize   int64
+	AllowedTypes map[string]bool
+}
+
+func loadUploadPolicy() uploadPolicy {
+	policy := uploadPolicy{
+		MaxFileSize:  envMegabytes("UPLOAD_MAX_FILE_MB", defaultMaxUploadMB),
+		MaxNFASize:   envMegabytes("UPLOAD_MAX_NFA_MB", defaultMaxNFAUploadMB),
+		AllowedTypes: map[string]bool{},
+	}
+	types := defaultUploadTypes
+	if configured := os.Getenv("UPLOAD_ALLOWED_TYPES"); configured != "" {
+		types = strings.Split(configured, ",")
+	}
+	for _, contentType := range types {
+		if contentType = strings.ToLower(strings.TrimSpace(contentType)); contentType != "" {
+			policy.AllowedTypes[contentType] = true
+		}
+	}
+	return policy
+}
+
+func envMegabytes(name string, fallback int) int64 {
+	mb, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || mb <= 0 {
+		mb = fallback
+	}
+	return int64(mb) << 20
+}
+
+// sanitizeFileName keeps the base name a client sent without control
+// characters or leading dots, shortened to maxFileNameLength while keeping
+// the extension. It returns "" when nothing usable is left.
+func sanitizeFileName(name string) string {
+	// Browsers on Windows may send a full path
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError || r == '/' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if len(name) > maxFileNameLength {
+		ext := filepath.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		stem := name[:maxFileNameLength-len(ext)]
+		// Do not cut through a multi-byte character
+		for !utf8.ValidString(stem) {
+			stem = stem[:len(stem)-1]
+		}
+		name = stem + ext
+	}
+	return name
+}
+
+// nfaUploadSize returns the total size of the uploads attached to the NFA and
+// its comments. Files uploaded before sizes were recorded do not count.
+func nfaUploadSize(q storage.Querier, nfaID int) (int64, error) {
+	var total int64
+	err := q.QueryRow(`
+		SELECT COALESCE(SUM(size), 0) FROM uploaded_files
+		WHERE file_name IN (
+			SELECT file_key FROM nfa_files WHERE nfa_id = $1
+			UNION
+			SELECT f.file_name FROM nfa_comment_files f JOIN nfa_comments c ON c.id = f.comment_id WHERE c.nfa_id = $1
+		)`, nfaID).Scan(&total)
+	return total, err
+}
+
+// checkNFAQuota fails with errNFAQuota when the NFA's attachments are over
+// UPLOAD_MAX_NFA_MB.
+func checkNFAQuota(q storage.Querier, nfaID int) error {
+	total, err := nfaUploadSize(q, nfaID)
+	if err != nil {
+		return fmt.Errorf("failed to check attachment quota: %v", err)
+	}
+	if limit := loadUploadPolicy().MaxNFASize; total > limit {
+		return fmt.Errorf("%w: attachments total %d MB, the limit is %d MB", errNFAQuota, total>>20, limit>>20)
+	}
+	return nil
+}
+
+// errFileTooLarge is returned by sizeLimitReader once more than the limit has
+// been read.
+var errFileTooLarge = errors.New("file too large")
+
+// sizeLimitReader fails the read that goes past limit bytes, so a store
+// aborts the upload instead of keeping a truncated file.
+type sizeLimitReader struct {
+	r        io.Reader
+	limit    int64
+	read     int64
+	exceeded bool
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		l.exceeded = true
+		return 0, errFileTooLarge
+	}
+	return n, err
+}
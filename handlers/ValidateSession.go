@@ -70,3 +70,69 @@ func getSessionBySessionID(db *sql.DB, sessionID string) (*models.Session, error
 
 	return &session, nil
 }
+
+// getSessionUserID resolves the user behind the Authorization header. When it
+// fails, the error response has already been written and ok is false.
+func getSessionUserID(db *sql.DB, c *gin.Context) (userID int, ok bool) {
+	sessionID := c.GetHeader("Authorization")
+	if sessionID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "session-id header is required"})
+		return 0, false
+	}
+
+	err := db.QueryRow("SELECT user_id FROM session WHERE session_id = $1", sessionID).Scan(&userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid session"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching session: " + err.Error()})
+		}
+		return 0, false
+	}
+	return userID, true
+}
+
+// optionalSessionUserID returns the user behind the Authorization header, or
+// 0 when the request has no valid session.
+func optionalSessionUserID(db *sql.DB, c *gin.Context) (int, error) {
+	var userID int
+	err := db.QueryRow("SELECT user_id FROM session WHERE session_id = $1", c.GetHeader("Authorization")).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return userID, err
+}
+
+// requireAdmin resolves the session user and checks that their role is admin
+// or superadmin. When it fails, the error response has already been written.
+func requireAdmin(db *sql.DB, c *gin.Context) (userID int, ok bool) {
+	userID, ok = getSessionUserID(db, c)
+	if !ok {
+		return 0, false
+	}
+
+	isAdmin, err := isAdminUser(db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check admin role"})
+		return 0, false
+	}
+	if !isAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+		return 0, false
+	}
+	return userID, true
+}
+
+func isAdminUser(db *sql.DB, userID int) (bool, error) {
+	var roleName string
+	err := db.QueryRow(`
+		SELECT r.role_name FROM users u
+		JOIN roles r ON u.role_id = r.role_id
+		WHERE u.id = $1`, userID).Scan(&roleName)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(roleName, "superadmin") || strings.EqualFold(roleName, "admin"), nil
+}
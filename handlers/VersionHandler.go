@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"nfa-app/models"
+	"nfa-app/utils"
+	"nfa-app/workflow"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetNFAVersions lists the saved versions of an NFA, newest first. Snapshots
+// are left out; use the diff endpoint to see what changed.
+func GetNFAVersions(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		nfaID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid NFA ID"})
+			return
+		}
+		if _, ok := requireParticipant(db, c, nfaID); !ok {
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT v.version, COALESCE(v.created_by, 0), COALESCE(u.name, ''), v.created_at
+			FROM nfa_versions v
+			LEFT JOIN users u ON v.created_by = u.id
+			WHERE v.nfa_id = $1
+			ORDER BY v.version DESC`, nfaID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		versions := []models.NFAVersion{}
+		for rows.Next() {
+			var v models.NFAVersion
+			if err := rows.Scan(&v.Version, &v.CreatedBy, &v.CreatedByName, &v.CreatedAt); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			versions = append(versions, v)
+		}
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"nfa_id": nfaID, "versions": versions})
+	}
+}
+
+// DiffNFAVersions compares two versions of an NFA field by field. "to"
+// defaults to the latest version. "from" defaults to the version that was
+// current when the NFA was last returned for clarification, so an approver
+// sees what the initiator changed in response; without a return it is the
+// version before "to".
+func DiffNFAVersions(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		nfaID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid NFA ID"})
+			return
+		}
+		if _, ok := requireParticipant(db, c, nfaID); !ok {
+			return
+		}
+
+		to, err := versionParam(c, "to")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		from, err := versionParam(c, "from")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if to == 0 {
+			err = db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM nfa_versions WHERE nfa_id = $1`, nfaID).Scan(&to)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if to == 0 {
+				c.JSON(http.StatusNotFound, gin.H{"error": "NFA has no saved versions"})
+				return
+			}
+		}
+		if from == 0 {
+			from, err = defaultDiffBase(db, nfaID, to)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		toSnapshot, err := fetchVersionSnapshot(db, nfaID, to)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Version %d not found", to)})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// The first version is compared against an empty NFA
+		fromSnapshot := map[string]interface{}{}
+		if from > 0 {
+			fromSnapshot, err = fetchVersionSnapshot(db, nfaID, from)
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Version %d not found", from)})
+				return
+			} else if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"nfa_id":  nfaID,
+			"from":    from,
+			"to":      to,
+			"changes": diffSnapshots(fromSnapshot, toSnapshot),
+		})
+	}
+}
+
+func versionParam(c *gin.Context, name string) (int, error) {
+	value := c.Query(name)
+	if value == "" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("%s must be a positive version number", name)
+	}
+	return version, nil
+}
+
+// defaultDiffBase picks the version to compare "to" against when the caller
+// did not choose one.
+func defaultDiffBase(db *sql.DB, nfaID, to int) (int, error) {
+	var base int
+	err := db.QueryRow(`
+		SELECT COALESCE(MAX(v.version), 0) FROM nfa_versions v
+		WHERE v.nfa_id = $1 AND v.version < $2
+		AND v.created_at <= (
+			SELECT MAX(created_at) FROM nfa_status_history
+			WHERE nfa_id = $1 AND to_status = $3
+		)`, nfaID, to, string(workflow.StateReturned)).Scan(&base)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find base version: %v", err)
+	}
+	if base == 0 {
+		base = to - 1
+	}
+	return base, nil
+}
+
+func fetchVersionSnapshot(db *sql.DB, nfaID, version int) (map[string]interface{}, error) {
+	var raw []byte
+	err := db.QueryRow(`SELECT snapshot FROM nfa_versions WHERE nfa_id = $1 AND version = $2`,
+		nfaID, version).Scan(&raw)
+	if err != nil {
+		return nil, err
+	}
+
+	// Numbers are kept as written so amounts are not turned into floats
+	snapshot := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&snapshot); err != nil {
+		return nil, fmt.Errorf("failed to read version %d: %v", version, err)
+	}
+	return snapshot, nil
+}
+
+// diffSnapshots returns the fields whose values differ, in name order.
+func diffSnapshots(from, to map[string]interface{}) []models.NFAFieldChange {
+	fields := make([]string, 0, len(to))
+	for field := range to {
+		fields = append(fields, field)
+	}
+	for field := range from {
+		if _, ok := to[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	changes := []models.NFAFieldChange{}
+	for _, field := range fields {
+		if reflect.DeepEqual(from[field], to[field]) {
+			continue
+		}
+		change := models.NFAFieldChange{Field: field, From: from[field], To: to[field]}
+		if field == "description" {
+			before, _ := from[field].(string)
+			after, _ := to[field].(string)
+			change.Segments = utils.DiffHTML(before, after)
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
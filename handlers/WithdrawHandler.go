@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"nfa-app/storage"
+	"nfa-app/workflow"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// WithdrawNFA lets the initiator recall an NFA that is still in flight. Once
+// any approver has approved or rejected it, only an admin can withdraw it, and
+// must give a reason. The NFA, its approvals and its files are kept.
+func WithdrawNFA(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := getSessionUserID(db, c)
+		if !ok {
+			return
+		}
+
+		nfaID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid NFA ID"})
+			return
+		}
+
+		var request struct {
+			Reason string `json:"reason"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+			return
+		}
+		request.Reason = strings.TrimSpace(request.Reason)
+
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+			return
+		}
+		defer tx.Rollback()
+
+		var initiatorID, recommenderID int
+		var status string
+		err = tx.QueryRow(`
+			SELECT COALESCE(initiator_id, 0), COALESCE(recommender, 0), COALESCE(status, '')
+			FROM nfa WHERE nfa_id = $1 FOR UPDATE`, nfaID).Scan(&initiatorID, &recommenderID, &status)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "NFA not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		var approverActed bool
+		err = tx.QueryRow(`
+			SELECT EXISTS(
+				SELECT 1 FROM nfa_approval_list
+				WHERE nfa_id = $1 AND status IN ('Approved', 'Rejected')
+			)`, nfaID).Scan(&approverActed)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		isAdmin, err := isAdminUser(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check admin role"})
+			return
+		}
+
+		switch {
+		case userID == initiatorID && !approverActed:
+		case isAdmin:
+			if approverActed && request.Reason == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "A reason is required to withdraw an NFA an approver has already acted on"})
+				return
+			}
+		case userID == initiatorID:
+			c.JSON(http.StatusForbidden, gin.H{"error": "An approver has already acted on this NFA; ask an admin to withdraw it"})
+			return
+		default:
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the initiator can withdraw this NFA"})
+			return
+		}
+
+		if !requireIfMatch(c, tx, nfaID) {
+			return
+		}
+
+		// Everyone currently expected to act is told the NFA is gone
+		notify := []int{}
+		if status == string(workflow.StatePending) && recommenderID != 0 {
+			notify = append(notify, recommenderID)
+		}
+		rows, err := tx.Query(`SELECT approver_id FROM nfa_approval_list WHERE nfa_id = $1 AND status = 'Pending'`, nfaID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		for rows.Next() {
+			var approverID int
+			if err := rows.Scan(&approverID); err != nil {
+				rows.Close()
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			notify = append(notify, approverID)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := workflow.NFA.Transition(tx, nfaID, workflow.StateWithdrawn, userID, request.Reason); err != nil {
+			status := http.StatusInternalServerError
+			var transitionErr *workflow.TransitionError
+			if errors.As(err, &transitionErr) {
+				status = http.StatusConflict
+			}
+			c.JSON(status, gin.H{"error": "Failed to withdraw NFA", "details": err.Error()})
+			return
+		}
+
+		// Close the approvals that were still open so they leave pending lists
+		// and the SLA job; decided approvals are kept as they are
+		_, err = tx.Exec(`
+			UPDATE nfa_approval_list
+			SET status = 'Withdrawn',
+			    updated_at = CURRENT_TIMESTAMP
+			WHERE nfa_id = $1
+			AND COALESCE(status, 'Waiting') IN ('Pending', 'Waiting')`, nfaID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to close open approvals"})
+			return
+		}
+
+		_, err = tx.Exec(`UPDATE nfa SET comments = NULLIF($1, '') WHERE nfa_id = $2`, request.Reason, nfaID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update NFA"})
+			return
+		}
+
+		message := fmt.Sprintf("NFA #%d has been withdrawn and no longer needs your action.", nfaID)
+		for _, recipientID := range notify {
+			if _, err := storage.CreateNotification(tx, recipientID, nfaID, message); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to notify user %d: %v", recipientID, err)})
+				return
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction", "details": err.Error()})
+			return
+		}
+		setNFAETag(db, c, nfaID)
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":  "NFA withdrawn successfully",
+			"nfa_id":   nfaID,
+			"notified": notify,
+		})
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"nfa-app/filestore"
 	"nfa-app/handlers"
+	"nfa-app/scanner"
 	"nfa-app/storage"
 	"strings"
 
@@ -20,8 +22,9 @@ func CORSConfig() cors.Config {
 	corsConfig.AllowCredentials = true
 	corsConfig.AllowHeaders = []string{
 		"Content-Type", "Content-Length", "Accept-Encoding", "X-XSRF-TOKEN",
-		"Accept", "Origin", "X-Requested-With", "Authorization", "User-Agent",
+		"Accept", "Origin", "X-Requested-With", "Authorization", "User-Agent", "If-Match",
 	}
+	corsConfig.ExposeHeaders = []string{"ETag"}
 	corsConfig.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "HEAD"}
 	return corsConfig
 }
@@ -117,6 +120,18 @@ func main() {
 	db := storage.InitDB()
 	defer db.Close()
 
+	if err := storage.MigrateSchema(db); err != nil {
+		log.Fatal("Failed to migrate database schema:", err)
+	}
+
+	if _, err := filestore.Init(); err != nil {
+		log.Fatal("Failed to set up file store:", err)
+	}
+
+	if _, err := scanner.Init(); err != nil {
+		log.Fatal("Failed to set up malware scanner:", err)
+	}
+
 	// Setup cron job to run cleanup every hour
 	c := cron.New()
 	c.AddFunc("@hourly", func() {
@@ -124,6 +139,24 @@ func main() {
 			log.Printf("Error cleaning up sessions: %v", err)
 		}
 	})
+	// Flag, remind and escalate approvals that have passed their SLA
+	c.AddFunc("@every 15m", func() {
+		if err := handlers.ProcessApprovalSLAs(db); err != nil {
+			log.Printf("Error processing approval SLAs: %v", err)
+		}
+	})
+	// Remove drafts that were never submitted
+	c.AddFunc("@daily", func() {
+		if err := handlers.ExpireDrafts(db); err != nil {
+			log.Printf("Error expiring drafts: %v", err)
+		}
+	})
+	// Scan uploads that are still quarantined
+	c.AddFunc("@every 1m", func() {
+		if err := handlers.ScanPendingUploads(db); err != nil {
+			log.Printf("Error scanning uploads: %v", err)
+		}
+	})
 	c.Start()
 
 	r := gin.Default()
@@ -210,6 +243,16 @@ func main() {
 	{
 		settingRoutes.POST("/create", handlers.CreateSettingHandler(db))
 		settingRoutes.GET("/", handlers.GetSettingHandler(db))
+		settingRoutes.POST("/sla", handlers.UpsertSLAPolicy(db))
+		settingRoutes.GET("/sla", handlers.GetSLAPolicies(db))
+		settingRoutes.POST("/approval_matrix", handlers.CreateApprovalMatrixRule(db))
+		settingRoutes.GET("/approval_matrix", handlers.GetApprovalMatrix(db))
+		settingRoutes.PUT("/approval_matrix/:id", handlers.UpdateApprovalMatrixRule(db))
+		settingRoutes.DELETE("/approval_matrix/:id", handlers.DeleteApprovalMatrixRule(db))
+		settingRoutes.POST("/numbering", handlers.CreateNumberingSeries(db))
+		settingRoutes.GET("/numbering", handlers.GetNumberingSeries(db))
+		settingRoutes.PUT("/numbering/:id", handlers.UpdateNumberingSeries(db))
+		settingRoutes.DELETE("/numbering/:id", handlers.DeleteNumberingSeries(db))
 	}
 
 	hierarchyRoutes := r.Group("/api/hierarchies")
@@ -217,6 +260,7 @@ func main() {
 		hierarchyRoutes.POST("/crreate", handlers.CreateHierarchy(db))
 		hierarchyRoutes.GET("/", handlers.GetHierarchies(db))
 		hierarchyRoutes.GET("/:department_id", handlers.GetHierarchyByDepartmentID(db))
+		hierarchyRoutes.GET("/chain/:department_id", handlers.PreviewHierarchyChain(db))
 		hierarchyRoutes.PUT("/update/:id", handlers.UpdateHierarchy(db))
 		hierarchyRoutes.DELETE("/delete/:id", handlers.DeleteHierarchy(db))
 	}
@@ -232,21 +276,79 @@ func main() {
 		nfaRoutes.GET("/recommender", handlers.GetNFAByRecommender(db))
 		nfaRoutes.GET("/all", handlers.GetAllNFA(db))
 		nfaRoutes.GET("/initiator", handlers.GetNFAByInitiator(db))
+		nfaRoutes.GET("/search", handlers.SearchNFAByNumber(db))
+		nfaRoutes.GET("/overdue/:department_id", handlers.GetOverdueApprovals(db))
 
 		nfaRoutes.POST("/create", handlers.CreateNFA(db))
+		nfaRoutes.POST("/draft", handlers.CreateDraft(db))
+		nfaRoutes.PUT("/draft/:id", handlers.UpdateDraft(db))
+		nfaRoutes.GET("/drafts", handlers.GetDrafts(db))
+		nfaRoutes.POST("/submit/:id", handlers.SubmitDraft(db))
 		nfaRoutes.PUT("/update/:id", handlers.UpdateNFA(db))
+		nfaRoutes.PUT("/resubmit/:id", handlers.ResubmitNFA(db))
+		nfaRoutes.PUT("/withdraw/:id", handlers.WithdrawNFA(db))
+		nfaRoutes.PUT("/unlock/:id", handlers.UnlockNFA(db))
+		nfaRoutes.POST("/revise/:id", handlers.ReviseNFA(db))
+		nfaRoutes.POST("/clone/:id", handlers.CloneNFA(db))
+		nfaRoutes.GET("/relations/:id", handlers.GetNFARelations(db))
+		nfaRoutes.POST("/relations/:id", handlers.AddNFARelation(db))
+		nfaRoutes.DELETE("/relations/:id/:relation_id", handlers.DeleteNFARelation(db))
+		nfaRoutes.GET("/bundle/:id", handlers.DownloadNFABundle(db))
+		nfaRoutes.GET("/versions/:id", handlers.GetNFAVersions(db))
+		nfaRoutes.GET("/versions/:id/diff", handlers.DiffNFAVersions(db))
 		nfaRoutes.DELETE("/delete/:id", handlers.DeleteNFA(db))
 	}
 
+	templateRoutes := r.Group("/api/templates")
+	{
+		templateRoutes.POST("/create", handlers.CreateTemplate(db))
+		templateRoutes.GET("/", handlers.GetTemplates(db))
+		templateRoutes.GET("/:id", handlers.GetTemplate(db))
+		templateRoutes.PUT("/update/:id", handlers.UpdateTemplate(db))
+		templateRoutes.DELETE("/delete/:id", handlers.DeleteTemplate(db))
+	}
+
+	customFieldRoutes := r.Group("/api/custom_fields")
+	{
+		customFieldRoutes.POST("/create", handlers.CreateCustomField(db))
+		customFieldRoutes.GET("/", handlers.GetCustomFields(db))
+		customFieldRoutes.PUT("/update/:id", handlers.UpdateCustomField(db))
+		customFieldRoutes.DELETE("/delete/:id", handlers.DeleteCustomField(db))
+	}
+
+	delegationRoutes := r.Group("/api/delegations")
+	{
+		delegationRoutes.POST("/create", handlers.CreateDelegation(db))
+		delegationRoutes.GET("/", handlers.GetDelegations(db))
+		delegationRoutes.DELETE("/delete/:id", handlers.DeleteDelegation(db))
+	}
+
+	notificationRoutes := r.Group("/api/notifications")
+	{
+		notificationRoutes.GET("/", handlers.GetNotifications(db))
+		notificationRoutes.PUT("/read/:id", handlers.MarkNotificationRead(db))
+	}
+
+	commentRoutes := r.Group("/api/comments")
+	{
+		commentRoutes.POST("/create", handlers.CreateComment(db))
+		commentRoutes.GET("/:nfa_id", handlers.GetComments(db))
+		commentRoutes.PUT("/update/:id", handlers.UpdateComment(db))
+		commentRoutes.DELETE("/delete/:id", handlers.DeleteComment(db))
+		commentRoutes.GET("/history/:id", handlers.GetCommentHistory(db))
+	}
+
 	r.PUT("/api/reject_approve", handlers.ApproveOrRejectNFA(db))
+	r.PUT("/api/reject_approve/bulk", handlers.BulkApproveOrRejectNFA(db))
 	r.GET("/api/pending_approvals", handlers.GetPendingApprovals(db))
 	r.GET("/api/fetch/nfa_data/:nfa_id", handlers.GetNFAApprovalList(db))
 	r.POST("/api/add_approver", handlers.AddApprover(db))
 	r.PUT("/api/approve/:nfa_id/:approver_id", handlers.ApproveNFA(db))
 	r.DELETE("/api/approvers/:nfa_id/:approver_id", handlers.RemoveApprover(db))
 
-	r.POST("/api/upload", handlers.UploadFiles)
-	r.GET("/api/get_file", handlers.ServeNFAFile)
+	r.POST("/api/upload", handlers.UploadFiles(db))
+	r.GET("/api/get_file", handlers.ServeNFAFile(db))
+	r.GET("/api/file_url", handlers.GetFileURL(db))
 
 	// Add PDF generation route
 	r.GET("/api/pdf/generate/:nfa_id", handlers.GenerateNFAPDF(db))
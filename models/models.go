@@ -1,6 +1,8 @@
 package models
 
 import (
+	"encoding/json"
+	"nfa-app/utils"
 	"time"
 
 	_ "github.com/lib/pq"
@@ -95,9 +97,16 @@ type NFA struct {
 	Recommender     int               `json:"recommender"`
 	LastRecommender int               `json:"last_recommender"`
 	InitiatorID     int               `json:"initiator_id"`
+	Amount          Money             `json:"amount"`
+	Currency        string            `json:"currency"`
+	CostCentre      string            `json:"cost_centre"`
 	Approvals       []NFAApprovalList `json:"approvals"`
 	Files           []NFAFile         `json:"files"`
 	Status          string            `json:"status"`
+	// NFANumber is the human-readable number allocated on submission
+	NFANumber string `json:"nfa_number,omitempty"`
+	// CustomFields holds the department's custom field values by field name
+	CustomFields map[string]interface{} `json:"custom_fields,omitempty"`
 }
 
 type NFAFile struct {
@@ -105,16 +114,214 @@ type NFAFile struct {
 	NFAID int    `json:"nfa_id"`
 	Path  string `json:"file_path"`
 	Name  string `json:"file_name"`
+	// Type is the kind of attachment, such as "quotation", checked against a
+	// template's required attachment types
+	Type string `json:"file_type,omitempty"`
+	// ScanStatus is the malware scan verdict for files kept in the file store
+	ScanStatus string `json:"scan_status,omitempty"`
 }
 
 type NFAApprovalList struct {
-	ID            int       `json:"id"`
-	NFAID         int       `json:"nfa_id"`
-	ApproverID    int       `json:"approver_id"`
-	Order         int       `json:"order_value"`
-	Status        string    `json:"status"`
-	Comments      string    `json:"comments"`
-	ApproverName  string    `json:"approver_name"`
-	StartedDate   time.Time `json:"started_at"`
-	CompletedDate time.Time `json:"completed_at"`
+	ID                int       `json:"id"`
+	NFAID             int       `json:"nfa_id"`
+	ApproverID        int       `json:"approver_id"`
+	Order             int       `json:"order_value"`
+	Rule              string    `json:"approval_rule"`      // "all" or "any" for approvers sharing an order_value
+	RequiredApprovals int       `json:"required_approvals"` // N in "any N of M"
+	Status            string    `json:"status"`
+	Comments          string    `json:"comments"`
+	ApproverName      string    `json:"approver_name"`
+	ActedBy           int       `json:"acted_by"` // differs from ApproverID when a delegate acted
+	ActedByName       string    `json:"acted_by_name"`
+	StartedDate       time.Time `json:"started_at"`
+	CompletedDate     time.Time `json:"completed_at"`
+}
+
+// NFAApprovalStage groups the approvers that share one order_value.
+type NFAApprovalStage struct {
+	Order             int               `json:"order_value"`
+	Rule              string            `json:"approval_rule"`
+	RequiredApprovals int               `json:"required_approvals"`
+	Approvals         []NFAApprovalList `json:"approvals"`
+}
+
+type Delegation struct {
+	ID           int       `json:"id"`
+	UserID       int       `json:"user_id"`
+	UserName     string    `json:"user_name"`
+	DelegateID   int       `json:"delegate_id"`
+	DelegateName string    `json:"delegate_name"`
+	StartDate    time.Time `json:"start_date"`
+	EndDate      time.Time `json:"end_date"`
+	Reason       string    `json:"reason"`
+}
+
+type Notification struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	NFAID     int       `json:"nfa_id"`
+	Message   string    `json:"message"`
+	IsRead    bool      `json:"is_read"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type SLAPolicy struct {
+	Priority      string `json:"priority"`
+	DueHours      int    `json:"due_hours"`      // approver is flagged overdue after this
+	EscalateHours int    `json:"escalate_hours"` // approval moves up the hierarchy after this
+}
+
+// NFARevision is one entry in the chain of revisions of an NFA.
+type NFARevision struct {
+	NFAID            int    `json:"nfa_id"`
+	Revision         int    `json:"revision"`
+	RevisionOf       int    `json:"revision_of,omitempty"`
+	Status           string `json:"status"`
+	Subject          string `json:"subject"`
+	RejectedBy       int    `json:"rejected_by,omitempty"`
+	RejectedByName   string `json:"rejected_by_name,omitempty"`
+	RejectionComment string `json:"rejection_comment,omitempty"`
+}
+
+// ApprovalMatrixRule requires NFAs in an amount band to be approved by someone
+// at MinLevel or higher in the department hierarchy. A zero DepartmentID or
+// ProjectID matches any; a nil MaxAmount leaves the band open-ended.
+type ApprovalMatrixRule struct {
+	ID           int    `json:"id"`
+	DepartmentID int    `json:"department_id"`
+	ProjectID    int    `json:"project_id"`
+	MinAmount    Money  `json:"min_amount"`
+	MaxAmount    *Money `json:"max_amount"`
+	MinLevel     int    `json:"min_level"`
+}
+
+// CustomField is an admin-defined field that NFAs of a department carry in
+// addition to the fixed ones. Type is one of text, number, date, enum or
+// user; Options lists the allowed values of an enum.
+type CustomField struct {
+	ID           int       `json:"id"`
+	DepartmentID int       `json:"department_id"`
+	Name         string    `json:"name"`
+	Label        string    `json:"label"`
+	Type         string    `json:"field_type"`
+	Options      []string  `json:"options"`
+	Required     bool      `json:"required"`
+	SortOrder    int       `json:"sort_order"`
+	IsActive     bool      `json:"is_active"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// NFATemplate pre-fills and validates NFAs of a recurring kind. A zero
+// DepartmentID or ProjectID makes the template available to any. Placeholders
+// in SubjectPattern are written as {name} and match any non-empty text.
+// RequiredAttachments lists MIME types or kinds of attachment; each must be
+// met by a file uploaded to the file store.
+type NFATemplate struct {
+	ID                  int               `json:"id"`
+	Name                string            `json:"name"`
+	DepartmentID        int               `json:"department_id"`
+	ProjectID           int               `json:"project_id"`
+	SubjectPattern      string            `json:"subject_pattern"`
+	Description         string            `json:"description"`
+	DefaultPriority     string            `json:"default_priority"`
+	ApprovalList        []NFAApprovalList `json:"approval_list"`
+	RequiredAttachments []string          `json:"required_attachments"`
+	IsActive            bool              `json:"is_active"`
+	CreatedAt           time.Time         `json:"created_at"`
+}
+
+// NumberingSeries sets the NFA number pattern for a department, a project or
+// both; zero IDs match any. The most specific series wins.
+type NumberingSeries struct {
+	ID           int    `json:"id"`
+	DepartmentID int    `json:"department_id"`
+	ProjectID    int    `json:"project_id"`
+	Pattern      string `json:"pattern"`
+	Example      string `json:"example"`
+}
+
+// NFARelation links an NFA to another one. Type is how the link is stored;
+// Label reads it from the side of the NFA it is listed on, so a parent sees
+// "parent_of" where the child sees "child_of".
+type NFARelation struct {
+	ID        int       `json:"id"`
+	Type      string    `json:"type"`
+	Label     string    `json:"label"`
+	NFAID     int       `json:"nfa_id"`
+	NFANumber string    `json:"nfa_number,omitempty"`
+	Subject   string    `json:"subject"`
+	Status    string    `json:"status"`
+	CreatedBy int       `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NFARollup summarizes the statuses of a parent NFA's children.
+type NFARollup struct {
+	Total    int            `json:"total"`
+	Statuses map[string]int `json:"statuses"`
+	// Done counts the children that reached a final status
+	Done int `json:"done"`
+}
+
+// UploadedFile is the metadata recorded for every upload. FileName is the key
+// in the file store. ScanStatus is "pending", "clean", "infected", "failed"
+// or "not_scanned".
+type UploadedFile struct {
+	ID           int       `json:"id"`
+	FileName     string    `json:"file_name"`
+	OriginalName string    `json:"original_name"`
+	Size         int64     `json:"size"`
+	MimeType     string    `json:"mime_type"`
+	SHA256       string    `json:"sha256"`
+	UploadedBy   int       `json:"uploaded_by"`
+	NFAID        int       `json:"nfa_id,omitempty"`
+	CommentID    int       `json:"comment_id,omitempty"`
+	ScanStatus   string    `json:"scan_status"`
+	ScanResult   string    `json:"scan_result,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// NFAComment is a post in an NFA's discussion thread. Replies are nested
+// under their parent.
+type NFAComment struct {
+	ID         int          `json:"id"`
+	NFAID      int          `json:"nfa_id"`
+	ParentID   int          `json:"parent_id,omitempty"`
+	AuthorID   int          `json:"author_id"`
+	AuthorName string       `json:"author_name"`
+	Body       string       `json:"body"`
+	Mentions   []int        `json:"mentions"`
+	Files      []string     `json:"files"`
+	CreatedAt  time.Time    `json:"created_at"`
+	UpdatedAt  *time.Time   `json:"updated_at,omitempty"`
+	Deleted    bool         `json:"deleted"`
+	Replies    []NFAComment `json:"replies"`
+}
+
+// NFACommentChange is an earlier version of a comment, kept when it is edited
+// or deleted.
+type NFACommentChange struct {
+	Action        string    `json:"action"` // "edit" or "delete"
+	Body          string    `json:"body"`
+	ChangedBy     int       `json:"changed_by"`
+	ChangedByName string    `json:"changed_by_name"`
+	ChangedAt     time.Time `json:"changed_at"`
+}
+
+// NFAVersion is a saved snapshot of an NFA's content.
+type NFAVersion struct {
+	Version       int             `json:"version"`
+	CreatedBy     int             `json:"created_by"`
+	CreatedByName string          `json:"created_by_name"`
+	CreatedAt     time.Time       `json:"created_at"`
+	Snapshot      json.RawMessage `json:"snapshot,omitempty"`
+}
+
+// NFAFieldChange is one field that differs between two NFA versions. Segments
+// holds a word-level diff for the HTML description.
+type NFAFieldChange struct {
+	Field    string              `json:"field"`
+	From     interface{}         `json:"from"`
+	To       interface{}         `json:"to"`
+	Segments []utils.DiffSegment `json:"segments,omitempty"`
 }
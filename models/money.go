@@ -0,0 +1,118 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount in minor units (paise), so amounts are stored and
+// compared exactly. In JSON it is a decimal string such as "1234.50"; a JSON
+// number with at most two decimals is accepted as well. In the database it is
+// read from and written to NUMERIC(18, 2) columns as decimal text.
+type Money int64
+
+var errMoney = errors.New("invalid amount")
+
+// ParseMoney reads a decimal amount with at most two decimals, such as
+// "1234.5" or "-10". Exponents and more precision than paise are rejected
+// rather than rounded.
+func ParseMoney(s string) (Money, error) {
+	text := strings.TrimSpace(s)
+	negative := strings.HasPrefix(text, "-")
+	text = strings.TrimPrefix(text, "-")
+
+	whole, fraction, _ := strings.Cut(text, ".")
+	if whole == "" || len(fraction) > 2 || !allDigits(whole) || !allDigits(fraction) {
+		return 0, fmt.Errorf("%w: %q", errMoney, s)
+	}
+	fraction += strings.Repeat("0", 2-len(fraction))
+
+	paise, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", errMoney, s)
+	}
+	if negative {
+		paise = -paise
+	}
+	return Money(paise), nil
+}
+
+func allDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats the amount with two decimals.
+func (m Money) String() string {
+	paise := int64(m)
+	sign := ""
+	if paise < 0 {
+		sign = "-"
+	}
+	units, rest := paise/100, paise%100
+	if rest < 0 {
+		units, rest = -units, -rest
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, units, rest)
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	text := string(data)
+	if text == "null" {
+		return nil
+	}
+	if strings.HasPrefix(text, `"`) {
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+	}
+	parsed, err := ParseMoney(text)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Value writes the amount as decimal text, which PostgreSQL converts to
+// NUMERIC without going through a float.
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return m.scanText(string(v))
+	case string:
+		return m.scanText(v)
+	case int64:
+		*m = Money(v * 100)
+		return nil
+	case nil:
+		*m = 0
+		return nil
+	}
+	return fmt.Errorf("cannot scan %T into Money", src)
+}
+
+func (m *Money) scanText(text string) error {
+	parsed, err := ParseMoney(text)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
@@ -0,0 +1,107 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Money
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"1234", 123400, false},
+		{"1234.5", 123450, false},
+		{"1234.56", 123456, false},
+		{"0.01", 1, false},
+		{"-10.05", -1005, false},
+		{" 7.10 ", 710, false},
+		{"0.1", 10, false},
+		{"99999999999999999.99", 0, true},
+		{"1.005", 0, true},
+		{"1e3", 0, true},
+		{"+5", 0, true},
+		{".5", 0, true},
+		{"-", 0, true},
+		{"", 0, true},
+		{"12,50", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseMoney(%q) = %d, %v; want %d, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		in   Money
+		want string
+	}{
+		{0, "0.00"},
+		{5, "0.05"},
+		{123450, "1234.50"},
+		{-5, "-0.05"},
+		{-123456, "-1234.56"},
+	}
+	for _, tt := range tests {
+		if got := tt.in.String(); got != tt.want {
+			t.Errorf("Money(%d).String() = %q, want %q", int64(tt.in), got, tt.want)
+		}
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	var rule ApprovalMatrixRule
+	if err := json.Unmarshal([]byte(`{"min_amount": 100000.10, "max_amount": "500000"}`), &rule); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if rule.MinAmount != 10000010 || rule.MaxAmount == nil || *rule.MaxAmount != 50000000 {
+		t.Errorf("Unmarshal() = %d, %v", rule.MinAmount, rule.MaxAmount)
+	}
+
+	rule = ApprovalMatrixRule{}
+	if err := json.Unmarshal([]byte(`{"min_amount": "1", "max_amount": null}`), &rule); err != nil || rule.MaxAmount != nil {
+		t.Errorf("Unmarshal() with null = %v, %v", rule.MaxAmount, err)
+	}
+	if err := json.Unmarshal([]byte(`{"min_amount": 0.333}`), &rule); err == nil {
+		t.Error("Unmarshal() accepted an amount below a paisa")
+	}
+
+	data, err := json.Marshal(struct {
+		Amount Money `json:"amount"`
+	}{Amount: 1999})
+	if err != nil || string(data) != `{"amount":"19.99"}` {
+		t.Errorf("Marshal() = %s, %v", data, err)
+	}
+}
+
+func TestMoneyScan(t *testing.T) {
+	tests := []struct {
+		src     interface{}
+		want    Money
+		wantErr bool
+	}{
+		{[]byte("1234.50"), 123450, false},
+		{"0.00", 0, false},
+		{int64(12), 1200, false},
+		{nil, 0, false},
+		{1.5, 0, true},
+		{[]byte("abc"), 0, true},
+	}
+	for _, tt := range tests {
+		var m Money
+		err := m.Scan(tt.src)
+		if (err != nil) != tt.wantErr || m != tt.want {
+			t.Errorf("Scan(%v) = %d, %v; want %d, error %v", tt.src, m, err, tt.want, tt.wantErr)
+		}
+	}
+
+	value, err := Money(-250).Value()
+	if err != nil || value != "-2.50" {
+		t.Errorf("Value() = %v, %v", value, err)
+	}
+}
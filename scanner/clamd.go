@@ -0,0 +1,137 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize is the size of the chunks streamed to clamd. It has to stay
+// below clamd's StreamMaxLength.
+const clamdChunkSize = 64 << 10
+
+// Clamd scans through the INSTREAM command of a clamd daemon, or anything that
+// speaks its protocol.
+type Clamd struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// NewClamd returns a scanner for the clamd listening on address: host:port,
+// or a path for a unix socket.
+func NewClamd(address string, timeout time.Duration) *Clamd {
+	network := "tcp"
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+	return &Clamd{network: network, address: address, timeout: timeout}
+}
+
+// Scan streams r to clamd in length-prefixed chunks and parses the reply, one
+// of "stream: OK", "stream: <signature> FOUND" or "<message> ERROR".
+func (s *Clamd) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to connect to clamd: %v", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if err := s.stream(conn, r); err != nil {
+		// clamd closes the connection early, e.g. when the stream is over
+		// its size limit; its reply says why
+		if reply, replyErr := readReply(conn); replyErr == nil {
+			return parseReply(reply)
+		}
+		return Result{}, err
+	}
+
+	reply, err := readReply(conn)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to read clamd reply: %v", err)
+	}
+	return parseReply(reply)
+}
+
+func (s *Clamd) stream(conn net.Conn, r io.Reader) error {
+	writer := bufio.NewWriterSize(conn, clamdChunkSize+4)
+	if _, err := writer.WriteString("zINSTREAM\x00"); err != nil {
+		return fmt.Errorf("failed to send to clamd: %v", err)
+	}
+
+	chunk := make([]byte, clamdChunkSize)
+	var size [4]byte
+	for {
+		n, readErr := io.ReadFull(r, chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			if _, err := writer.Write(size[:]); err != nil {
+				return fmt.Errorf("failed to send to clamd: %v", err)
+			}
+			if _, err := writer.Write(chunk[:n]); err != nil {
+				return fmt.Errorf("failed to send to clamd: %v", err)
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		} else if readErr != nil {
+			return fmt.Errorf("failed to read file: %v", readErr)
+		}
+	}
+
+	// A zero-length chunk ends the stream
+	binary.BigEndian.PutUint32(size[:], 0)
+	if _, err := writer.Write(size[:]); err != nil {
+		return fmt.Errorf("failed to send to clamd: %v", err)
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to send to clamd: %v", err)
+	}
+	return nil
+}
+
+// readReply reads the NUL-terminated reply of a z-prefixed command. A reply
+// cut off before its terminator is an error, not a verdict.
+func readReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if errors.Is(err, io.EOF) {
+		if reply == "" {
+			return "", errors.New("clamd closed the connection without a reply")
+		}
+		return "", fmt.Errorf("truncated clamd reply %q", reply)
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(strings.TrimRight(reply, "\x00")), nil
+}
+
+func parseReply(reply string) (Result, error) {
+	// Replies to sessions carry a request number: "1: stream: OK"
+	verdict := reply
+	if i := strings.Index(verdict, "stream: "); i >= 0 {
+		verdict = verdict[i+len("stream: "):]
+	}
+	switch {
+	case verdict == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(verdict, " FOUND")}, nil
+	case strings.Contains(verdict, "size limit exceeded"):
+		return Result{}, fmt.Errorf("%w: clamd: %s", ErrUnscannable, reply)
+	default:
+		return Result{}, fmt.Errorf("clamd: %s", reply)
+	}
+}
@@ -0,0 +1,184 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClamd accepts a single INSTREAM command and answers it with reply.
+// When limit is above 0 it stops reading once that many bytes have been
+// streamed, the way clamd does at its StreamMaxLength. The streamed content
+// is sent on received.
+type fakeClamd struct {
+	reply    string
+	limit    int
+	hang     bool
+	received chan []byte
+}
+
+func (f *fakeClamd) start(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	f.received = make(chan []byte, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		f.received <- f.serve(t, conn)
+	}()
+	return listener.Addr().String()
+}
+
+func (f *fakeClamd) serve(t *testing.T, conn net.Conn) []byte {
+	reader := bufio.NewReader(conn)
+	command, err := reader.ReadString(0)
+	if err != nil || command != "zINSTREAM\x00" {
+		t.Errorf("command = %q, %v", command, err)
+		return nil
+	}
+
+	var content []byte
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(reader, size[:]); err != nil {
+			t.Errorf("failed to read chunk size: %v", err)
+			return content
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n == 0 {
+			break
+		}
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			t.Errorf("failed to read chunk: %v", err)
+			return content
+		}
+		content = append(content, chunk...)
+		if f.limit > 0 && len(content) > f.limit {
+			break
+		}
+	}
+
+	if f.hang {
+		time.Sleep(time.Second)
+		return content
+	}
+	conn.Write([]byte(f.reply))
+	if f.limit > 0 {
+		// Keep reading what is still being sent, so closing does not reset
+		// the connection before the client has read the reply
+		io.Copy(io.Discard, reader)
+	}
+	return content
+}
+
+func TestClamdScan(t *testing.T) {
+	content := []byte("quotation for the pumps")
+	tests := []struct {
+		name        string
+		reply       string
+		want        Result
+		wantErr     bool
+		unscannable bool
+	}{
+		{"clean", "stream: OK\x00", Result{}, false, false},
+		{"clean in a session", "1: stream: OK\x00", Result{}, false, false},
+		{"infected", "stream: Eicar-Test-Signature FOUND\x00", Result{Infected: true, Signature: "Eicar-Test-Signature"}, false, false},
+		{"scanner error", "Can't allocate memory ERROR\x00", Result{}, true, false},
+		{"size limit", "INSTREAM size limit exceeded. ERROR\x00", Result{}, true, true},
+		{"truncated verdict", "stream: O", Result{}, true, false},
+		{"truncated before FOUND", "stream: Eicar-Test-Sig", Result{}, true, false},
+		{"no reply", "", Result{}, true, false},
+		{"unknown reply", "stream: MAYBE\x00", Result{}, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeClamd{reply: tt.reply}
+			clamd := NewClamd(fake.start(t), 5*time.Second)
+
+			got, err := clamd.Scan(context.Background(), bytes.NewReader(content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Scan() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(err, ErrUnscannable) != tt.unscannable {
+				t.Errorf("Scan() error = %v, ErrUnscannable %v", err, tt.unscannable)
+			}
+			if got != tt.want {
+				t.Errorf("Scan() = %+v, want %+v", got, tt.want)
+			}
+			if received := <-fake.received; !bytes.Equal(received, content) {
+				t.Errorf("clamd received %q, want %q", received, content)
+			}
+		})
+	}
+}
+
+func TestClamdScanChunks(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), clamdChunkSize/4)
+	fake := &fakeClamd{reply: "stream: OK\x00"}
+	clamd := NewClamd(fake.start(t), 5*time.Second)
+
+	if _, err := clamd.Scan(context.Background(), bytes.NewReader(content)); err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+	if received := <-fake.received; !bytes.Equal(received, content) {
+		t.Errorf("clamd received %d bytes, want %d", len(received), len(content))
+	}
+}
+
+// clamd replies as soon as a stream passes its limit, while the rest is still
+// being sent.
+func TestClamdScanOverLimit(t *testing.T) {
+	content := bytes.Repeat([]byte{'x'}, 64*clamdChunkSize)
+	fake := &fakeClamd{reply: "INSTREAM size limit exceeded. ERROR\x00", limit: clamdChunkSize}
+	clamd := NewClamd(fake.start(t), 5*time.Second)
+
+	_, err := clamd.Scan(context.Background(), bytes.NewReader(content))
+	if !errors.Is(err, ErrUnscannable) {
+		t.Fatalf("Scan() error = %v, want ErrUnscannable", err)
+	}
+	<-fake.received
+}
+
+func TestClamdScanTimeout(t *testing.T) {
+	fake := &fakeClamd{hang: true}
+	clamd := NewClamd(fake.start(t), 100*time.Millisecond)
+
+	_, err := clamd.Scan(context.Background(), strings.NewReader("content"))
+	if err == nil {
+		t.Fatal("Scan() succeeded without a reply")
+	}
+	if errors.Is(err, ErrUnscannable) {
+		t.Errorf("a timeout was reported as final: %v", err)
+	}
+	<-fake.received
+}
+
+func TestClamdUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	if _, err := NewClamd(address, time.Second).Scan(context.Background(), strings.NewReader("x")); err == nil {
+		t.Fatal("Scan() succeeded without clamd")
+	}
+}
@@ -0,0 +1,71 @@
+// Package scanner checks uploaded attachments for malware before they can be
+// downloaded.
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Result is the verdict on a scanned file.
+type Result struct {
+	Infected bool
+	// Signature names what was found in an infected file
+	Signature string
+}
+
+// Scanner checks a file's content. An error means no verdict was reached;
+// unless it is ErrUnscannable the scan may be retried.
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+}
+
+// ErrUnscannable is returned for a file the scanner refuses outright, such as
+// one over its size limit. Retrying will not give a verdict.
+var ErrUnscannable = errors.New("file cannot be scanned")
+
+// defaultClamdAddress is used when CLAMD_ADDRESS is not set.
+const defaultClamdAddress = "localhost:3310"
+
+// defaultClamdTimeout is used when CLAMD_TIMEOUT_SECONDS is not set.
+const defaultClamdTimeout = 2 * time.Minute
+
+var scanner Scanner
+
+// Init configures the scanner from the environment:
+//
+//	SCANNER                 "none" (default) or "clamd"
+//	CLAMD_ADDRESS           host:port of clamd, or the path of its unix socket
+//	CLAMD_TIMEOUT_SECONDS   limit on a single scan
+//
+// Without a scanner, uploads are marked as not scanned and can be downloaded
+// straight away.
+func Init() (Scanner, error) {
+	switch backend := os.Getenv("SCANNER"); backend {
+	case "", "none":
+		scanner = nil
+	case "clamd":
+		address := os.Getenv("CLAMD_ADDRESS")
+		if address == "" {
+			address = defaultClamdAddress
+		}
+		timeout := defaultClamdTimeout
+		if seconds, err := strconv.Atoi(os.Getenv("CLAMD_TIMEOUT_SECONDS")); err == nil && seconds > 0 {
+			timeout = time.Duration(seconds) * time.Second
+		}
+		scanner = NewClamd(address, timeout)
+	default:
+		return nil, fmt.Errorf("unknown SCANNER %q", backend)
+	}
+	return scanner, nil
+}
+
+// Get returns the scanner configured by Init, or nil when scanning is off.
+func Get() Scanner {
+	return scanner
+}
@@ -0,0 +1,15 @@
+package storage
+
+import "fmt"
+
+// LogNFAChange records a change made to an NFA outside the normal workflow,
+// such as an admin unlock or an approver added after approval has started.
+// actorID may be zero when the caller is not known.
+func LogNFAChange(q Querier, nfaID, actorID int, action, details string) error {
+	_, err := q.Exec(`INSERT INTO nfa_audit_log (nfa_id, actor_id, action, details) VALUES ($1, NULLIF($2, 0), $3, $4)`,
+		nfaID, actorID, action, details)
+	if err != nil {
+		return fmt.Errorf("failed to record audit entry: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package storage
+
+import (
+	"database/sql"
+	"log"
+)
+
+// Querier is satisfied by both *sql.DB and *sql.Tx, so notifications can be
+// written inside the transaction that triggered them.
+type Querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// CreateNotification stores an in-app notification for the user. nfaID may be
+// zero when the notification is not about a particular NFA.
+func CreateNotification(q Querier, userID, nfaID int, message string) (int, error) {
+	var id int
+	err := q.QueryRow(`INSERT INTO notifications (user_id, nfa_id, message) VALUES ($1, NULLIF($2, 0), $3) RETURNING id`,
+		userID, nfaID, message).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Notification %d for user %d: %s", id, userID, message)
+	return id, nil
+}
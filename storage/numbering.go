@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// DefaultNumberPattern is used when no numbering series matches an NFA.
+const DefaultNumberPattern = "NFA/{FY}/{SEQ:4}"
+
+// Pattern tokens:
+//
+//	{DEPT_ID}     department ID
+//	{PROJECT_ID}  project ID
+//	{FY}          financial year, e.g. 2026-27
+//	{YYYY}        calendar year
+//	{SEQ} {SEQ:n} sequence number, zero-padded to n digits
+//
+// Everything else is copied literally, so a department's series can spell
+// out its own code, as in FIN/PRJ{PROJECT_ID}/{FY}/{SEQ:4}.
+var numberToken = regexp.MustCompile(`\{([A-Z_]+)(?::(\d+))?\}`)
+
+// ValidateNumberPattern checks that a pattern uses known tokens and has
+// exactly one sequence.
+func ValidateNumberPattern(pattern string) error {
+	sequences := 0
+	for _, match := range numberToken.FindAllStringSubmatch(pattern, -1) {
+		switch match[1] {
+		case "DEPT_ID", "PROJECT_ID", "FY", "YYYY":
+			if match[2] != "" {
+				return fmt.Errorf("{%s} does not take a width", match[1])
+			}
+		case "SEQ":
+			sequences++
+			if width, _ := strconv.Atoi(match[2]); width > 10 {
+				return fmt.Errorf("sequence width must be at most 10")
+			}
+		default:
+			return fmt.Errorf("unknown token {%s}", match[1])
+		}
+	}
+	if sequences != 1 {
+		return fmt.Errorf("pattern must contain {SEQ} exactly once")
+	}
+	return nil
+}
+
+// financialYearStartMonth reads FINANCIAL_YEAR_START_MONTH, defaulting to
+// April.
+func financialYearStartMonth() time.Month {
+	month, err := strconv.Atoi(os.Getenv("FINANCIAL_YEAR_START_MONTH"))
+	if err != nil || month < 1 || month > 12 {
+		return time.April
+	}
+	return time.Month(month)
+}
+
+// FinancialYear formats the financial year containing t, e.g. 2026-27. With
+// a January start it is just the calendar year.
+func FinancialYear(t time.Time) string {
+	start := financialYearStartMonth()
+	if start == time.January {
+		return strconv.Itoa(t.Year())
+	}
+	year := t.Year()
+	if t.Month() < start {
+		year--
+	}
+	return fmt.Sprintf("%d-%02d", year, (year+1)%100)
+}
+
+// renderNumberPattern fills in every token except the sequence, which is
+// left as {SEQ...} so the result can serve as the counter scope.
+func renderNumberPattern(pattern string, departmentID, projectID int, at time.Time) string {
+	return numberToken.ReplaceAllStringFunc(pattern, func(token string) string {
+		match := numberToken.FindStringSubmatch(token)
+		switch match[1] {
+		case "DEPT_ID":
+			return strconv.Itoa(departmentID)
+		case "PROJECT_ID":
+			return strconv.Itoa(projectID)
+		case "FY":
+			return FinancialYear(at)
+		case "YYYY":
+			return strconv.Itoa(at.Year())
+		}
+		return token
+	})
+}
+
+// AllocateNFANumber returns the next number for an NFA from the most
+// specific series configured for its department and project. Counters are
+// kept per rendered pattern, whatever the sequence width, so every department, project and financial year
+// that the pattern distinguishes has its own sequence. q should be the
+// transaction that stores the number: the counter row stays locked until it
+// commits, and a rollback gives the number back, which keeps the sequence
+// free of gaps.
+func AllocateNFANumber(q Querier, departmentID, projectID int, at time.Time) (string, error) {
+	var pattern string
+	err := q.QueryRow(`
+		SELECT pattern FROM numbering_series
+		WHERE (department_id IS NULL OR department_id = $1)
+		AND (project_id IS NULL OR project_id = $2)
+		ORDER BY department_id IS NULL, project_id IS NULL, id
+		LIMIT 1`, departmentID, projectID).Scan(&pattern)
+	if err == sql.ErrNoRows {
+		pattern = DefaultNumberPattern
+	} else if err != nil {
+		return "", fmt.Errorf("failed to find numbering series: %v", err)
+	}
+
+	rendered := renderNumberPattern(pattern, departmentID, projectID, at)
+
+	var sequence int
+	err = q.QueryRow(`
+		INSERT INTO numbering_counters (scope, last_value) VALUES ($1, 1)
+		ON CONFLICT (scope) DO UPDATE SET last_value = numbering_counters.last_value + 1
+		RETURNING last_value`, counterScope(rendered)).Scan(&sequence)
+	if err != nil {
+		return "", fmt.Errorf("failed to allocate NFA number: %v", err)
+	}
+
+	return fillSequence(rendered, sequence), nil
+}
+
+// sequenceWidth matches the width of a {SEQ:n} token.
+var sequenceWidth = regexp.MustCompile(`\{SEQ:\d+\}`)
+
+// counterScope drops the sequence width from a rendered pattern. Changing
+// only the padding of a series then carries on with the same counter rather
+// than starting again at 1 and repeating numbers already given out.
+func counterScope(rendered string) string {
+	return sequenceWidth.ReplaceAllString(rendered, "{SEQ}")
+}
+
+// PreviewNFANumber shows what the first number of a pattern looks like.
+func PreviewNFANumber(pattern string, departmentID, projectID int, at time.Time) string {
+	return fillSequence(renderNumberPattern(pattern, departmentID, projectID, at), 1)
+}
+
+func fillSequence(scope string, sequence int) string {
+	return numberToken.ReplaceAllStringFunc(scope, func(token string) string {
+		match := numberToken.FindStringSubmatch(token)
+		width, _ := strconv.Atoi(match[2])
+		return fmt.Sprintf("%0*d", width, sequence)
+	})
+}
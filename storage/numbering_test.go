@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateNumberPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		wantErr bool
+	}{
+		{DefaultNumberPattern, false},
+		{"FIN/PRJ{PROJECT_ID}/{FY}/{SEQ:4}", false},
+		{"{DEPT_ID}-{YYYY}-{SEQ}", false},
+		{"{SEQ:10}", false},
+		{"{SEQ:11}", true},
+		{"NFA/{FY}", true},
+		{"{SEQ}/{SEQ}", true},
+		{"{FY:2}/{SEQ}", true},
+		{"{MONTH}/{SEQ}", true},
+	}
+	for _, tt := range tests {
+		if err := ValidateNumberPattern(tt.pattern); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateNumberPattern(%q) error = %v, wantErr %v", tt.pattern, err, tt.wantErr)
+		}
+	}
+}
+
+func TestFinancialYear(t *testing.T) {
+	tests := []struct {
+		startMonth string
+		at         time.Time
+		want       string
+	}{
+		{"", time.Date(2026, time.April, 1, 0, 0, 0, 0, time.UTC), "2026-27"},
+		{"", time.Date(2026, time.March, 31, 23, 0, 0, 0, time.UTC), "2025-26"},
+		{"", time.Date(1999, time.December, 1, 0, 0, 0, 0, time.UTC), "1999-00"},
+		{"13", time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC), "2025-26"},
+		{"7", time.Date(2026, time.June, 30, 0, 0, 0, 0, time.UTC), "2025-26"},
+		{"7", time.Date(2026, time.July, 1, 0, 0, 0, 0, time.UTC), "2026-27"},
+		{"1", time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC), "2026"},
+	}
+	for _, tt := range tests {
+		t.Setenv("FINANCIAL_YEAR_START_MONTH", tt.startMonth)
+		if got := FinancialYear(tt.at); got != tt.want {
+			t.Errorf("FinancialYear(%s) with start month %q = %q, want %q", tt.at.Format("2006-01-02"), tt.startMonth, got, tt.want)
+		}
+	}
+}
+
+func TestFillSequence(t *testing.T) {
+	tests := []struct {
+		rendered string
+		sequence int
+		want     string
+	}{
+		{"NFA/2026-27/{SEQ:4}", 7, "NFA/2026-27/0007"},
+		{"NFA/{SEQ:2}", 100, "NFA/100"},
+		{"NFA/{SEQ}", 42, "NFA/42"},
+		{"{SEQ:3}-FIN", 1, "001-FIN"},
+	}
+	for _, tt := range tests {
+		if got := fillSequence(tt.rendered, tt.sequence); got != tt.want {
+			t.Errorf("fillSequence(%q, %d) = %q, want %q", tt.rendered, tt.sequence, got, tt.want)
+		}
+	}
+}
+
+func TestCounterScopeIgnoresWidth(t *testing.T) {
+	at := time.Date(2026, time.May, 1, 0, 0, 0, 0, time.UTC)
+	t.Setenv("FINANCIAL_YEAR_START_MONTH", "")
+
+	narrow := counterScope(renderNumberPattern("X/{FY}/{SEQ:2}", 1, 2, at))
+	wide := counterScope(renderNumberPattern("X/{FY}/{SEQ:3}", 1, 2, at))
+	plain := counterScope(renderNumberPattern("X/{FY}/{SEQ}", 1, 2, at))
+	if narrow != wide || wide != plain {
+		t.Errorf("scopes differ by width: %q, %q, %q", narrow, wide, plain)
+	}
+	if want := "X/2026-27/{SEQ}"; plain != want {
+		t.Errorf("counterScope() = %q, want %q", plain, want)
+	}
+
+	other := counterScope(renderNumberPattern("X/{FY}/{DEPT_ID}/{SEQ:2}", 3, 2, at))
+	if other == narrow {
+		t.Errorf("departments share the scope %q", other)
+	}
+}
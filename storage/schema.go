@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// schemaStatements holds the idempotent DDL for tables and columns added on
+// top of the original schema. Statements run in order on every start, so each
+// one must be safe to repeat.
+var schemaStatements = []string{
+	`CREATE TABLE IF NOT EXISTS nfa_status_history (
+		id SERIAL PRIMARY KEY,
+		nfa_id INT NOT NULL,
+		from_status TEXT NOT NULL,
+		to_status TEXT NOT NULL,
+		actor_id INT,
+		comment TEXT,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_nfa_status_history_nfa ON nfa_status_history (nfa_id)`,
+
+	// Parallel approval stages: rows sharing an order_value form one stage.
+	`ALTER TABLE nfa_approval_list ADD COLUMN IF NOT EXISTS approval_rule TEXT NOT NULL DEFAULT 'all'`,
+	`ALTER TABLE nfa_approval_list ADD COLUMN IF NOT EXISTS required_approvals INT NOT NULL DEFAULT 0`,
+
+	// Out-of-office delegation; acted_by records who actually acted on a row.
+	`CREATE TABLE IF NOT EXISTS approval_delegations (
+		id SERIAL PRIMARY KEY,
+		user_id INT NOT NULL,
+		delegate_id INT NOT NULL,
+		start_date DATE NOT NULL,
+		end_date DATE NOT NULL,
+		reason TEXT,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_approval_delegations_delegate ON approval_delegations (delegate_id, start_date, end_date)`,
+	`ALTER TABLE nfa_approval_list ADD COLUMN IF NOT EXISTS acted_by INT`,
+
+	// In-app notifications.
+	`CREATE TABLE IF NOT EXISTS notifications (
+		id SERIAL PRIMARY KEY,
+		user_id INT NOT NULL,
+		nfa_id INT,
+		message TEXT NOT NULL,
+		is_read BOOLEAN NOT NULL DEFAULT FALSE,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_notifications_user ON notifications (user_id, is_read)`,
+
+	// Approval SLAs per NFA priority, in hours from when an approver's turn starts.
+	`CREATE TABLE IF NOT EXISTS sla_policies (
+		priority TEXT PRIMARY KEY,
+		due_hours INT NOT NULL,
+		escalate_hours INT NOT NULL,
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`INSERT INTO sla_policies (priority, due_hours, escalate_hours) VALUES
+		('High', 24, 48), ('Medium', 72, 120), ('Low', 120, 168)
+		ON CONFLICT (priority) DO NOTHING`,
+	`ALTER TABLE nfa_approval_list ADD COLUMN IF NOT EXISTS overdue_at TIMESTAMP`,
+	`ALTER TABLE nfa_approval_list ADD COLUMN IF NOT EXISTS escalated_at TIMESTAMP`,
+	`ALTER TABLE nfa_approval_list ADD COLUMN IF NOT EXISTS escalated_from INT`,
+
+	// Send back for clarification. returned_to is NULL when the NFA went back
+	// to the initiator; returned_order is NULL when the recommender returned it.
+	`ALTER TABLE nfa ADD COLUMN IF NOT EXISTS returned_by INT`,
+	`ALTER TABLE nfa ADD COLUMN IF NOT EXISTS returned_to INT`,
+	`ALTER TABLE nfa ADD COLUMN IF NOT EXISTS returned_order INT`,
+
+	// Revisions of a rejected NFA point back at the NFA they replace.
+	`ALTER TABLE nfa ADD COLUMN IF NOT EXISTS revision_of INT`,
+	`ALTER TABLE nfa ADD COLUMN IF NOT EXISTS revision INT NOT NULL DEFAULT 1`,
+	`CREATE INDEX IF NOT EXISTS idx_nfa_revision_of ON nfa (revision_of)`,
+
+	// Spend details and the approval matrix (delegation of financial
+	// authority). A NULL department or project matches any; a NULL max_amount
+	// leaves the band open-ended.
+	`ALTER TABLE nfa ADD COLUMN IF NOT EXISTS amount NUMERIC(18, 2) NOT NULL DEFAULT 0`,
+	`ALTER TABLE nfa ADD COLUMN IF NOT EXISTS currency TEXT`,
+	`ALTER TABLE nfa ADD COLUMN IF NOT EXISTS cost_centre TEXT`,
+	`CREATE TABLE IF NOT EXISTS approval_matrix (
+		id SERIAL PRIMARY KEY,
+		department_id INT,
+		project_id INT,
+		min_amount NUMERIC(18, 2) NOT NULL DEFAULT 0,
+		max_amount NUMERIC(18, 2),
+		min_level INT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+
+	// Discussion thread. Deleted comments keep their row, with the body moved
+	// to nfa_comment_history, so replies stay attached.
+	`CREATE TABLE IF NOT EXISTS nfa_comments (
+		id SERIAL PRIMARY KEY,
+		nfa_id INT NOT NULL,
+		parent_id INT,
+		author_id INT NOT NULL,
+		body TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP,
+		deleted_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_nfa_comments_nfa ON nfa_comments (nfa_id, created_at)`,
+	`CREATE TABLE IF NOT EXISTS nfa_comment_history (
+		id SERIAL PRIMARY KEY,
+		comment_id INT NOT NULL,
+		action TEXT NOT NULL,
+		body TEXT NOT NULL,
+		changed_by INT NOT NULL,
+		changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS nfa_comment_mentions (
+		comment_id INT NOT NULL,
+		user_id INT NOT NULL,
+		PRIMARY KEY (comment_id, user_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS nfa_comment_files (
+		id SERIAL PRIMARY KEY,
+		comment_id INT NOT NULL,
+		file_name TEXT NOT NULL
+	)`,
+
+	// Last autosave of a draft; drafts expire some days after it.
+	`ALTER TABLE nfa ADD COLUMN IF NOT EXISTS draft_saved_at TIMESTAMP`,
+
+	// Immutable snapshot of an NFA's editable content after each save.
+	`CREATE TABLE IF NOT EXISTS nfa_versions (
+		id SERIAL PRIMARY KEY,
+		nfa_id INT NOT NULL,
+		version INT NOT NULL,
+		snapshot JSONB NOT NULL,
+		created_by INT,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (nfa_id, version)
+	)`,
+
+	// Content locking once approval has started
+	`ALTER TABLE nfa ADD COLUMN IF NOT EXISTS unlocked_by INT`,
+	`ALTER TABLE nfa ADD COLUMN IF NOT EXISTS unlocked_at TIMESTAMP`,
+	`ALTER TABLE nfa ADD COLUMN IF NOT EXISTS unlock_reason TEXT`,
+	`CREATE TABLE IF NOT EXISTS nfa_audit_log (
+		id SERIAL PRIMARY KEY,
+		nfa_id INT NOT NULL,
+		actor_id INT,
+		action VARCHAR(50) NOT NULL,
+		details TEXT,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_nfa_audit_log_nfa ON nfa_audit_log (nfa_id)`,
+
+	// Row versions for optimistic concurrency; the trigger bumps the version
+	// on every update, whichever code path makes it
+	`ALTER TABLE nfa ADD COLUMN IF NOT EXISTS row_version INT NOT NULL DEFAULT 1`,
+	`ALTER TABLE nfa_approval_list ADD COLUMN IF NOT EXISTS row_version INT NOT NULL DEFAULT 1`,
+	`CREATE OR REPLACE FUNCTION bump_row_version() RETURNS TRIGGER AS $$
+	BEGIN
+		NEW.row_version := OLD.row_version + 1;
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS nfa_row_version ON nfa`,
+	`CREATE TRIGGER nfa_row_version BEFORE UPDATE ON nfa
+		FOR EACH ROW EXECUTE PROCEDURE bump_row_version()`,
+	`DROP TRIGGER IF EXISTS nfa_approval_list_row_version ON nfa_approval_list`,
+	`CREATE TRIGGER nfa_approval_list_row_version BEFORE UPDATE ON nfa_approval_list
+		FOR EACH ROW EXECUTE PROCEDURE bump_row_version()`,
+
+	// Admin-managed NFA templates scoped to a department or project
+	`CREATE TABLE IF NOT EXISTS nfa_templates (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		department_id INT,
+		project_id INT,
+		subject_pattern TEXT NOT NULL DEFAULT '',
+		description TEXT NOT NULL DEFAULT '',
+		default_priority VARCHAR(50) NOT NULL DEFAULT '',
+		required_attachments TEXT[] NOT NULL DEFAULT '{}',
+		is_active BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS nfa_template_approvers (
+		id SERIAL PRIMARY KEY,
+		template_id INT NOT NULL,
+		approver_id INT NOT NULL,
+		order_value INT NOT NULL,
+		approval_rule TEXT NOT NULL DEFAULT 'all',
+		required_approvals INT NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_nfa_template_approvers_template ON nfa_template_approvers (template_id)`,
+	`ALTER TABLE nfa ADD COLUMN IF NOT EXISTS template_id INT`,
+	`ALTER TABLE nfa_files ADD COLUMN IF NOT EXISTS file_type VARCHAR(100)`,
+
+	// Department-specific custom fields; values live on the NFA keyed by name
+	`CREATE TABLE IF NOT EXISTS custom_fields (
+		id SERIAL PRIMARY KEY,
+		department_id INT NOT NULL,
+		name VARCHAR(100) NOT NULL,
+		label VARCHAR(255) NOT NULL,
+		field_type VARCHAR(20) NOT NULL,
+		options TEXT[] NOT NULL DEFAULT '{}',
+		required BOOLEAN NOT NULL DEFAULT FALSE,
+		sort_order INT NOT NULL DEFAULT 0,
+		is_active BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (department_id, name)
+	)`,
+	`ALTER TABLE nfa ADD COLUMN IF NOT EXISTS custom_fields JSONB NOT NULL DEFAULT '{}'`,
+
+	// Human-readable NFA numbers. A series sets the pattern for a department,
+	// project or both; counters are kept per rendered prefix
+	`CREATE TABLE IF NOT EXISTS numbering_series (
+		id SERIAL PRIMARY KEY,
+		department_id INT,
+		project_id INT,
+		pattern TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS idx_numbering_series_scope
+		ON numbering_series (COALESCE(department_id, 0), COALESCE(project_id, 0))`,
+	`CREATE TABLE IF NOT EXISTS numbering_counters (
+		scope TEXT PRIMARY KEY,
+		last_value INT NOT NULL
+	)`,
+	// Counter scopes no longer include the sequence width; older ones are
+	// merged into the scope without it, keeping the highest value
+	`INSERT INTO numbering_counters (scope, last_value)
+		SELECT regexp_replace(scope, '\{SEQ:\d+\}', '{SEQ}', 'g'), MAX(last_value)
+		FROM numbering_counters WHERE scope ~ '\{SEQ:\d+\}'
+		GROUP BY 1
+		ON CONFLICT (scope) DO UPDATE SET last_value = GREATEST(numbering_counters.last_value, EXCLUDED.last_value)`,
+	`DELETE FROM numbering_counters WHERE scope ~ '\{SEQ:\d+\}'`,
+	`ALTER TABLE nfa ADD COLUMN IF NOT EXISTS nfa_number VARCHAR(100)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS idx_nfa_number ON nfa (nfa_number)`,
+
+	// Drafts started as a copy of another NFA
+	`ALTER TABLE nfa ADD COLUMN IF NOT EXISTS cloned_from INT`,
+
+	// Typed links between NFAs. nfa_id supersedes, is a child of or is
+	// related to related_nfa_id; "related_to" is stored once with the lower
+	// ID first
+	`CREATE TABLE IF NOT EXISTS nfa_relations (
+		id SERIAL PRIMARY KEY,
+		nfa_id INT NOT NULL,
+		related_nfa_id INT NOT NULL,
+		relation_type VARCHAR(20) NOT NULL,
+		created_by INT,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (nfa_id, related_nfa_id, relation_type)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_nfa_relations_related ON nfa_relations (related_nfa_id, relation_type)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS idx_nfa_relations_parent ON nfa_relations (nfa_id) WHERE relation_type = 'child_of'`,
+
+	// Upload metadata. file_name is the key in the file store; the owner is
+	// the NFA or comment the upload was first attached to
+	`CREATE TABLE IF NOT EXISTS uploaded_files (
+		id SERIAL PRIMARY KEY,
+		file_name TEXT NOT NULL UNIQUE,
+		original_name TEXT NOT NULL,
+		size BIGINT NOT NULL,
+		mime_type VARCHAR(255) NOT NULL,
+		sha256 CHAR(64) NOT NULL,
+		uploaded_by INT,
+		nfa_id INT,
+		comment_id INT,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	// file_key is the store key an NFA attachment points at; older rows only
+	// have it inside file_path, either bare or as a get_file URL
+	`ALTER TABLE nfa_files ADD COLUMN IF NOT EXISTS file_key TEXT`,
+	`UPDATE nfa_files
+		SET file_key = COALESCE(substring(file_path from '[?&]file=([^&]+)'),
+			CASE WHEN file_path !~ '^[a-z]+://' THEN file_path END)
+		WHERE file_key IS NULL AND file_path <> ''`,
+	`CREATE INDEX IF NOT EXISTS idx_nfa_files_key ON nfa_files (file_key)`,
+	`CREATE INDEX IF NOT EXISTS idx_nfa_comment_files_name ON nfa_comment_files (file_name)`,
+
+	// Malware scan verdicts. Uploads wait as pending until the scanner has
+	// seen them; files from before scanning count as not_scanned
+	`ALTER TABLE uploaded_files ADD COLUMN IF NOT EXISTS scan_status VARCHAR(20) NOT NULL DEFAULT 'not_scanned'`,
+	`ALTER TABLE uploaded_files ADD COLUMN IF NOT EXISTS scan_result TEXT`,
+	`ALTER TABLE uploaded_files ADD COLUMN IF NOT EXISTS scanned_at TIMESTAMP`,
+	`CREATE INDEX IF NOT EXISTS idx_uploaded_files_pending ON uploaded_files (id) WHERE scan_status = 'pending'`,
+	// Scans that gave no verdict; after too many the upload is marked failed
+	`ALTER TABLE uploaded_files ADD COLUMN IF NOT EXISTS scan_attempts INT NOT NULL DEFAULT 0`,
+}
+
+// MigrateSchema applies schemaStatements against the database.
+func MigrateSchema(db *sql.DB) error {
+	for i, stmt := range schemaStatements {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("schema statement %d failed: %v", i+1, err)
+		}
+	}
+	return nil
+}
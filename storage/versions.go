@@ -0,0 +1,53 @@
+package storage
+
+import "fmt"
+
+// RecordNFAVersion snapshots the editable content of the NFA, including its
+// approval list and files, as the next version. userID may be zero when the
+// editor is not known.
+func RecordNFAVersion(q Querier, nfaID, userID int) (int, error) {
+	var version int
+	err := q.QueryRow(`
+		INSERT INTO nfa_versions (nfa_id, version, snapshot, created_by)
+		SELECT n.nfa_id,
+		       COALESCE((SELECT MAX(v.version) FROM nfa_versions v WHERE v.nfa_id = n.nfa_id), 0) + 1,
+		       jsonb_build_object(
+		           'project_id', n.project_id,
+		           'tower_id', n.tower_id,
+		           'area_id', n.area_id,
+		           'department_id', n.department_id,
+		           'priority', COALESCE(n.priority, ''),
+		           'subject', COALESCE(n.subject, ''),
+		           'description', COALESCE(n.description, ''),
+		           'reference', COALESCE(n.reference, ''),
+		           'recommender', n.recommender,
+		           'last_recommender', n.last_recommender,
+		           'amount', n.amount,
+		           'currency', COALESCE(n.currency, ''),
+		           'cost_centre', COALESCE(n.cost_centre, ''),
+		           'custom_fields', n.custom_fields,
+		           'approval_list', COALESCE((
+		               SELECT jsonb_agg(jsonb_build_object(
+		                   'approver_id', al.approver_id,
+		                   'order_value', al.order_value,
+		                   'approval_rule', al.approval_rule,
+		                   'required_approvals', al.required_approvals)
+		                   ORDER BY al.order_value, al.approver_id)
+		               FROM nfa_approval_list al WHERE al.nfa_id = n.nfa_id), '[]'::jsonb),
+		           'files', COALESCE((
+		               SELECT jsonb_agg(jsonb_build_object(
+		                   'file_name', COALESCE(f.file_name, ''),
+		                   'file_path', COALESCE(f.file_path, ''),
+		                   'file_type', COALESCE(f.file_type, ''))
+		                   ORDER BY f.id)
+		               FROM nfa_files f WHERE f.nfa_id = n.nfa_id), '[]'::jsonb)
+		       ),
+		       NULLIF($2, 0)
+		FROM nfa n
+		WHERE n.nfa_id = $1
+		RETURNING version`, nfaID, userID).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record NFA version: %v", err)
+	}
+	return version, nil
+}
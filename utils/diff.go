@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+)
+
+// DiffSegment is a run of text that is unchanged, inserted or deleted.
+type DiffSegment struct {
+	Op   string `json:"op"` // "equal", "insert" or "delete"
+	Text string `json:"text"`
+}
+
+// maxDiffTokens and maxDiffEdits bound the work done by DiffTokens; larger
+// inputs, or ones that differ in more than maxDiffEdits tokens, are reported
+// as a single replacement.
+const (
+	maxDiffTokens = 20000
+	maxDiffEdits  = 1000
+)
+
+var htmlTokenPattern = regexp.MustCompile(`<[^>]*>|\s+|[^\s<]+`)
+
+// TokenizeHTML splits HTML into tags, whitespace runs and words, so a diff
+// never cuts through the middle of a tag.
+func TokenizeHTML(html string) []string {
+	return htmlTokenPattern.FindAllString(html, -1)
+}
+
+// DiffHTML returns a word-level diff of two HTML fragments.
+func DiffHTML(from, to string) []DiffSegment {
+	return DiffTokens(TokenizeHTML(from), TokenizeHTML(to))
+}
+
+// DiffTokens computes the shortest edit script between two token lists using
+// Myers' algorithm and returns it as merged segments.
+func DiffTokens(a, b []string) []DiffSegment {
+	// Common prefix and suffix do not need to go through the algorithm
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var ops []DiffSegment
+	add := func(op, text string) {
+		if text == "" {
+			return
+		}
+		if n := len(ops); n > 0 && ops[n-1].Op == op {
+			ops[n-1].Text += text
+			return
+		}
+		ops = append(ops, DiffSegment{Op: op, Text: text})
+	}
+
+	add("equal", strings.Join(a[:prefix], ""))
+	for _, segment := range myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]) {
+		add(segment.Op, segment.Text)
+	}
+	add("equal", strings.Join(a[len(a)-suffix:], ""))
+
+	if ops == nil {
+		ops = []DiffSegment{}
+	}
+	return ops
+}
+
+func myers(a, b []string) []DiffSegment {
+	n, m := len(a), len(b)
+	if n == 0 && m == 0 {
+		return nil
+	}
+	replace := []DiffSegment{
+		{Op: "delete", Text: strings.Join(a, "")},
+		{Op: "insert", Text: strings.Join(b, "")},
+	}
+	if n+m > maxDiffTokens || n == 0 || m == 0 {
+		return replace
+	}
+
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	// trace[d] keeps v[-d..d] as it was before step d; that window is all
+	// the walk back reads, so the trace grows with d² rather than d·(n+m)
+	var trace [][]int
+
+search:
+	for d := 0; ; d++ {
+		if d > maxDiffEdits {
+			return replace
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// Walk the trace backwards to recover the edits, then reverse them
+	var reversed []DiffSegment
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[d+k-1] < v[d+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := 0
+		if d > 0 {
+			prevX = v[d+prevK]
+		}
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			reversed = append(reversed, DiffSegment{Op: "equal", Text: a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				reversed = append(reversed, DiffSegment{Op: "insert", Text: b[prevY]})
+			} else {
+				reversed = append(reversed, DiffSegment{Op: "delete", Text: a[prevX]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	segments := make([]DiffSegment, len(reversed))
+	for i, segment := range reversed {
+		segments[len(reversed)-1-i] = segment
+	}
+	return segments
+}
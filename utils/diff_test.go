@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"math/rand"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// apply rebuilds both sides of a diff: equal and delete segments give the
+// old text, equal and insert segments the new one.
+func apply(segments []DiffSegment) (from, to string) {
+	var a, b strings.Builder
+	for _, segment := range segments {
+		switch segment.Op {
+		case "equal":
+			a.WriteString(segment.Text)
+			b.WriteString(segment.Text)
+		case "delete":
+			a.WriteString(segment.Text)
+		case "insert":
+			b.WriteString(segment.Text)
+		}
+	}
+	return a.String(), b.String()
+}
+
+func TestTokenizeHTML(t *testing.T) {
+	got := TokenizeHTML(`<p class="x">Buy  two<br/>pumps</p>`)
+	want := []string{`<p class="x">`, "Buy", "  ", "two", "<br/>", "pumps", "</p>"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("TokenizeHTML() = %q, want %q", got, want)
+	}
+}
+
+func TestDiffHTML(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		want     []DiffSegment
+	}{
+		{"equal", "<p>same</p>", "<p>same</p>", []DiffSegment{{"equal", "<p>same</p>"}}},
+		{"both empty", "", "", []DiffSegment{}},
+		{"from empty", "", "new", []DiffSegment{{"insert", "new"}}},
+		{"to empty", "old", "", []DiffSegment{{"delete", "old"}}},
+		{"word changed", "<p>buy two pumps</p>", "<p>buy three pumps</p>", []DiffSegment{
+			{"equal", "<p>buy "}, {"delete", "two"}, {"insert", "three"}, {"equal", " pumps</p>"}}},
+		{"word inserted", "buy pumps", "buy two pumps", []DiffSegment{
+			{"equal", "buy "}, {"insert", "two "}, {"equal", "pumps"}}},
+		{"tag changed", "<p>pumps</p>", "<li>pumps</li>", []DiffSegment{
+			{"delete", "<p>"}, {"insert", "<li>"}, {"equal", "pumps"}, {"delete", "</p>"}, {"insert", "</li>"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DiffHTML(tt.from, tt.to)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DiffHTML() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// lcs is the textbook dynamic programming answer the diff is checked against.
+func lcs(a, b []string) int {
+	table := make([][]int, len(a)+1)
+	for i := range table {
+		table[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				table[i][j] = table[i+1][j+1] + 1
+			} else {
+				table[i][j] = max(table[i+1][j], table[i][j+1])
+			}
+		}
+	}
+	return table[0][0]
+}
+
+func TestDiffTokensIsMinimal(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	words := func(n int) []string {
+		tokens := make([]string, n)
+		for i := range tokens {
+			tokens[i] = strconv.Itoa(random.Intn(4)) + " "
+		}
+		return tokens
+	}
+
+	for i := 0; i < 500; i++ {
+		a, b := words(random.Intn(30)), words(random.Intn(30))
+		segments := DiffTokens(a, b)
+
+		from, to := apply(segments)
+		if from != strings.Join(a, "") || to != strings.Join(b, "") {
+			t.Fatalf("DiffTokens(%q, %q) = %+v does not rebuild the inputs", a, b, segments)
+		}
+		equal := 0
+		for _, segment := range segments {
+			if segment.Op == "equal" {
+				equal += strings.Count(segment.Text, " ")
+			}
+		}
+		if want := lcs(a, b); equal != want {
+			t.Fatalf("DiffTokens(%q, %q) keeps %d tokens, want %d", a, b, equal, want)
+		}
+	}
+}
+
+func TestDiffTokensGivesUp(t *testing.T) {
+	unrelated := func(prefix string, n int) []string {
+		tokens := make([]string, n)
+		for i := range tokens {
+			tokens[i] = prefix + strconv.Itoa(i) + " "
+		}
+		return tokens
+	}
+
+	tests := []struct {
+		name string
+		a, b []string
+	}{
+		{"too many edits", unrelated("a", 2000), unrelated("b", 2000)},
+		{"too many tokens", unrelated("a", maxDiffTokens), unrelated("b", 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DiffTokens(tt.a, tt.b)
+			want := []DiffSegment{
+				{"delete", strings.Join(tt.a, "")},
+				{"insert", strings.Join(tt.b, "")},
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("DiffTokens() returned %d segments, want a single replacement", len(got))
+			}
+		})
+	}
+}
+
+// Two long descriptions that differ everywhere used to keep a full copy of
+// the search state for every edit, hundreds of MiB per diff.
+func TestDiffTokensMemory(t *testing.T) {
+	a := make([]string, 0, 4000)
+	b := make([]string, 0, 4000)
+	for i := 0; i < 2000; i++ {
+		word := strconv.Itoa(i) + " "
+		a = append(a, word, "old ")
+		b = append(b, word, "new ")
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	DiffTokens(a, b)
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 32<<20 {
+		t.Errorf("DiffTokens() allocated %d MiB", allocated>>20)
+	}
+}
@@ -0,0 +1,134 @@
+package workflow
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeNFA is the data behind a fake database holding a single NFA. It
+// answers the handful of queries this package runs and records the writes.
+type fakeNFA struct {
+	missing     bool
+	status      string
+	approvers   int
+	outstanding int
+	stage       Stage
+	stageRule   string
+	history     []string
+}
+
+var (
+	fakeMu  sync.Mutex
+	fakeDBs = map[string]*fakeNFA{}
+)
+
+func init() {
+	sql.Register("workflowfake", fakeDriver{})
+}
+
+// openFake returns a transaction on a fake database backed by nfa.
+func openFake(t *testing.T, nfa *fakeNFA) *sql.Tx {
+	t.Helper()
+	fakeMu.Lock()
+	fakeDBs[t.Name()] = nfa
+	fakeMu.Unlock()
+
+	db, err := sql.Open("workflowfake", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		tx.Rollback()
+		db.Close()
+		fakeMu.Lock()
+		delete(fakeDBs, t.Name())
+		fakeMu.Unlock()
+	})
+	return tx
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeMu.Lock()
+	defer fakeMu.Unlock()
+	nfa, ok := fakeDBs[name]
+	if !ok {
+		return nil, fmt.Errorf("no fake database %q", name)
+	}
+	return &fakeConn{nfa: nfa}, nil
+}
+
+type fakeConn struct {
+	nfa *fakeNFA
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("prepare is not supported")
+}
+
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *fakeConn) Commit() error             { return nil }
+func (c *fakeConn) Rollback() error           { return nil }
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	n := c.nfa
+	switch {
+	case strings.Contains(query, "FROM nfa WHERE nfa_id") && strings.Contains(query, "FOR UPDATE"):
+		if n.missing {
+			return &fakeRows{columns: 1}, nil
+		}
+		return &fakeRows{columns: 1, values: [][]driver.Value{{n.status}}}, nil
+	case strings.Contains(query, "approval_rule"):
+		s := n.stage
+		return &fakeRows{columns: 5, values: [][]driver.Value{
+			{n.stageRule, int64(s.Required), int64(s.Total), int64(s.Approved), int64(s.Rejected)},
+		}}, nil
+	case strings.Contains(query, "IN ('Pending', 'Waiting')"):
+		return &fakeRows{columns: 1, values: [][]driver.Value{{int64(n.outstanding)}}}, nil
+	case strings.Contains(query, "COUNT(*) FROM nfa_approval_list"):
+		return &fakeRows{columns: 1, values: [][]driver.Value{{int64(n.approvers)}}}, nil
+	}
+	return nil, fmt.Errorf("unexpected query: %s", query)
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	n := c.nfa
+	switch {
+	case strings.Contains(query, "UPDATE nfa SET status"):
+		n.status = args[0].Value.(string)
+	case strings.Contains(query, "INSERT INTO nfa_status_history"):
+		n.history = append(n.history, fmt.Sprintf("%v->%v", args[1].Value, args[2].Value))
+	default:
+		return nil, fmt.Errorf("unexpected statement: %s", query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+type fakeRows struct {
+	columns int
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return make([]string, r.columns) }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
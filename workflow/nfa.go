@@ -0,0 +1,91 @@
+package workflow
+
+import "fmt"
+
+// NFA is the lifecycle every note for approval follows:
+//
+//	Draft --(submitted by the initiator)--> Pending
+//	Pending --(recommender approves, no approvers)--> Completed
+//	Pending --(recommender approves)--> Initiated
+//	Pending --(recommender rejects)--> Rejected
+//	Initiated --(last approver approves)--> Completed
+//	Initiated --(an approver rejects)--> Rejected_By_Approver
+//	Pending, Initiated --(sent back for clarification)--> Returned
+//	Returned --(resubmitted, returned by the recommender)--> Pending
+//	Returned --(resubmitted or answered, returned by an approver)--> Initiated
+//	Returned --(the approver it was returned to rejects)--> Rejected_By_Approver
+//	Pending, Initiated, Returned --(withdrawn by the initiator)--> Withdrawn
+var NFA = newNFAMachine()
+
+func newNFAMachine() *Machine {
+	m := NewMachine()
+
+	m.Allow(StateDraft, StatePending)
+	m.Allow(StatePending, StateInitiated, StateCompleted, StateRejected, StateReturned, StateWithdrawn)
+	m.Allow(StateInitiated, StateCompleted, StateRejectedByApprover, StateReturned, StateWithdrawn)
+	m.Allow(StateReturned, StatePending, StateInitiated, StateRejectedByApprover, StateWithdrawn)
+
+	m.Guard(StatePending, StateInitiated, hasApprovers)
+	m.Guard(StatePending, StateCompleted, hasNoApprovers)
+	m.Guard(StateInitiated, StateCompleted, noApprovalsOutstanding)
+
+	m.OnTransition(recordHistory)
+	return m
+}
+
+func countApprovers(ctx *Context) (int, error) {
+	var count int
+	err := ctx.Tx.QueryRow(`SELECT COUNT(*) FROM nfa_approval_list WHERE nfa_id = $1`, ctx.NFAID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count approvers: %v", err)
+	}
+	return count, nil
+}
+
+func hasApprovers(ctx *Context) error {
+	count, err := countApprovers(ctx)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return Refuse("the NFA has no approvers")
+	}
+	return nil
+}
+
+func hasNoApprovers(ctx *Context) error {
+	count, err := countApprovers(ctx)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return Refuse("the NFA still has %d approver(s) to go through", count)
+	}
+	return nil
+}
+
+func noApprovalsOutstanding(ctx *Context) error {
+	var outstanding int
+	err := ctx.Tx.QueryRow(`
+		SELECT COUNT(*) FROM nfa_approval_list
+		WHERE nfa_id = $1 AND COALESCE(status, 'Waiting') IN ('Pending', 'Waiting')`,
+		ctx.NFAID).Scan(&outstanding)
+	if err != nil {
+		return fmt.Errorf("failed to check outstanding approvals: %v", err)
+	}
+	if outstanding > 0 {
+		return Refuse("%d approval(s) are still outstanding", outstanding)
+	}
+	return nil
+}
+
+func recordHistory(ctx *Context) error {
+	_, err := ctx.Tx.Exec(`
+		INSERT INTO nfa_status_history (nfa_id, from_status, to_status, actor_id, comment)
+		VALUES ($1, $2, $3, NULLIF($4, 0), NULLIF($5, ''))`,
+		ctx.NFAID, string(ctx.From), string(ctx.To), ctx.ActorID, ctx.Comment)
+	if err != nil {
+		return fmt.Errorf("failed to record status history: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package workflow
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// ApprovalRule decides when a stage of approvers sharing one order_value is
+// complete.
+type ApprovalRule string
+
+const (
+	RuleAll ApprovalRule = "all" // every approver in the stage must approve
+	RuleAny ApprovalRule = "any" // any N of the M approvers must approve
+)
+
+// ParseRule converts a stored rule into an ApprovalRule. An empty rule means
+// RuleAll, which is how single-approver stages behave.
+func ParseRule(s string) (ApprovalRule, error) {
+	switch ApprovalRule(s) {
+	case "", RuleAll:
+		return RuleAll, nil
+	case RuleAny:
+		return RuleAny, nil
+	}
+	return "", fmt.Errorf("unknown approval rule '%s'", s)
+}
+
+// Stage is the state of one group of parallel approvers.
+type Stage struct {
+	Order    int
+	Rule     ApprovalRule
+	Required int // N for RuleAny; ignored for RuleAll
+	Total    int
+	Approved int
+	Rejected int
+}
+
+// RequiredApprovals returns how many approvals complete the stage.
+func (s Stage) RequiredApprovals() int {
+	if s.Rule != RuleAny || s.Required <= 0 || s.Required > s.Total {
+		return s.Total
+	}
+	return s.Required
+}
+
+// Satisfied reports whether enough approvers have approved.
+func (s Stage) Satisfied() bool {
+	return s.Approved >= s.RequiredApprovals()
+}
+
+// Failed reports whether rejections have made the stage impossible to
+// satisfy.
+func (s Stage) Failed() bool {
+	return s.Total-s.Rejected < s.RequiredApprovals()
+}
+
+// ValidateStage checks the rule settings given for a stage with total
+// approvers.
+func ValidateStage(order int, rule string, required, total int) error {
+	r, err := ParseRule(rule)
+	if err != nil {
+		return fmt.Errorf("stage %d: %v", order, err)
+	}
+	if r == RuleAny && (required < 1 || required > total) {
+		return fmt.Errorf("stage %d: required_approvals must be between 1 and %d", order, total)
+	}
+	return nil
+}
+
+// LoadStage reads the current counts for the stage at the given order.
+func LoadStage(tx *sql.Tx, nfaID, order int) (Stage, error) {
+	stage := Stage{Order: order}
+	var rule string
+	err := tx.QueryRow(`
+		SELECT
+			COALESCE(MAX(approval_rule), ''),
+			COALESCE(MAX(required_approvals), 0),
+			COUNT(*),
+			COUNT(*) FILTER (WHERE status = 'Approved'),
+			COUNT(*) FILTER (WHERE status = 'Rejected')
+		FROM nfa_approval_list
+		WHERE nfa_id = $1 AND order_value = $2`,
+		nfaID, order).Scan(&rule, &stage.Required, &stage.Total, &stage.Approved, &stage.Rejected)
+	if err != nil {
+		return stage, fmt.Errorf("failed to load approval stage: %v", err)
+	}
+	if stage.Rule, err = ParseRule(rule); err != nil {
+		return stage, err
+	}
+	return stage, nil
+}
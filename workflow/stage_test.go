@@ -0,0 +1,104 @@
+package workflow
+
+import "testing"
+
+func TestStageSatisfiedAndFailed(t *testing.T) {
+	tests := []struct {
+		name          string
+		stage         Stage
+		wantSatisfied bool
+		wantFailed    bool
+	}{
+		{"single approver waiting", Stage{Rule: RuleAll, Total: 1}, false, false},
+		{"single approver approved", Stage{Rule: RuleAll, Total: 1, Approved: 1}, true, false},
+		{"single approver rejected", Stage{Rule: RuleAll, Total: 1, Rejected: 1}, false, true},
+		{"all: some approved", Stage{Rule: RuleAll, Total: 3, Approved: 2}, false, false},
+		{"all: every one approved", Stage{Rule: RuleAll, Total: 3, Approved: 3}, true, false},
+		{"all: one rejection fails it", Stage{Rule: RuleAll, Total: 3, Approved: 2, Rejected: 1}, false, true},
+		{"all: Required is ignored", Stage{Rule: RuleAll, Required: 1, Total: 3, Approved: 1}, false, false},
+		{"any: below N", Stage{Rule: RuleAny, Required: 2, Total: 3, Approved: 1}, false, false},
+		{"any: N reached", Stage{Rule: RuleAny, Required: 2, Total: 3, Approved: 2}, true, false},
+		{"any: rejection still leaves N reachable", Stage{Rule: RuleAny, Required: 2, Total: 3, Rejected: 1}, false, false},
+		{"any: rejections make N unreachable", Stage{Rule: RuleAny, Required: 2, Total: 3, Approved: 1, Rejected: 2}, false, true},
+		{"any: N above total falls back to all", Stage{Rule: RuleAny, Required: 5, Total: 2, Approved: 1}, false, false},
+		{"any: N of zero falls back to all", Stage{Rule: RuleAny, Total: 2, Approved: 2}, true, false},
+		{"empty stage", Stage{Rule: RuleAll}, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.stage.Satisfied(); got != tt.wantSatisfied {
+				t.Errorf("Satisfied() = %v, want %v", got, tt.wantSatisfied)
+			}
+			if got := tt.stage.Failed(); got != tt.wantFailed {
+				t.Errorf("Failed() = %v, want %v", got, tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ApprovalRule
+		wantErr bool
+	}{
+		{"", RuleAll, false},
+		{"all", RuleAll, false},
+		{"any", RuleAny, false},
+		{"ALL", "", true},
+		{"majority", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRule(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseRule(%q) = %q, %v; want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateStage(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     string
+		required int
+		total    int
+		wantErr  bool
+	}{
+		{"default rule", "", 0, 1, false},
+		{"all ignores required", "all", 9, 2, false},
+		{"any within range", "any", 2, 3, false},
+		{"any of all", "any", 3, 3, false},
+		{"any needs at least one", "any", 0, 3, true},
+		{"any above total", "any", 4, 3, true},
+		{"unknown rule", "most", 1, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateStage(1, tt.rule, tt.required, tt.total)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateStage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadStage(t *testing.T) {
+	nfa := &fakeNFA{stageRule: "any", stage: Stage{Required: 2, Total: 3, Approved: 2, Rejected: 1}}
+	stage, err := LoadStage(openFake(t, nfa), 1, 4)
+	if err != nil {
+		t.Fatalf("LoadStage() error = %v", err)
+	}
+	want := Stage{Order: 4, Rule: RuleAny, Required: 2, Total: 3, Approved: 2, Rejected: 1}
+	if stage != want {
+		t.Errorf("LoadStage() = %+v, want %+v", stage, want)
+	}
+	if !stage.Satisfied() {
+		t.Error("loaded stage is not satisfied")
+	}
+
+	nfa = &fakeNFA{stageRule: "quorum", stage: Stage{Total: 1}}
+	if _, err := LoadStage(openFake(t, nfa), 1, 1); err == nil {
+		t.Error("LoadStage() accepted an unknown rule")
+	}
+}
@@ -0,0 +1,183 @@
+package workflow
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// State is a lifecycle state stored in nfa.status.
+type State string
+
+const (
+	StateDraft              State = "Draft"     // being written; visible only to the initiator
+	StatePending            State = "Pending"   // waiting on the recommender
+	StateInitiated          State = "Initiated" // moving through the approval list
+	StateCompleted          State = "Completed"
+	StateRejected           State = "Rejected" // rejected by the recommender
+	StateRejectedByApprover State = "Rejected_By_Approver"
+	StateReturned           State = "Returned"  // sent back for clarification
+	StateWithdrawn          State = "Withdrawn" // recalled by the initiator
+)
+
+// InitialState is the state an NFA starts in once it is submitted.
+const InitialState = StatePending
+
+var knownStates = map[State]bool{
+	StateDraft:              true,
+	StatePending:            true,
+	StateInitiated:          true,
+	StateCompleted:          true,
+	StateRejected:           true,
+	StateRejectedByApprover: true,
+	StateReturned:           true,
+	StateWithdrawn:          true,
+}
+
+// ParseState converts a stored status string into a State.
+func ParseState(s string) (State, error) {
+	state := State(s)
+	if !knownStates[state] {
+		return "", fmt.Errorf("unknown NFA status '%s'", s)
+	}
+	return state, nil
+}
+
+// ErrNFANotFound is returned when the NFA being transitioned does not exist.
+var ErrNFANotFound = errors.New("NFA not found")
+
+// TransitionError is returned when a status change is not allowed, either
+// because the transition is not defined or because a guard refused it.
+type TransitionError struct {
+	From   State
+	To     State
+	Reason string
+}
+
+func (e *TransitionError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("cannot move NFA from '%s' to '%s'", e.From, e.To)
+	}
+	return fmt.Sprintf("cannot move NFA from '%s' to '%s': %s", e.From, e.To, e.Reason)
+}
+
+// Context describes a single transition while it is being applied.
+type Context struct {
+	Tx      *sql.Tx
+	NFAID   int
+	ActorID int
+	Comment string
+	From    State
+	To      State
+}
+
+// Guard decides whether a transition may happen. A guard refuses a
+// transition by returning Refuse; any other error is treated as a failure
+// to evaluate the guard.
+type Guard func(ctx *Context) error
+
+// Refuse builds the error a guard returns to block a transition.
+func Refuse(format string, args ...interface{}) error {
+	return &TransitionError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// Hook runs after the status has been written, inside the same transaction.
+type Hook func(ctx *Context) error
+
+type transition struct {
+	from State
+	to   State
+}
+
+// Machine holds the allowed transitions between states together with their
+// guards and hooks.
+type Machine struct {
+	allowed map[transition]bool
+	guards  map[transition][]Guard
+	hooks   []Hook
+}
+
+// NewMachine returns an empty machine with no allowed transitions.
+func NewMachine() *Machine {
+	return &Machine{
+		allowed: make(map[transition]bool),
+		guards:  make(map[transition][]Guard),
+	}
+}
+
+// Allow registers transitions from one state to each of the given states.
+func (m *Machine) Allow(from State, to ...State) {
+	for _, t := range to {
+		m.allowed[transition{from, t}] = true
+	}
+}
+
+// Guard attaches a guard to an allowed transition.
+func (m *Machine) Guard(from, to State, g Guard) {
+	key := transition{from, to}
+	m.guards[key] = append(m.guards[key], g)
+}
+
+// OnTransition registers a hook that runs after every successful transition.
+func (m *Machine) OnTransition(h Hook) {
+	m.hooks = append(m.hooks, h)
+}
+
+// Can reports whether the transition is defined, without running guards.
+func (m *Machine) Can(from, to State) bool {
+	return m.allowed[transition{from, to}]
+}
+
+// IsFinal reports whether no transition leaves the state.
+func (m *Machine) IsFinal(s State) bool {
+	for t := range m.allowed {
+		if t.from == s {
+			return false
+		}
+	}
+	return true
+}
+
+// Transition moves the NFA to the given state. The current status is read
+// with a row lock so concurrent actions on the same NFA are serialised.
+func (m *Machine) Transition(tx *sql.Tx, nfaID int, to State, actorID int, comment string) error {
+	var current string
+	err := tx.QueryRow(`SELECT COALESCE(status, '') FROM nfa WHERE nfa_id = $1 FOR UPDATE`, nfaID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return ErrNFANotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to read NFA status: %v", err)
+	}
+
+	from, err := ParseState(current)
+	if err != nil {
+		return &TransitionError{From: State(current), To: to, Reason: err.Error()}
+	}
+
+	key := transition{from, to}
+	if !m.allowed[key] {
+		return &TransitionError{From: from, To: to}
+	}
+
+	ctx := &Context{Tx: tx, NFAID: nfaID, ActorID: actorID, Comment: comment, From: from, To: to}
+	for _, g := range m.guards[key] {
+		if err := g(ctx); err != nil {
+			var te *TransitionError
+			if errors.As(err, &te) {
+				return &TransitionError{From: from, To: to, Reason: te.Reason}
+			}
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE nfa SET status = $1 WHERE nfa_id = $2`, string(to), nfaID); err != nil {
+		return fmt.Errorf("failed to update NFA status: %v", err)
+	}
+
+	for _, h := range m.hooks {
+		if err := h(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package workflow
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNFATransitions(t *testing.T) {
+	tests := []struct {
+		name        string
+		from        State
+		to          State
+		approvers   int
+		outstanding int
+		wantErr     bool
+	}{
+		{"submit draft", StateDraft, StatePending, 0, 0, false},
+		{"recommender approves with approvers", StatePending, StateInitiated, 2, 2, false},
+		{"recommender approves without approvers", StatePending, StateCompleted, 0, 0, false},
+		{"recommender rejects", StatePending, StateRejected, 1, 1, false},
+		{"recommender returns", StatePending, StateReturned, 1, 1, false},
+		{"initiator withdraws pending", StatePending, StateWithdrawn, 1, 1, false},
+		{"last approver approves", StateInitiated, StateCompleted, 2, 0, false},
+		{"approver rejects", StateInitiated, StateRejectedByApprover, 2, 1, false},
+		{"approver returns", StateInitiated, StateReturned, 2, 1, false},
+		{"initiator withdraws initiated", StateInitiated, StateWithdrawn, 2, 1, false},
+		{"resubmitted to recommender", StateReturned, StatePending, 1, 1, false},
+		{"resubmitted to approver", StateReturned, StateInitiated, 1, 1, false},
+		{"returned then rejected", StateReturned, StateRejectedByApprover, 1, 1, false},
+		{"initiator withdraws returned", StateReturned, StateWithdrawn, 1, 1, false},
+
+		{"guard: initiated without approvers", StatePending, StateInitiated, 0, 0, true},
+		{"guard: completed with approvers left", StatePending, StateCompleted, 1, 1, true},
+		{"guard: completed with approvals outstanding", StateInitiated, StateCompleted, 2, 1, true},
+
+		{"draft cannot complete", StateDraft, StateCompleted, 0, 0, true},
+		{"pending cannot go back to draft", StatePending, StateDraft, 0, 0, true},
+		{"completed is final", StateCompleted, StatePending, 0, 0, true},
+		{"rejected is final", StateRejected, StatePending, 0, 0, true},
+		{"withdrawn is final", StateWithdrawn, StateInitiated, 1, 1, true},
+		{"recommender rejection is not an approver rejection", StatePending, StateRejectedByApprover, 1, 1, true},
+		{"no transition to the same state", StateInitiated, StateInitiated, 1, 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nfa := &fakeNFA{status: string(tt.from), approvers: tt.approvers, outstanding: tt.outstanding}
+			tx := openFake(t, nfa)
+
+			err := NFA.Transition(tx, 1, tt.to, 7, "comment")
+			if tt.wantErr {
+				var te *TransitionError
+				if !errors.As(err, &te) {
+					t.Fatalf("Transition() error = %v, want a TransitionError", err)
+				}
+				if te.From != tt.from || te.To != tt.to {
+					t.Errorf("TransitionError is %s -> %s, want %s -> %s", te.From, te.To, tt.from, tt.to)
+				}
+				if nfa.status != string(tt.from) {
+					t.Errorf("status changed to %s on a refused transition", nfa.status)
+				}
+				if len(nfa.history) != 0 {
+					t.Errorf("history recorded on a refused transition: %v", nfa.history)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Transition() error = %v", err)
+			}
+			if nfa.status != string(tt.to) {
+				t.Errorf("status = %s, want %s", nfa.status, tt.to)
+			}
+			want := string(tt.from) + "->" + string(tt.to)
+			if len(nfa.history) != 1 || nfa.history[0] != want {
+				t.Errorf("history = %v, want [%s]", nfa.history, want)
+			}
+		})
+	}
+}
+
+func TestTransitionNotFound(t *testing.T) {
+	tx := openFake(t, &fakeNFA{missing: true})
+	if err := NFA.Transition(tx, 1, StatePending, 7, ""); !errors.Is(err, ErrNFANotFound) {
+		t.Fatalf("Transition() error = %v, want ErrNFANotFound", err)
+	}
+}
+
+func TestTransitionUnknownStatus(t *testing.T) {
+	nfa := &fakeNFA{status: "Archived"}
+	tx := openFake(t, nfa)
+
+	err := NFA.Transition(tx, 1, StatePending, 7, "")
+	var te *TransitionError
+	if !errors.As(err, &te) {
+		t.Fatalf("Transition() error = %v, want a TransitionError", err)
+	}
+	if nfa.status != "Archived" {
+		t.Errorf("status changed to %s", nfa.status)
+	}
+}
+
+func TestGuardFailure(t *testing.T) {
+	m := NewMachine()
+	m.Allow(StatePending, StateCompleted)
+	broken := errors.New("database is down")
+	m.Guard(StatePending, StateCompleted, func(ctx *Context) error { return broken })
+
+	nfa := &fakeNFA{status: string(StatePending)}
+	err := m.Transition(openFake(t, nfa), 1, StateCompleted, 7, "")
+	if !errors.Is(err, broken) {
+		t.Fatalf("Transition() error = %v, want the guard's error", err)
+	}
+	var te *TransitionError
+	if errors.As(err, &te) {
+		t.Errorf("a failing guard was reported as a refusal: %v", err)
+	}
+	if nfa.status != string(StatePending) {
+		t.Errorf("status changed to %s", nfa.status)
+	}
+}
+
+func TestIsFinal(t *testing.T) {
+	final := map[State]bool{
+		StateCompleted:          true,
+		StateRejected:           true,
+		StateRejectedByApprover: true,
+		StateWithdrawn:          true,
+	}
+	for state := range knownStates {
+		if got := NFA.IsFinal(state); got != final[state] {
+			t.Errorf("IsFinal(%s) = %v, want %v", state, got, final[state])
+		}
+	}
+}
+
+func TestParseState(t *testing.T) {
+	for state := range knownStates {
+		got, err := ParseState(string(state))
+		if err != nil || got != state {
+			t.Errorf("ParseState(%q) = %q, %v", state, got, err)
+		}
+	}
+	for _, s := range []string{"", "pending", "Archived"} {
+		if _, err := ParseState(s); err == nil {
+			t.Errorf("ParseState(%q) succeeded, want an error", s)
+		}
+	}
+}